@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/armadillica/pillar-statscollector/mongo"
+	"github.com/armadillica/pillar-statscollector/sink"
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// step is the interval between the timestamps collected by a backfill. Timestamps are aligned to
+// the step in UTC, for example to midnight for daily steps.
+type step struct {
+	name string
+	// truncate returns the latest step boundary at or before t.
+	truncate func(t time.Time) time.Time
+	// next returns the step boundary after boundary t.
+	next func(t time.Time) time.Time
+}
+
+func truncateDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+var steps = map[string]step{
+	"hourly": {
+		truncate: func(t time.Time) time.Time { return t.Truncate(time.Hour) },
+		next:     func(t time.Time) time.Time { return t.Add(time.Hour) },
+	},
+	"daily": {
+		truncate: truncateDay,
+		next:     func(t time.Time) time.Time { return t.AddDate(0, 0, 1) },
+	},
+	"weekly": {
+		// Weeks start on Monday.
+		truncate: func(t time.Time) time.Time {
+			day := truncateDay(t)
+			return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+		},
+		next: func(t time.Time) time.Time { return t.AddDate(0, 0, 7) },
+	},
+	"monthly": {
+		truncate: func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC) },
+		next:     func(t time.Time) time.Time { return t.AddDate(0, 1, 0) },
+	},
+}
+
+func parseStep(name string) (step, error) {
+	s, found := steps[name]
+	if !found {
+		names := []string{}
+		for name := range steps {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return step{}, fmt.Errorf("unknown step %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	s.name = name
+	return s, nil
+}
+
+// previous returns the step boundary before boundary t.
+func (s step) previous(t time.Time) time.Time {
+	return s.truncate(t.Add(-time.Nanosecond))
+}
+
+// backfillSlots returns the step boundaries after begin, up to and including until.
+func backfillSlots(begin, until time.Time, s step) []time.Time {
+	slots := []time.Time{}
+	for slot := s.next(s.truncate(begin.UTC())); !slot.After(until); slot = s.next(slot) {
+		slots = append(slots, slot)
+	}
+	return slots
+}
+
+// pendingSlots returns the slots that still have to be collected. Slots are skipped when the
+// checkpoint says they were completed, unless they failed, or when there is a document with a
+// timestamp in the step leading up to the slot.
+func pendingSlots(slots []time.Time, s step, checkpoint mongo.Checkpoint, existing []time.Time) []time.Time {
+	covered := map[int64]bool{}
+	for _, timestamp := range existing {
+		slot := s.truncate(timestamp)
+		if !slot.Equal(timestamp) {
+			slot = s.next(slot)
+		}
+		covered[slot.Unix()] = true
+	}
+	failed := map[int64]bool{}
+	for _, timestamp := range checkpoint.Failed {
+		failed[timestamp.Unix()] = true
+	}
+
+	pending := []time.Time{}
+	for _, slot := range slots {
+		if covered[slot.Unix()] {
+			continue
+		}
+		if !slot.After(checkpoint.Completed) && !failed[slot.Unix()] {
+			continue
+		}
+		pending = append(pending, slot)
+	}
+	return pending
+}
+
+// checkpointInterval is the number of collected timestamps between saving the checkpoint.
+const checkpointInterval = 10
+
+// backfill collects statistics for every step boundary between begin and until that doesn't have
+// a statistics document yet. Progress is checkpointed in MongoDB, so that an interrupted backfill
+// resumes where it stopped. Failures are logged, and retried when the backfill runs again.
+func backfill(ctx context.Context, mgoCloud, mgoStats *mgo.Session, output sink.Sink,
+	begin, until time.Time, s step) error {
+
+	slots := backfillSlots(begin, until, s)
+	checkpointID := fmt.Sprintf("%s-%s-%s", config.Instance, s.name, begin.UTC().Format(time.RFC3339))
+	checkpoint, err := mongo.LoadCheckpoint(mgoStats, checkpointID)
+	if err != nil {
+		return fmt.Errorf("unable to load backfill checkpoint %s: %s", checkpointID, err)
+	}
+	existing := []time.Time{}
+	if hasSink("mongo") && len(slots) > 0 {
+		existing, err = mongo.Timestamps(mgoStats, s.previous(slots[0]), until)
+		if err != nil {
+			return fmt.Errorf("unable to find existing statistics: %s", err)
+		}
+	}
+	pending := pendingSlots(slots, s, checkpoint, existing)
+
+	logger := log.WithFields(log.Fields{
+		"begin":      begin,
+		"until":      until,
+		"step":       s.name,
+		"checkpoint": checkpointID,
+	})
+	logger.WithFields(log.Fields{
+		"timestamps": len(slots),
+		"pending":    len(pending),
+	}).Warning("backfilling statistics, this may take a while")
+
+	failed := map[int64]time.Time{}
+	for _, timestamp := range checkpoint.Failed {
+		failed[timestamp.Unix()] = timestamp
+	}
+	save := func() error {
+		if cliArgs.nopush {
+			return nil
+		}
+		checkpoint.Failed = []time.Time{}
+		for _, timestamp := range failed {
+			checkpoint.Failed = append(checkpoint.Failed, timestamp)
+		}
+		sort.Slice(checkpoint.Failed, func(i, j int) bool { return checkpoint.Failed[i].Before(checkpoint.Failed[j]) })
+
+		// Buffered documents have to be pushed before they are marked as completed. This also
+		// happens when the backfill was cancelled, so don't use its context.
+		if err := output.Flush(context.Background()); err != nil {
+			return err
+		}
+		return mongo.SaveCheckpoint(mgoStats, checkpoint)
+	}
+
+	collected, failures := 0, 0
+	for idx := range pending {
+		if ctx.Err() != nil {
+			break
+		}
+		slot := pending[idx]
+		if err := singleRun(ctx, mgoCloud, output, &slot); err != nil {
+			logger.WithError(err).WithField("timestamp", slot).Error("unable to collect statistics, continuing with the next timestamp")
+			failed[slot.Unix()] = slot
+			failures++
+		} else {
+			delete(failed, slot.Unix())
+			collected++
+		}
+		if slot.After(checkpoint.Completed) {
+			checkpoint.Completed = slot
+		}
+
+		if (idx+1)%checkpointInterval == 0 {
+			if err := save(); err != nil {
+				return fmt.Errorf("unable to save backfill checkpoint: %s", err)
+			}
+		}
+	}
+	if err := save(); err != nil {
+		return fmt.Errorf("unable to save backfill checkpoint: %s", err)
+	}
+
+	logger.WithFields(log.Fields{
+		"collected": collected,
+		"failed":    failures,
+	}).Warning("done backfilling")
+	if ctx.Err() != nil {
+		return fmt.Errorf("backfill stopped after %d of %d timestamps, run again to resume: %s", collected+failures, len(pending), ctx.Err())
+	}
+	if failures > 0 {
+		return fmt.Errorf("unable to collect statistics for %d of %d timestamps, run again to retry them", failures, len(pending))
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"time"
+
+	"github.com/armadillica/pillar-statscollector/mongo"
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+)
+
+type BackfillTestSuite struct{}
+
+var _ = check.Suite(&BackfillTestSuite{})
+
+func date(year int, month time.Month, day, hour int) time.Time {
+	return time.Date(year, month, day, hour, 0, 0, 0, time.UTC)
+}
+
+func (s *BackfillTestSuite) TestParseStep(t *check.C) {
+	for _, name := range []string{"hourly", "daily", "weekly", "monthly"} {
+		parsed, err := parseStep(name)
+		assert.Nil(t, err)
+		assert.Equal(t, name, parsed.name)
+	}
+	_, err := parseStep("fortnightly")
+	assert.NotNil(t, err)
+}
+
+func (s *BackfillTestSuite) TestSlots(t *check.C) {
+	daily, _ := parseStep("daily")
+	assert.Equal(t,
+		[]time.Time{date(2018, 7, 2, 0), date(2018, 7, 3, 0), date(2018, 7, 4, 0)},
+		backfillSlots(date(2018, 7, 1, 13), date(2018, 7, 4, 0), daily))
+
+	// A begin timestamp on a boundary is not collected itself.
+	assert.Equal(t, []time.Time{date(2018, 7, 2, 0)}, backfillSlots(date(2018, 7, 1, 0), date(2018, 7, 2, 5), daily))
+
+	hourly, _ := parseStep("hourly")
+	assert.Equal(t,
+		[]time.Time{date(2018, 7, 1, 23), date(2018, 7, 2, 0)},
+		backfillSlots(date(2018, 7, 1, 22).Add(30*time.Minute), date(2018, 7, 2, 0), hourly))
+
+	// 2018-07-04 is a Wednesday; weeks start on Monday.
+	weekly, _ := parseStep("weekly")
+	assert.Equal(t,
+		[]time.Time{date(2018, 7, 9, 0), date(2018, 7, 16, 0)},
+		backfillSlots(date(2018, 7, 4, 0), date(2018, 7, 20, 0), weekly))
+
+	monthly, _ := parseStep("monthly")
+	assert.Equal(t,
+		[]time.Time{date(2018, 2, 1, 0), date(2018, 3, 1, 0)},
+		backfillSlots(date(2018, 1, 31, 0), date(2018, 3, 15, 0), monthly))
+	assert.Equal(t, date(2018, 2, 1, 0), monthly.previous(date(2018, 3, 1, 0)))
+}
+
+func (s *BackfillTestSuite) TestPendingSlots(t *check.C) {
+	daily, _ := parseStep("daily")
+	slots := backfillSlots(date(2018, 7, 1, 0), date(2018, 7, 6, 0), daily)
+
+	// A document from a cron run during the day covers the slot at the end of that day, and a
+	// document from an earlier backfill covers its own slot.
+	existing := []time.Time{date(2018, 7, 2, 4), date(2018, 7, 4, 0)}
+	checkpoint := mongo.Checkpoint{}
+	assert.Equal(t,
+		[]time.Time{date(2018, 7, 2, 0), date(2018, 7, 5, 0), date(2018, 7, 6, 0)},
+		pendingSlots(slots, daily, checkpoint, existing))
+
+	// Completed slots are skipped, unless they failed.
+	checkpoint.Completed = date(2018, 7, 5, 0)
+	checkpoint.Failed = []time.Time{date(2018, 7, 2, 0)}
+	assert.Equal(t,
+		[]time.Time{date(2018, 7, 2, 0), date(2018, 7, 6, 0)},
+		pendingSlots(slots, daily, checkpoint, existing))
+}
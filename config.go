@@ -0,0 +1,496 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	"github.com/armadillica/pillar-statscollector/influx"
+	"github.com/armadillica/pillar-statscollector/pillar"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config contains the settings of the statistics collector. They are read from the configuration
+// file given with -config, then overridden by STATSCOLL_* environment variables, which in turn are
+// overridden by CLI options.
+type Config struct {
+	// Instance identifies the Pillar instance; it is part of the IDs of documents collected for
+	// a given timestamp, so that collecting them again replaces the existing documents.
+	Instance string `yaml:"instance"`
+
+	Mongo struct {
+		// URL of the MongoDB database to read from.
+		URL string `yaml:"url"`
+		// URL of the MongoDB database to store the statistics to; defaults to URL.
+		StorageURL string `yaml:"storage_url,omitempty"`
+	} `yaml:"mongo"`
+
+	Elastic struct {
+		URL      string `yaml:"url"`
+		Username string `yaml:"username,omitempty"`
+		Password string `yaml:"password,omitempty"`
+		// APIKey is the base64-encoded "id:api_key"; it takes precedence over username/password.
+		APIKey string `yaml:"api_key,omitempty"`
+		// CAFile, CertFile and KeyFile are PEM files for TLS connections.
+		CAFile             string `yaml:"ca_file,omitempty"`
+		CertFile           string `yaml:"cert_file,omitempty"`
+		KeyFile            string `yaml:"key_file,omitempty"`
+		InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+		// Timeout, MaxIdleConns and IdleConnTimeout configure the HTTP connections.
+		Timeout         time.Duration `yaml:"timeout"`
+		MaxIdleConns    int           `yaml:"max_idle_conns"`
+		IdleConnTimeout time.Duration `yaml:"idle_conn_timeout"`
+		// Compress enables gzip compression of requests, when the cluster supports it.
+		Compress bool `yaml:"compress"`
+		// BulkSize and FlushInterval configure the batches used by -reindex and -allsince.
+		BulkSize      int           `yaml:"bulk_size"`
+		FlushInterval time.Duration `yaml:"flush_interval"`
+	} `yaml:"elastic"`
+
+	Influx struct {
+		// URL of the InfluxDB HTTP write API, for example "http://localhost:8086/write?db=cloudstats".
+		URL      string `yaml:"url"`
+		Username string `yaml:"username,omitempty"`
+		Password string `yaml:"password,omitempty"`
+	} `yaml:"influx"`
+
+	Store struct {
+		// URL of the Blender Store product counter; empty to not query the store.
+		URL string `yaml:"url"`
+	} `yaml:"store"`
+
+	BlenderID struct {
+		// URL of the Blender ID statistics; empty to not query Blender ID.
+		URL     string     `yaml:"url"`
+		Token   string     `yaml:"token,omitempty"`
+		Headers headerFlag `yaml:"headers,omitempty"`
+	} `yaml:"blender_id"`
+
+	// Retry configures retrying requests to the Blender Store and Blender ID.
+	Retry struct {
+		// Attempts is the maximum number of attempts, including the first one.
+		Attempts int `yaml:"attempts"`
+		// Delay before the first retry; it doubles for every next retry, up to MaxDelay.
+		Delay    time.Duration `yaml:"delay"`
+		MaxDelay time.Duration `yaml:"max_delay"`
+	} `yaml:"retry"`
+
+	Collectors struct {
+		Only []string `yaml:"only,omitempty"`
+		Skip []string `yaml:"skip,omitempty"`
+		// Enable lists optional collectors to run next to the default ones, like "orphans".
+		Enable      []string `yaml:"enable,omitempty"`
+		Concurrency int      `yaml:"concurrency"`
+		// Timeout is the maximum duration of each collector; zero means no limit.
+		Timeout time.Duration `yaml:"timeout"`
+		// TopProjects is the number of projects using the most storage to include in the document.
+		TopProjects int `yaml:"top_projects"`
+		// ProjectBreakdown enables storing the storage statistics of every project separately.
+		ProjectBreakdown bool `yaml:"project_breakdown"`
+		// The file size histogram has Count buckets, the first up to Base bytes and each next one
+		// Factor times larger.
+		FileSizeBuckets struct {
+			Base   int `yaml:"base"`
+			Factor int `yaml:"factor"`
+			Count  int `yaml:"count"`
+		} `yaml:"file_size_buckets"`
+		// LargestFiles is the number of largest files to include in the document.
+		LargestFiles int `yaml:"largest_files"`
+		// LinkExpiryWindows are the periods for which links that expire within them are counted.
+		LinkExpiryWindows []time.Duration `yaml:"link_expiry_windows"`
+		// BlenderSyncQuotaMiB is the home project storage per user above which users are counted as
+		// over quota; zero disables counting.
+		BlenderSyncQuotaMiB int `yaml:"blender_sync_quota_mib"`
+	} `yaml:"collectors"`
+
+	// RunTimeout is the maximum duration of collecting and pushing one statistics document; zero
+	// means no limit.
+	RunTimeout time.Duration `yaml:"run_timeout"`
+
+	// Sinks lists where collected statistics are pushed to: "mongo", "elastic" and/or "influx".
+	Sinks []string `yaml:"sinks"`
+	// RequiredSinks lists the sinks that make the run fail when pushing to them fails. Failures of
+	// the other sinks are only logged.
+	RequiredSinks []string `yaml:"required_sinks"`
+
+	// FillGaps configures -fill-gaps, which fills in missing statistics of the Blender Store and
+	// Blender ID in stored documents.
+	FillGaps struct {
+		// MaxAge is the maximum age of documents that are filled with the current values.
+		MaxAge time.Duration `yaml:"max_age"`
+		// Policy for older documents: "interpolate" estimates the values from the surrounding
+		// documents, and "skip" leaves them alone.
+		Policy string `yaml:"policy"`
+	} `yaml:"fill_gaps"`
+
+	Daemon struct {
+		// Schedule is a cron expression like "0 4 * * *" or "@daily", or an interval like "6h".
+		Schedule string `yaml:"schedule"`
+		// CatchUp makes the daemon collect statistics for the runs it missed while it was down.
+		CatchUp bool `yaml:"catch_up"`
+		// MaxCatchUp is the maximum number of missed runs to catch up on.
+		MaxCatchUp int `yaml:"max_catch_up"`
+	} `yaml:"daemon"`
+
+	Metrics struct {
+		// Listen is the address to serve Prometheus metrics on, when running with -serve-metrics.
+		Listen string `yaml:"listen"`
+		// RefreshInterval makes the statistics refresh periodically. When zero, the statistics are
+		// refreshed when they are scraped and older than CacheTTL.
+		RefreshInterval time.Duration `yaml:"refresh_interval"`
+		CacheTTL        time.Duration `yaml:"cache_ttl"`
+	} `yaml:"metrics"`
+}
+
+var knownSinks = map[string]bool{"mongo": true, "elastic": true, "influx": true}
+
+const redacted = "-redacted-"
+
+var config Config
+
+func defaultConfig() Config {
+	c := Config{}
+	c.Instance = "cloud"
+	c.Mongo.URL = "mongodb://localhost/cloud"
+	c.Elastic.URL = "http://localhost:9200/cloudstats/stats/"
+	c.Elastic.Timeout = elastic.DefaultClientOptions().Timeout
+	c.Elastic.MaxIdleConns = elastic.DefaultClientOptions().MaxIdleConns
+	c.Elastic.IdleConnTimeout = elastic.DefaultClientOptions().IdleConnTimeout
+	c.Elastic.Compress = elastic.DefaultClientOptions().Compress
+	c.Elastic.BulkSize = elastic.DefaultBulkOptions().BatchSize
+	c.Elastic.FlushInterval = elastic.DefaultBulkOptions().FlushInterval
+	c.Influx.URL = "http://localhost:8086/write?db=cloudstats"
+	c.Store.URL = pillar.DefaultStoreURL
+	c.BlenderID.URL = pillar.DefaultBlenderIDURL
+	c.Retry.Attempts = pillar.DefaultRetryAttempts
+	c.Retry.Delay = pillar.DefaultRetryDelay
+	c.Retry.MaxDelay = pillar.DefaultMaxRetryDelay
+	c.Collectors.Concurrency = pillar.DefaultConcurrency
+	c.Collectors.TopProjects = pillar.DefaultTopProjects
+	c.Collectors.FileSizeBuckets.Base = pillar.DefaultFileSizeBucketBase
+	c.Collectors.FileSizeBuckets.Factor = pillar.DefaultFileSizeBucketFactor
+	c.Collectors.FileSizeBuckets.Count = pillar.DefaultFileSizeBucketCount
+	c.Collectors.LargestFiles = pillar.DefaultLargestFiles
+	c.Collectors.LinkExpiryWindows = pillar.DefaultLinkExpiryWindows()
+	c.Collectors.BlenderSyncQuotaMiB = pillar.DefaultBlenderSyncQuota >> 20
+	c.Sinks = []string{"mongo", "elastic"}
+	c.RequiredSinks = []string{"mongo"}
+	c.FillGaps.MaxAge = 48 * time.Hour
+	c.FillGaps.Policy = gapPolicyInterpolate
+	c.Daemon.Schedule = "@daily"
+	c.Daemon.CatchUp = true
+	c.Daemon.MaxCatchUp = 7
+	c.Metrics.Listen = ":9401"
+	c.Metrics.CacheTTL = 5 * time.Minute
+	return c
+}
+
+// loadConfig combines the defaults, configuration file, environment and CLI options.
+func loadConfig() (Config, error) {
+	c := defaultConfig()
+
+	if cliArgs.configFile != "" {
+		if err := c.loadFile(cliArgs.configFile); err != nil {
+			return c, err
+		}
+	}
+	if err := c.overrideFromEnv(os.LookupEnv); err != nil {
+		return c, err
+	}
+	if err := c.overrideFromCliArgs(); err != nil {
+		return c, err
+	}
+
+	if c.Mongo.StorageURL == "" {
+		c.Mongo.StorageURL = c.Mongo.URL
+	}
+	return c, c.validate()
+}
+
+// validate checks the combined configuration for values the collectors cannot work with.
+func (c *Config) validate() error {
+	switch c.FillGaps.Policy {
+	case gapPolicyInterpolate, gapPolicySkip:
+	default:
+		return fmt.Errorf("unknown fill-gaps policy %q", c.FillGaps.Policy)
+	}
+	if c.Collectors.TopProjects < 0 {
+		return fmt.Errorf("the number of top projects should not be negative, not %d", c.Collectors.TopProjects)
+	}
+	if buckets := c.Collectors.FileSizeBuckets; buckets.Count > 0 && (buckets.Base < 1 || buckets.Factor < 2) {
+		return fmt.Errorf("file size buckets need a base of at least 1 byte and a factor of at least 2")
+	} else if buckets.Count > 0 && len(pillar.LogBuckets(int64(buckets.Base), buckets.Factor, buckets.Count)) < buckets.Count {
+		return fmt.Errorf("too many file size buckets, the largest would be over %d bytes", int64(math.MaxInt64))
+	}
+	seenWindows := map[time.Duration]bool{}
+	for _, window := range c.Collectors.LinkExpiryWindows {
+		if window <= 0 {
+			return fmt.Errorf("link expiry windows should be positive, not %s", window)
+		}
+		if seenWindows[window] {
+			return fmt.Errorf("link expiry window %s is listed more than once", window)
+		}
+		seenWindows[window] = true
+	}
+	for _, sink := range append(append([]string{}, c.Sinks...), c.RequiredSinks...) {
+		if !knownSinks[sink] {
+			return fmt.Errorf("unknown sink %q", sink)
+		}
+	}
+	return nil
+}
+
+func (c *Config) loadFile(filename string) error {
+	logger := log.WithField("filename", filename)
+	logger.Info("loading configuration file")
+
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("unable to read configuration file: %s", err)
+	}
+	if err := yaml.UnmarshalStrict(contents, c); err != nil {
+		return fmt.Errorf("unable to parse configuration file %s: %s", filename, err)
+	}
+	return nil
+}
+
+// settings maps the names of settings to functions that set them from a string.
+// The names are used for the STATSCOLL_* environment variables and the CLI options.
+func (c *Config) settings() map[string]func(value string) error {
+	setString := func(target *string) func(string) error {
+		return func(value string) error {
+			*target = value
+			return nil
+		}
+	}
+	setInt := func(target *int) func(string) error {
+		return func(value string) error {
+			number, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid number %q: %s", value, err)
+			}
+			*target = number
+			return nil
+		}
+	}
+	setDuration := func(target *time.Duration) func(string) error {
+		return func(value string) error {
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid duration %q: %s", value, err)
+			}
+			*target = duration
+			return nil
+		}
+	}
+	setBool := func(target *bool) func(string) error {
+		return func(value string) error {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid boolean %q: %s", value, err)
+			}
+			*target = parsed
+			return nil
+		}
+	}
+	setList := func(target *[]string) func(string) error {
+		return func(value string) error {
+			*target = splitList(value)
+			return nil
+		}
+	}
+	setDurationList := func(target *[]time.Duration) func(string) error {
+		return func(value string) error {
+			durations := []time.Duration{}
+			for _, item := range splitList(value) {
+				duration, err := time.ParseDuration(item)
+				if err != nil {
+					return fmt.Errorf("invalid duration %q: %s", item, err)
+				}
+				durations = append(durations, duration)
+			}
+			*target = durations
+			return nil
+		}
+	}
+
+	return map[string]func(string) error{
+		"instance":                  setString(&c.Instance),
+		"mongo":                     setString(&c.Mongo.URL),
+		"storage":                   setString(&c.Mongo.StorageURL),
+		"elastic":                   setString(&c.Elastic.URL),
+		"elastic-username":          setString(&c.Elastic.Username),
+		"elastic-password":          setString(&c.Elastic.Password),
+		"elastic-api-key":           setString(&c.Elastic.APIKey),
+		"elastic-ca-file":           setString(&c.Elastic.CAFile),
+		"elastic-cert-file":         setString(&c.Elastic.CertFile),
+		"elastic-key-file":          setString(&c.Elastic.KeyFile),
+		"elastic-insecure":          setBool(&c.Elastic.InsecureSkipVerify),
+		"elastic-timeout":           setDuration(&c.Elastic.Timeout),
+		"elastic-max-idle-conns":    setInt(&c.Elastic.MaxIdleConns),
+		"elastic-idle-conn-timeout": setDuration(&c.Elastic.IdleConnTimeout),
+		"elastic-compress":          setBool(&c.Elastic.Compress),
+		"elastic-bulk-size":         setInt(&c.Elastic.BulkSize),
+		"elastic-flush-interval":    setDuration(&c.Elastic.FlushInterval),
+		"influx":                    setString(&c.Influx.URL),
+		"influx-username":           setString(&c.Influx.Username),
+		"influx-password":           setString(&c.Influx.Password),
+		"store-url":                 setString(&c.Store.URL),
+		"blenderid-url":             setString(&c.BlenderID.URL),
+		"blenderid-token":           setString(&c.BlenderID.Token),
+		"retry-attempts":            setInt(&c.Retry.Attempts),
+		"retry-delay":               setDuration(&c.Retry.Delay),
+		"retry-max-delay":           setDuration(&c.Retry.MaxDelay),
+		"only":                      setList(&c.Collectors.Only),
+		"skip":                      setList(&c.Collectors.Skip),
+		"enable":                    setList(&c.Collectors.Enable),
+		"sinks":                     setList(&c.Sinks),
+		"required-sinks":            setList(&c.RequiredSinks),
+		"fill-gaps-max-age":         setDuration(&c.FillGaps.MaxAge),
+		"fill-gaps-policy":          setString(&c.FillGaps.Policy),
+		"schedule":                  setString(&c.Daemon.Schedule),
+		"concurrency":               setInt(&c.Collectors.Concurrency),
+		"collector-timeout":         setDuration(&c.Collectors.Timeout),
+		"top-projects":              setInt(&c.Collectors.TopProjects),
+		"project-breakdown":         setBool(&c.Collectors.ProjectBreakdown),
+		"blender-sync-quota-mib":    setInt(&c.Collectors.BlenderSyncQuotaMiB),
+		"file-size-bucket-base":     setInt(&c.Collectors.FileSizeBuckets.Base),
+		"file-size-bucket-factor":   setInt(&c.Collectors.FileSizeBuckets.Factor),
+		"file-size-bucket-count":    setInt(&c.Collectors.FileSizeBuckets.Count),
+		"largest-files":             setInt(&c.Collectors.LargestFiles),
+		"link-expiry-windows":       setDurationList(&c.Collectors.LinkExpiryWindows),
+		"run-timeout":               setDuration(&c.RunTimeout),
+		"max-catch-up":              setInt(&c.Daemon.MaxCatchUp),
+		"metrics-listen":            setString(&c.Metrics.Listen),
+		"metrics-refresh":           setDuration(&c.Metrics.RefreshInterval),
+		"metrics-cache":             setDuration(&c.Metrics.CacheTTL),
+		"catch-up":                  setBool(&c.Daemon.CatchUp),
+	}
+}
+
+// envName returns the name of the environment variable for a setting, for example
+// STATSCOLL_STORE_URL for "store-url".
+func envName(setting string) string {
+	return "STATSCOLL_" + strings.ToUpper(strings.Replace(setting, "-", "_", -1))
+}
+
+func (c *Config) overrideFromEnv(lookupEnv func(string) (string, bool)) error {
+	for setting, set := range c.settings() {
+		name := envName(setting)
+		value, found := lookupEnv(name)
+		if !found {
+			continue
+		}
+		log.WithField("variable", name).Debug("configuration overridden from environment")
+		if err := set(value); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) overrideFromCliArgs() error {
+	settings := c.settings()
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "blenderid-header" {
+			c.BlenderID.Headers = cliArgs.blenderIDHeader
+			return
+		}
+		set, found := settings[f.Name]
+		if !found || err != nil {
+			return
+		}
+		if setErr := set(f.Value.String()); setErr != nil {
+			err = fmt.Errorf("-%s: %s", f.Name, setErr)
+		}
+	})
+	return err
+}
+
+// redacted returns a copy of the configuration with passwords and tokens removed.
+func (c Config) redacted() Config {
+	c.Mongo.URL = redactURL(c.Mongo.URL)
+	c.Mongo.StorageURL = redactURL(c.Mongo.StorageURL)
+	c.Elastic.URL = redactURL(c.Elastic.URL)
+	if c.Elastic.Password != "" {
+		c.Elastic.Password = redacted
+	}
+	if c.Elastic.APIKey != "" {
+		c.Elastic.APIKey = redacted
+	}
+	c.Influx.URL = redactURL(c.Influx.URL)
+	if c.Influx.Password != "" {
+		c.Influx.Password = redacted
+	}
+	if c.BlenderID.Token != "" {
+		c.BlenderID.Token = redacted
+	}
+	if c.BlenderID.Headers != nil {
+		headers := headerFlag{}
+		for name, values := range c.BlenderID.Headers {
+			switch strings.ToLower(name) {
+			case "authorization", "cookie", "x-api-key":
+				values = []string{redacted}
+			}
+			headers[name] = values
+		}
+		c.BlenderID.Headers = headers
+	}
+	return c
+}
+
+// urlPasswordRegexp matches the "scheme://username:password@" part of a URL. A regular expression
+// is used instead of url.Parse(), as the latter refuses MongoDB URLs with multiple hosts.
+var urlPasswordRegexp = regexp.MustCompile(`^([^:/]+://[^:@/]*):[^@/]*@`)
+
+// redactURL removes the password from the URL, if there is any.
+func redactURL(rawURL string) string {
+	return urlPasswordRegexp.ReplaceAllString(rawURL, "${1}:"+redacted+"@")
+}
+
+// applyConfig passes the configuration to the packages that need it.
+func applyConfig(c Config) error {
+	err := elastic.Configure(elastic.ClientOptions{
+		Username:           c.Elastic.Username,
+		Password:           c.Elastic.Password,
+		APIKey:             c.Elastic.APIKey,
+		CAFile:             c.Elastic.CAFile,
+		CertFile:           c.Elastic.CertFile,
+		KeyFile:            c.Elastic.KeyFile,
+		InsecureSkipVerify: c.Elastic.InsecureSkipVerify,
+		Timeout:            c.Elastic.Timeout,
+		MaxIdleConns:       c.Elastic.MaxIdleConns,
+		IdleConnTimeout:    c.Elastic.IdleConnTimeout,
+		Compress:           c.Elastic.Compress,
+	})
+	if err != nil {
+		return fmt.Errorf("invalid ElasticSearch configuration: %s", err)
+	}
+	influx.SetBasicAuth(c.Influx.Username, c.Influx.Password)
+	return nil
+}
+
+func printConfig() error {
+	return writeConfig(os.Stdout, config.redacted())
+}
+
+// writeConfig writes the configuration as YAML that can be loaded as configuration file again.
+// Durations are written like "5m0s" rather than as a number of nanoseconds.
+func writeConfig(w io.Writer, c Config) error {
+	asYAML, err := yaml.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("unable to marshal configuration to YAML: %s", err)
+	}
+	_, err = w.Write(asYAML)
+	return err
+}
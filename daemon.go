@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/armadillica/pillar-statscollector/mongo"
+	"github.com/robfig/cron"
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// parseSchedule parses either an interval like "6h", or a cron expression like "0 4 * * *" or
+// "@daily".
+func parseSchedule(spec string) (cron.Schedule, error) {
+	if interval, err := time.ParseDuration(spec); err == nil {
+		if interval < time.Minute {
+			return nil, fmt.Errorf("interval %s is too short", interval)
+		}
+		return cron.Every(interval), nil
+	}
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %s", spec, err)
+	}
+	return schedule, nil
+}
+
+// missedSlots returns the scheduled times after lastRun that are before now. At most maxSlots
+// are returned; if more slots were missed, only the most recent ones are returned.
+func missedSlots(schedule cron.Schedule, lastRun, now time.Time, maxSlots int) []time.Time {
+	slots := []time.Time{}
+	if maxSlots < 1 {
+		return slots
+	}
+	for slot := schedule.Next(lastRun); !slot.After(now); slot = schedule.Next(slot) {
+		slots = append(slots, slot)
+		if len(slots) > maxSlots {
+			slots = slots[1:]
+		}
+	}
+	return slots
+}
+
+// daemon runs singleRun() on a schedule, using the same MongoDB sessions for every run.
+type daemon struct {
+	mgoCloud *mgo.Session
+	mgoStats *mgo.Session
+	schedule cron.Schedule
+	signals  chan os.Signal
+}
+
+// runDaemon collects statistics according to the configured schedule, until it receives SIGINT
+// or SIGTERM. A run that is in progress is always finished first. SIGHUP reloads the configuration.
+func runDaemon(mgoCloud, mgoStats *mgo.Session) error {
+	schedule, err := parseSchedule(config.Daemon.Schedule)
+	if err != nil {
+		return err
+	}
+
+	d := daemon{
+		mgoCloud: mgoCloud,
+		mgoStats: mgoStats,
+		schedule: schedule,
+		signals:  make(chan os.Signal, 3),
+	}
+	signal.Notify(d.signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(d.signals)
+
+	log.WithField("schedule", config.Daemon.Schedule).Warning("running as daemon")
+	if config.Daemon.CatchUp {
+		if stop := d.catchUp(); stop {
+			return nil
+		}
+	}
+
+	for {
+		now := time.Now().UTC()
+		next := d.schedule.Next(now)
+		log.WithField("next_run", next).Info("waiting for next scheduled run")
+
+		timer := time.NewTimer(next.Sub(now))
+		select {
+		case <-timer.C:
+			d.run(nil)
+		case sig := <-d.signals:
+			timer.Stop()
+			if stop := d.handleSignal(sig); stop {
+				return nil
+			}
+		}
+	}
+}
+
+// catchUp collects statistics for the scheduled slots that were missed since the last stored
+// statistics document. Returns true when the daemon should stop.
+func (d *daemon) catchUp() bool {
+	lastRun, err := mongo.LatestTimestamp(d.mgoStats)
+	if err == mgo.ErrNotFound {
+		log.Info("no statistics stored yet, nothing to catch up on")
+		return false
+	}
+	if err != nil {
+		log.WithError(err).Error("unable to find the latest statistics, not catching up")
+		return false
+	}
+
+	slots := missedSlots(d.schedule, lastRun, time.Now().UTC(), config.Daemon.MaxCatchUp)
+	if len(slots) > 0 {
+		log.WithFields(log.Fields{
+			"last_run": lastRun,
+			"missed":   len(slots),
+		}).Warning("catching up on missed runs")
+	}
+	for idx := range slots {
+		d.run(&slots[idx])
+
+		// Handle signals between runs, so that we don't have to wait for all of them to finish.
+		select {
+		case sig := <-d.signals:
+			if stop := d.handleSignal(sig); stop {
+				return true
+			}
+		default:
+		}
+	}
+	return false
+}
+
+// run performs a single run, logging instead of returning errors, as the daemon should keep running.
+func (d *daemon) run(timestamp *time.Time) {
+	// Re-establish the sessions' connections if they were broken since the last run.
+	d.mgoCloud.Refresh()
+	d.mgoStats.Refresh()
+
+	output, err := newSinks(d.mgoStats, "", false)
+	if err != nil {
+		log.WithError(err).Error("unable to create sinks")
+		return
+	}
+
+	startTime := time.Now()
+	err = singleRun(context.Background(), d.mgoCloud, output, timestamp)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.WithError(err).Error("error collecting statistics")
+		return
+	}
+	log.WithField("duration", time.Since(startTime)).Info("scheduled run done")
+}
+
+// handleSignal returns true when the daemon should stop.
+func (d *daemon) handleSignal(sig os.Signal) bool {
+	logger := log.WithField("signal", sig)
+	if sig != syscall.SIGHUP {
+		logger.Warning("shutting down")
+		return true
+	}
+
+	logger.Warning("reloading configuration")
+	newConfig, err := loadConfig()
+	if err != nil {
+		logger.WithError(err).Error("invalid configuration, keeping the current one")
+		return false
+	}
+	schedule, err := parseSchedule(newConfig.Daemon.Schedule)
+	if err != nil {
+		logger.WithError(err).Error("invalid schedule, keeping the current configuration")
+		return false
+	}
+
+	if err := applyConfig(newConfig); err != nil {
+		logger.WithError(err).Error("keeping the current configuration")
+		return false
+	}
+
+	reconnect := newConfig.Mongo.URL != config.Mongo.URL || newConfig.Mongo.StorageURL != config.Mongo.StorageURL
+	oldConfig := config
+	config = newConfig
+	d.schedule = schedule
+
+	if reconnect {
+		logger.Warning("MongoDB URL changed, reconnecting")
+		mgoCloud, mgoStats, err := connectMongoDB()
+		if err != nil {
+			// Keep using the current connections, as the daemon should keep running.
+			logger.WithError(err).Error("unable to reconnect, keeping the current MongoDB connections")
+			config.Mongo = oldConfig.Mongo
+			return false
+		}
+		if d.mgoStats != d.mgoCloud {
+			d.mgoStats.Close()
+		}
+		d.mgoCloud.Close()
+		d.mgoCloud, d.mgoStats = mgoCloud, mgoStats
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+)
+
+type DaemonTestSuite struct{}
+
+var _ = check.Suite(&DaemonTestSuite{})
+
+func (s *DaemonTestSuite) TestParseSchedule(t *check.C) {
+	base := time.Date(2018, 7, 4, 13, 47, 0, 0, time.UTC)
+
+	schedule, err := parseSchedule("6h")
+	assert.Nil(t, err)
+	assert.Equal(t, base.Add(6*time.Hour), schedule.Next(base))
+
+	schedule, err = parseSchedule("0 4 * * *")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2018, 7, 5, 4, 0, 0, 0, time.UTC), schedule.Next(base))
+
+	schedule, err = parseSchedule("@daily")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2018, 7, 5, 0, 0, 0, 0, time.UTC), schedule.Next(base))
+
+	_, err = parseSchedule("1s")
+	assert.NotNil(t, err)
+	_, err = parseSchedule("every now and then")
+	assert.NotNil(t, err)
+}
+
+func (s *DaemonTestSuite) TestMissedSlots(t *check.C) {
+	schedule, err := parseSchedule("@daily")
+	assert.Nil(t, err)
+
+	lastRun := time.Date(2018, 7, 1, 0, 0, 12, 0, time.UTC)
+	now := time.Date(2018, 7, 4, 13, 47, 0, 0, time.UTC)
+
+	assert.Equal(t, []time.Time{
+		time.Date(2018, 7, 2, 0, 0, 0, 0, time.UTC),
+		time.Date(2018, 7, 3, 0, 0, 0, 0, time.UTC),
+		time.Date(2018, 7, 4, 0, 0, 0, 0, time.UTC),
+	}, missedSlots(schedule, lastRun, now, 7))
+
+	// Only the most recent slots should be returned.
+	assert.Equal(t, []time.Time{
+		time.Date(2018, 7, 3, 0, 0, 0, 0, time.UTC),
+		time.Date(2018, 7, 4, 0, 0, 0, 0, time.UTC),
+	}, missedSlots(schedule, lastRun, now, 2))
+
+	assert.Empty(t, missedSlots(schedule, lastRun, now, 0))
+	assert.Empty(t, missedSlots(schedule, now, now, 7))
+}
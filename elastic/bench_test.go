@@ -0,0 +1,133 @@
+package elastic
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+)
+
+// fakeElastic is a minimal ElasticSearch 6 server, which accepts single and bulk pushes.
+type fakeElastic struct {
+	*httptest.Server
+	compression bool
+	// gzipped counts the requests that had a gzip-compressed body.
+	gzipped int
+}
+
+func newFakeElastic(compression bool) *fakeElastic {
+	fake := &fakeElastic{compression: compression}
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.handle))
+
+	clusters.Lock()
+	clusters.byURL = map[string]*Cluster{}
+	clusters.Unlock()
+	return fake
+}
+
+func (f *fakeElastic) handle(w http.ResponseWriter, r *http.Request) {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		f.gzipped++
+		gzipReader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = gzipReader
+	}
+
+	switch {
+	case r.URL.Path == "/":
+		info := []byte(`{"version": {"number": "6.1.2"}}`)
+		if f.compression && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gzipWriter := gzip.NewWriter(w)
+			gzipWriter.Write(info)
+			gzipWriter.Close()
+			return
+		}
+		w.Write(info)
+	case strings.HasSuffix(r.URL.Path, "/_bulk"):
+		items := []string{}
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			scanner.Scan() // skip the document itself
+			items = append(items, `{"index": {"status": 201}}`)
+		}
+		fmt.Fprintf(w, `{"errors": false, "items": [%s]}`, strings.Join(items, ","))
+	default:
+		ioutil.ReadAll(body)
+		w.Write([]byte(`{"_id": "some-id"}`))
+	}
+}
+
+func benchmarkStats(count int) []Stats {
+	docs := make([]Stats, count)
+	for idx := range docs {
+		docs[idx].Timestamp = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, idx)
+		docs[idx].Files.TotalBytesStorageUsedPerBackend = map[string]int64{"gcs": int64(idx) << 30, "local": 1}
+		docs[idx].Files.FileCountPerStatus = map[string]int{"complete": idx, "processing": 3}
+		docs[idx].Nodes.PublicCountPerNodeType = map[string]int{"asset": idx, "group": 5, "comment": 12}
+		docs[idx].Users.CountPerType = map[string]int{"subscriber": idx, "demo": 2}
+	}
+	return docs
+}
+
+func (s *ClientTestSuite) TestCompression(t *check.C) {
+	for _, compression := range []bool{false, true} {
+		fake := newFakeElastic(compression)
+		_, err := BulkPush(fake.URL+"/cloudstats/stats/", DefaultBulkOptions(), benchmarkStats(20)...)
+		fake.Close()
+
+		assert.Nil(t, err)
+		if compression {
+			assert.Equal(t, 1, fake.gzipped)
+		} else {
+			assert.Equal(t, 0, fake.gzipped)
+		}
+	}
+}
+
+// The benchmarks below compare the ways to reindex a year of daily statistics.
+
+func benchmarkReindex(b *testing.B, compression, bulk bool) {
+	level := log.GetLevel()
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(level)
+
+	fake := newFakeElastic(compression)
+	defer fake.Close()
+	elasticURL := fake.URL + "/cloudstats/stats/"
+	docs := benchmarkStats(365)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if bulk {
+			if _, err := BulkPush(elasticURL, DefaultBulkOptions(), docs...); err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+		for _, doc := range docs {
+			if _, err := Push(elasticURL, doc); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkReindexSingle(b *testing.B)   { benchmarkReindex(b, false, false) }
+func BenchmarkReindexBulk(b *testing.B)     { benchmarkReindex(b, false, true) }
+func BenchmarkReindexBulkGzip(b *testing.B) { benchmarkReindex(b, true, true) }
@@ -0,0 +1,352 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BulkOptions configure a BulkPusher.
+type BulkOptions struct {
+	// BatchSize is the maximum number of documents sent in one request.
+	BatchSize int
+	// FlushInterval is the maximum time a document is queued before it is sent. Zero means that
+	// documents are only sent when the batch is full or Flush() is called.
+	FlushInterval time.Duration
+	// MaxRetries is the number of times documents rejected by ElasticSearch (because it's
+	// overloaded or unreachable) are sent again.
+	MaxRetries int
+	// RetryDelay is the time to wait before the first retry; it doubles for every next retry.
+	RetryDelay time.Duration
+}
+
+// DefaultBulkOptions returns the options used when nothing else is configured.
+func DefaultBulkOptions() BulkOptions {
+	return BulkOptions{
+		BatchSize:     500,
+		FlushInterval: 30 * time.Second,
+		MaxRetries:    3,
+		RetryDelay:    time.Second,
+	}
+}
+
+// BulkFailure describes a document that could not be indexed.
+type BulkFailure struct {
+	ID        string
+	Timestamp time.Time
+	// Status is the HTTP status code for this document, or 0 if ElasticSearch was unreachable.
+	Status int
+	Reason string
+}
+
+// BulkSummary counts the documents sent by a BulkPusher.
+type BulkSummary struct {
+	Indexed  int
+	Failed   int
+	Retried  int
+	Failures []BulkFailure
+}
+
+// BulkPusher sends documents to ElasticSearch in batches, using the _bulk endpoint.
+// It is safe for concurrent use.
+type BulkPusher struct {
+	elasticURL string
+	options    BulkOptions
+
+	// mutex protects the queue and the summary; it is not held while sending.
+	mutex   sync.Mutex
+	queue   []Stats
+	timer   *time.Timer
+	summary BulkSummary
+}
+
+type bulkItem struct {
+	stats  Stats
+	status int
+	reason string
+}
+
+type bulkResponse struct {
+	Errors bool                        `json:"errors"`
+	Items  []map[string]bulkItemResult `json:"items"`
+}
+
+type bulkItemResult struct {
+	ID     string `json:"_id"`
+	Status int    `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// NewBulkPusher returns a BulkPusher for the same index and type as elasticURL. The cluster is
+// only contacted when the first batch is sent, so that an unreachable cluster is handled like
+// any other failure to index documents.
+func NewBulkPusher(elasticURL string, options BulkOptions) (*BulkPusher, error) {
+	if _, err := url.Parse(elasticURL); err != nil {
+		return nil, fmt.Errorf("invalid URL: %s", err)
+	}
+	if options.BatchSize < 1 {
+		options.BatchSize = 1
+	}
+
+	return &BulkPusher{
+		elasticURL: elasticURL,
+		options:    options,
+	}, nil
+}
+
+// BulkPush sends all documents to ElasticSearch, and returns a summary of the result. An error is
+// returned when one or more documents could not be indexed.
+func BulkPush(elasticURL string, options BulkOptions, stats ...Stats) (BulkSummary, error) {
+	pusher, err := NewBulkPusher(elasticURL, options)
+	if err != nil {
+		return BulkSummary{}, err
+	}
+	ctx := context.Background()
+	for _, doc := range stats {
+		// Errors are collected in the summary, so we can just continue.
+		pusher.Add(ctx, doc)
+	}
+	pusher.Flush(ctx)
+
+	summary := pusher.Summary()
+	if summary.Failed > 0 {
+		return summary, fmt.Errorf("%d of %d documents could not be indexed", summary.Failed, len(stats))
+	}
+	return summary, nil
+}
+
+// Add queues the document. The queue is sent when it reaches the batch size, or when the flush
+// interval has passed since the first document was queued. An error is returned when sending
+// the queue causes documents to fail.
+func (b *BulkPusher) Add(ctx context.Context, stats Stats) error {
+	b.mutex.Lock()
+	b.queue = append(b.queue, stats)
+	full := len(b.queue) >= b.options.BatchSize
+	if !full && b.timer == nil && b.options.FlushInterval > 0 {
+		b.timer = time.AfterFunc(b.options.FlushInterval, b.flushOnTimer)
+	}
+	b.mutex.Unlock()
+
+	if full {
+		return b.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush sends all queued documents. An error is returned when documents could not be indexed;
+// they are also listed in the summary. When the context is done, waiting for a retry stops and
+// the remaining documents fail.
+func (b *BulkPusher) Flush(ctx context.Context) error {
+	b.mutex.Lock()
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	docs := b.queue
+	b.queue = nil
+	b.mutex.Unlock()
+
+	return b.push(ctx, docs)
+}
+
+// Summary returns the counts of all documents sent so far.
+func (b *BulkPusher) Summary() BulkSummary {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	summary := b.summary
+	summary.Failures = append([]BulkFailure{}, b.summary.Failures...)
+	return summary
+}
+
+func (b *BulkPusher) flushOnTimer() {
+	if err := b.Flush(context.Background()); err != nil {
+		log.WithError(err).Error("unable to push queued documents to ElasticSearch")
+	}
+}
+
+// push sends the documents, retrying the rejected ones.
+func (b *BulkPusher) push(ctx context.Context, docs []Stats) error {
+	failed := 0
+	for attempt := 0; len(docs) > 0; attempt++ {
+		rejected, failedNow := b.send(ctx, docs)
+		failed += failedNow
+		if len(rejected) == 0 {
+			break
+		}
+		if attempt >= b.options.MaxRetries {
+			failed += b.failAll(rejected, "")
+			break
+		}
+
+		delay := b.options.RetryDelay << uint(attempt)
+		log.WithFields(log.Fields{
+			"rejected": len(rejected),
+			"attempt":  attempt + 1,
+			"delay":    delay,
+		}).Warning("ElasticSearch rejected documents, retrying")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			failed += b.failAll(rejected, ctx.Err().Error())
+			return fmt.Errorf("%d documents could not be indexed: %s", failed, ctx.Err())
+		case <-timer.C:
+		}
+
+		b.mutex.Lock()
+		b.summary.Retried += len(rejected)
+		b.mutex.Unlock()
+		docs = docs[:0:0]
+		for _, item := range rejected {
+			docs = append(docs, item.stats)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d documents could not be indexed", failed)
+	}
+	return nil
+}
+
+// send performs a single bulk request, and returns the documents that should be retried and the
+// number of documents that failed.
+func (b *BulkPusher) send(ctx context.Context, docs []Stats) ([]bulkItem, int) {
+	logger := log.WithFields(log.Fields{
+		"url":       b.elasticURL,
+		"documents": len(docs),
+	})
+
+	// All documents are rejected (or failed) in the same way when the request itself fails.
+	rejectAll := func(status int, reason string) ([]bulkItem, int) {
+		items := make([]bulkItem, len(docs))
+		for idx, doc := range docs {
+			items[idx] = bulkItem{doc, status, reason}
+		}
+		if status == 0 || status == http.StatusTooManyRequests || status >= 500 {
+			return items, 0
+		}
+		return nil, b.failAll(items, "")
+	}
+
+	// The cluster is detected on the first request; after that it is cached.
+	cluster, err := DetectClusterContext(ctx, b.elasticURL)
+	if err != nil {
+		logger.WithError(err).Warning("unable to connect to ElasticSearch")
+		return rejectAll(0, err.Error())
+	}
+	bulkURL := cluster.typeURL("_bulk")
+
+	payload := bytes.Buffer{}
+	encoder := json.NewEncoder(&payload)
+	for _, doc := range docs {
+		action := map[string]map[string]string{"index": {}}
+		if doc.ID != "" {
+			action["index"]["_id"] = doc.ID
+		}
+		if err := encoder.Encode(action); err != nil {
+			return rejectAll(-1, err.Error())
+		}
+		if err := encoder.Encode(doc); err != nil {
+			return rejectAll(-1, err.Error())
+		}
+	}
+
+	req, err := newRequest("POST", bulkURL.String(), payload.Bytes(), cluster.Compression)
+	if err != nil {
+		return rejectAll(-1, err.Error())
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	logger.Debug("bulk-pushing to ElasticSearch")
+	resp, err := httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		logger.WithError(err).Warning("error performing HTTP request")
+		return rejectAll(0, err.Error())
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return rejectAll(0, fmt.Sprintf("error reading response: %s", err))
+	}
+	if resp.StatusCode >= 300 {
+		logger.WithField("code", resp.StatusCode).Warningf("error response from Elastic:\n%s", body)
+		return rejectAll(resp.StatusCode, fmt.Sprintf("error response from ElasticSearch: %s", resp.Status))
+	}
+
+	var response bulkResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return rejectAll(-1, fmt.Sprintf("unable to decode JSON: %s", err))
+	}
+	if len(response.Items) != len(docs) {
+		return rejectAll(-1, fmt.Sprintf("expected %d items in response, got %d", len(docs), len(response.Items)))
+	}
+
+	rejected := []bulkItem{}
+	failed := []bulkItem{}
+	indexed := 0
+	for idx, resultPerAction := range response.Items {
+		result := resultPerAction["index"]
+		item := bulkItem{stats: docs[idx], status: result.Status}
+		if result.Error != nil {
+			item.reason = result.Error.Type + ": " + result.Error.Reason
+		}
+
+		switch {
+		case result.Status < 300:
+			indexed++
+		case result.Status == http.StatusTooManyRequests || result.Status == http.StatusServiceUnavailable:
+			rejected = append(rejected, item)
+		default:
+			failed = append(failed, item)
+		}
+	}
+
+	b.mutex.Lock()
+	b.summary.Indexed += indexed
+	b.mutex.Unlock()
+
+	logger.WithField("rejected", len(rejected)).Info("bulk-pushed to ElasticSearch")
+	return rejected, b.failAll(failed, "")
+}
+
+// failAll records the items as failed, and returns their number. A non-empty reason replaces
+// the reason of the items.
+func (b *BulkPusher) failAll(items []bulkItem, reason string) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, item := range items {
+		if reason != "" {
+			item.reason = reason
+		}
+		log.WithFields(log.Fields{
+			"ID":        item.stats.ID,
+			"timestamp": item.stats.Timestamp,
+			"status":    item.status,
+			"reason":    item.reason,
+		}).Error("unable to index document in ElasticSearch")
+
+		b.summary.Failed++
+		b.summary.Failures = append(b.summary.Failures, BulkFailure{
+			ID:        item.stats.ID,
+			Timestamp: item.stats.Timestamp,
+			Status:    item.status,
+			Reason:    item.reason,
+		})
+	}
+	return len(items)
+}
@@ -0,0 +1,169 @@
+package elastic
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	"gopkg.in/jarcoal/httpmock.v1"
+)
+
+type BulkTestSuite struct {
+	options BulkOptions
+}
+
+var _ = check.Suite(&BulkTestSuite{})
+
+const testBulkURL = "http://elastic.test/cloudstats/stats/_bulk"
+
+func (s *BulkTestSuite) SetUpTest(c *check.C) {
+	httpmock.ActivateNonDefault(client)
+	mockCluster("http://elastic.test/", "6.1.2", "")
+	s.options = BulkOptions{
+		BatchSize:  2,
+		MaxRetries: 2,
+		RetryDelay: time.Millisecond,
+	}
+}
+
+func (s *BulkTestSuite) TearDownTest(c *check.C) {
+	httpmock.DeactivateAndReset()
+}
+
+// bulkResponder responds to each bulk request with the next list of statuses, one per document.
+func bulkResponder(t *check.C, requests *[][]map[string]interface{}, statuses ...[]int) httpmock.Responder {
+	return func(req *http.Request) (*http.Response, error) {
+		lines := []map[string]interface{}{}
+		scanner := bufio.NewScanner(req.Body)
+		for scanner.Scan() {
+			line := map[string]interface{}{}
+			assert.Nil(t, json.Unmarshal(scanner.Bytes(), &line))
+			lines = append(lines, line)
+		}
+		*requests = append(*requests, lines)
+
+		response := bulkResponse{Errors: true}
+		for _, status := range statuses[len(*requests)-1] {
+			result := bulkItemResult{Status: status}
+			if status >= 300 {
+				result.Error = &struct {
+					Type   string `json:"type"`
+					Reason string `json:"reason"`
+				}{"some_exception", "something went wrong"}
+			}
+			response.Items = append(response.Items, map[string]bulkItemResult{"index": result})
+		}
+		return httpmock.NewJsonResponse(200, response)
+	}
+}
+
+func (s *BulkTestSuite) TestBulkPush(t *check.C) {
+	requests := [][]map[string]interface{}{}
+	httpmock.RegisterResponder("POST", testBulkURL,
+		bulkResponder(t, &requests, []int{201, 201}, []int{201}))
+
+	docs := []Stats{{ID: "existing", SchemaVersion: 1}, {SchemaVersion: 1}, {SchemaVersion: 1}}
+	summary, err := BulkPush("http://elastic.test/cloudstats/stats/", s.options, docs...)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, summary.Indexed)
+	assert.Equal(t, 0, summary.Failed)
+
+	// Two documents per batch, with an action line per document.
+	assert.Len(t, requests, 2)
+	assert.Len(t, requests[0], 4)
+	assert.Len(t, requests[1], 2)
+	assert.Equal(t, map[string]interface{}{"index": map[string]interface{}{"_id": "existing"}}, requests[0][0])
+	assert.Equal(t, map[string]interface{}{"index": map[string]interface{}{}}, requests[0][2])
+	assert.Equal(t, 1.0, requests[0][1]["stats_schema_version"])
+}
+
+func (s *BulkTestSuite) TestRetryRejected(t *check.C) {
+	requests := [][]map[string]interface{}{}
+	httpmock.RegisterResponder("POST", testBulkURL,
+		bulkResponder(t, &requests, []int{201, 429}, []int{429}, []int{201}))
+
+	summary, err := BulkPush("http://elastic.test/cloudstats/stats/", s.options, Stats{}, Stats{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, summary.Indexed)
+	assert.Equal(t, 2, summary.Retried)
+	assert.Len(t, requests, 3)
+}
+
+func (s *BulkTestSuite) TestItemFailures(t *check.C) {
+	requests := [][]map[string]interface{}{}
+	httpmock.RegisterResponder("POST", testBulkURL,
+		bulkResponder(t, &requests, []int{400, 429}, []int{429}, []int{429}))
+
+	timestamp := time.Date(2018, 7, 4, 0, 0, 0, 0, time.UTC)
+	summary, err := BulkPush("http://elastic.test/cloudstats/stats/", s.options,
+		Stats{Timestamp: timestamp}, Stats{})
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, summary.Indexed)
+	assert.Equal(t, 2, summary.Failed)
+	assert.Len(t, requests, 3)
+
+	// The 400 is not retried, the 429 is retried until MaxRetries is reached.
+	assert.Equal(t, 400, summary.Failures[0].Status)
+	assert.Equal(t, timestamp, summary.Failures[0].Timestamp)
+	assert.Equal(t, "some_exception: something went wrong", summary.Failures[0].Reason)
+	assert.Equal(t, 429, summary.Failures[1].Status)
+}
+
+func (s *BulkTestSuite) TestRequestFailure(t *check.C) {
+	httpmock.RegisterResponder("POST", testBulkURL,
+		httpmock.NewStringResponder(401, `{"error": "unauthorized"}`))
+
+	summary, err := BulkPush("http://elastic.test/cloudstats/stats/", s.options, Stats{})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, summary.Failed)
+	assert.Equal(t, 401, summary.Failures[0].Status)
+}
+
+func (s *BulkTestSuite) TestFlushInterval(t *check.C) {
+	requests := [][]map[string]interface{}{}
+	httpmock.RegisterResponder("POST", testBulkURL, bulkResponder(t, &requests, []int{201}))
+
+	s.options.FlushInterval = 10 * time.Millisecond
+	pusher, err := NewBulkPusher("http://elastic.test/cloudstats/stats/", s.options)
+	assert.Nil(t, err)
+	assert.Nil(t, pusher.Add(context.Background(), Stats{}))
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, pusher.Summary().Indexed)
+}
+
+func (s *BulkTestSuite) TestClusterUnreachable(t *check.C) {
+	// The cluster is only contacted when sending, and failing to reach it is retried.
+	pusher, err := NewBulkPusher("http://down.test/cloudstats/stats/", s.options)
+	assert.Nil(t, err)
+	assert.Nil(t, pusher.Add(context.Background(), Stats{}))
+	assert.NotNil(t, pusher.Flush(context.Background()))
+
+	summary := pusher.Summary()
+	assert.Equal(t, 1, summary.Failed)
+	assert.Equal(t, 2, summary.Retried)
+	assert.Equal(t, 0, summary.Failures[0].Status)
+}
+
+func (s *BulkTestSuite) TestFlushCancelled(t *check.C) {
+	requests := [][]map[string]interface{}{}
+	httpmock.RegisterResponder("POST", testBulkURL, bulkResponder(t, &requests, []int{429}))
+
+	s.options.RetryDelay = time.Hour
+	pusher, err := NewBulkPusher("http://elastic.test/cloudstats/stats/", s.options)
+	assert.Nil(t, err)
+	assert.Nil(t, pusher.Add(context.Background(), Stats{}))
+
+	// Waiting for the retry should stop when the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = pusher.Flush(ctx)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "context deadline exceeded")
+	assert.Len(t, requests, 1)
+	assert.Equal(t, 1, pusher.Summary().Failed)
+}
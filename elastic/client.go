@@ -0,0 +1,179 @@
+package elastic
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ClientOptions configure authentication and TLS for all requests to ElasticSearch.
+type ClientOptions struct {
+	// Username and Password are used for basic authentication; an empty username disables it.
+	Username string
+	Password string
+	// APIKey is the base64-encoded "id:api_key" as returned by ElasticSearch when creating an API
+	// key. When set, it is used instead of the username and password.
+	APIKey string
+
+	// CAFile is a PEM file with the certificate authorities that are trusted to sign the
+	// certificate of ElasticSearch. When empty, the system's certificate authorities are used.
+	CAFile string
+	// CertFile and KeyFile are PEM files with the client certificate and its private key.
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify disables verification of the certificate of ElasticSearch. Only use this
+	// for testing, for example with a staging cluster that uses a self-signed certificate.
+	InsecureSkipVerify bool
+
+	// Timeout limits the duration of each request, including reading the response.
+	// Zero means no timeout.
+	Timeout time.Duration
+	// MaxIdleConns is the maximum number of idle (keep-alive) connections that are kept open.
+	MaxIdleConns int
+	// IdleConnTimeout is how long an idle connection is kept open.
+	IdleConnTimeout time.Duration
+	// Compress enables gzip compression of request bodies, when the cluster supports it.
+	Compress bool
+}
+
+// minCompressSize is the minimum size of a request body to compress; compressing smaller bodies
+// costs more time than it saves.
+const minCompressSize = 1024
+
+// DefaultClientOptions returns the options used when Configure() isn't called.
+func DefaultClientOptions() ClientOptions {
+	return ClientOptions{
+		Timeout:         time.Minute,
+		MaxIdleConns:    10,
+		IdleConnTimeout: 90 * time.Second,
+		Compress:        true,
+	}
+}
+
+var (
+	// clientMutex protects client and clientOptions, which are replaced by Configure().
+	clientMutex   sync.RWMutex
+	clientOptions = DefaultClientOptions()
+	// client is shared by all requests to ElasticSearch, so that connections are reused.
+	client = newClient(clientOptions, nil)
+)
+
+func newClient(options ClientOptions, tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		Transport: newTransport(options, tlsConfig),
+		Timeout:   options.Timeout,
+	}
+}
+
+// httpClient returns the HTTP client for requests to ElasticSearch.
+func httpClient() *http.Client {
+	clientMutex.RLock()
+	defer clientMutex.RUnlock()
+	return client
+}
+
+// currentOptions returns the options set by Configure().
+func currentOptions() ClientOptions {
+	clientMutex.RLock()
+	defer clientMutex.RUnlock()
+	return clientOptions
+}
+
+func newTransport(options ClientOptions, tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        options.MaxIdleConns,
+		MaxIdleConnsPerHost: options.MaxIdleConns,
+		IdleConnTimeout:     options.IdleConnTimeout,
+	}
+}
+
+// Configure sets the authentication, TLS and connection options used for all requests to
+// ElasticSearch. Start from DefaultClientOptions() to keep the defaults.
+func Configure(options ClientOptions) error {
+	if (options.CertFile == "") != (options.KeyFile == "") {
+		return fmt.Errorf("both client certificate and key should be given, or neither")
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: options.InsecureSkipVerify}
+	if options.CAFile != "" {
+		pemCerts, err := ioutil.ReadFile(options.CAFile)
+		if err != nil {
+			return fmt.Errorf("unable to read CA file: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pemCerts) {
+			return fmt.Errorf("no certificates found in CA file %s", options.CAFile)
+		}
+	}
+	if options.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return fmt.Errorf("unable to load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	replacement := newClient(options, tlsConfig)
+	clientMutex.Lock()
+	previous := client
+	client, clientOptions = replacement, options
+	clientMutex.Unlock()
+
+	// Requests in progress finish on the previous client; its idle connections would be leaked.
+	previous.CloseIdleConnections()
+	return nil
+}
+
+// newRequest creates a request with a JSON body and the configured credentials. When compress is
+// true and compression is enabled, the body is gzip-compressed.
+func newRequest(method, url string, body []byte, compress bool) (*http.Request, error) {
+	options := currentOptions()
+	contentEncoding := ""
+	if compress && options.Compress && len(body) >= minCompressSize {
+		compressed := bytes.Buffer{}
+		writer := gzip.NewWriter(&compressed)
+		if _, err := writer.Write(body); err != nil {
+			return nil, fmt.Errorf("unable to compress request body: %s", err)
+		}
+		if err := writer.Close(); err != nil {
+			return nil, fmt.Errorf("unable to compress request body: %s", err)
+		}
+		body = compressed.Bytes()
+		contentEncoding = "gzip"
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	authenticate(req, options)
+	return req, nil
+}
+
+// authenticate adds the configured credentials to the request.
+func authenticate(req *http.Request, options ClientOptions) {
+	switch {
+	case options.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+options.APIKey)
+	case options.Username != "":
+		req.SetBasicAuth(options.Username, options.Password)
+	}
+}
@@ -0,0 +1,89 @@
+package elastic
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+)
+
+type ClientTestSuite struct {
+	server        *httptest.Server
+	serverURL     *url.URL
+	authorization string
+}
+
+var _ = check.Suite(&ClientTestSuite{})
+
+func (s *ClientTestSuite) SetUpTest(c *check.C) {
+	s.server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.authorization = r.Header.Get("Authorization")
+		w.Write([]byte(`{}`))
+	}))
+	s.serverURL, _ = url.Parse(s.server.URL)
+}
+
+func (s *ClientTestSuite) TearDownTest(c *check.C) {
+	s.server.Close()
+	Configure(DefaultClientOptions())
+}
+
+func (s *ClientTestSuite) TestUntrustedCertificate(t *check.C) {
+	assert.Nil(t, Configure(DefaultClientOptions()))
+	_, err := (&Cluster{}).requestJSON("GET", s.serverURL, nil, nil)
+	assert.NotNil(t, err)
+}
+
+func (s *ClientTestSuite) TestInsecureSkipVerify(t *check.C) {
+	assert.Nil(t, Configure(ClientOptions{InsecureSkipVerify: true}))
+	_, err := (&Cluster{}).requestJSON("GET", s.serverURL, nil, nil)
+	assert.Nil(t, err)
+}
+
+func (s *ClientTestSuite) TestCAFile(t *check.C) {
+	caFile, err := ioutil.TempFile("", "elastic-ca")
+	assert.Nil(t, err)
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: s.server.Certificate().Raw})
+	caFile.Close()
+
+	assert.Nil(t, Configure(ClientOptions{CAFile: caFile.Name()}))
+	_, err = (&Cluster{}).requestJSON("GET", s.serverURL, nil, nil)
+	assert.Nil(t, err)
+}
+
+func (s *ClientTestSuite) TestInvalidOptions(t *check.C) {
+	assert.NotNil(t, Configure(ClientOptions{CAFile: "/nonexistant/ca.pem"}))
+	assert.NotNil(t, Configure(ClientOptions{CertFile: "client.pem"}))
+}
+
+func (s *ClientTestSuite) TestAuthentication(t *check.C) {
+	assert.Nil(t, Configure(ClientOptions{InsecureSkipVerify: true, Username: "user", Password: "pass"}))
+	(&Cluster{}).requestJSON("GET", s.serverURL, nil, nil)
+	assert.Equal(t, "Basic dXNlcjpwYXNz", s.authorization)
+
+	// The API key should take precedence.
+	assert.Nil(t, Configure(ClientOptions{
+		InsecureSkipVerify: true,
+		Username:           "user",
+		APIKey:             "aWQ6a2V5",
+	}))
+	(&Cluster{}).requestJSON("GET", s.serverURL, nil, nil)
+	assert.Equal(t, "ApiKey aWQ6a2V5", s.authorization)
+}
+
+func (s *ClientTestSuite) TestConfigureReplacesClient(t *check.C) {
+	assert.Nil(t, Configure(DefaultClientOptions()))
+	previous := httpClient()
+	assert.Nil(t, Configure(ClientOptions{InsecureSkipVerify: true, Username: "user"}))
+
+	// Requests in progress keep the previous client, so it shouldn't be modified.
+	assert.False(t, previous == httpClient())
+	assert.False(t, previous.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify)
+	assert.Equal(t, "user", currentOptions().Username)
+}
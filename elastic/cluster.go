@@ -0,0 +1,240 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Cluster describes the ElasticSearch or OpenSearch cluster that contains the statistics index.
+type Cluster struct {
+	// Distribution is either "elasticsearch" or "opensearch".
+	Distribution string
+	// Version is the version number reported by the cluster, like "6.1.2".
+	Version string
+	Major   int
+	// Compression is true when the cluster accepts gzip-compressed requests.
+	Compression bool
+
+	root    *url.URL
+	index   string
+	docType string // empty for typeless clusters
+}
+
+var clusters = struct {
+	sync.Mutex
+	byURL map[string]*Cluster
+}{byURL: map[string]*Cluster{}}
+
+// DetectCluster queries the root endpoint of the cluster to determine its version. The URL can
+// be in the form "http://host:port/index/type/" for ElasticSearch 6 or "http://host:port/index/"
+// for typeless clusters (ElasticSearch 7+ and OpenSearch); on typeless clusters the type is
+// ignored. The result is cached per URL.
+func DetectCluster(elasticURL string) (*Cluster, error) {
+	return DetectClusterContext(context.Background(), elasticURL)
+}
+
+// DetectClusterContext is like DetectCluster, but aborts the request when the context is done.
+func DetectClusterContext(ctx context.Context, elasticURL string) (*Cluster, error) {
+	clusters.Lock()
+	cluster, found := clusters.byURL[elasticURL]
+	clusters.Unlock()
+	if found {
+		return cluster, nil
+	}
+
+	// The cluster is queried without holding the lock, so that a slow cluster doesn't block
+	// callers for other URLs. Concurrent callers for the same URL may both query it.
+	cluster, err := queryCluster(ctx, elasticURL)
+	if err != nil {
+		return nil, err
+	}
+
+	clusters.Lock()
+	defer clusters.Unlock()
+	if existing, found := clusters.byURL[elasticURL]; found {
+		return existing, nil
+	}
+	clusters.byURL[elasticURL] = cluster
+	return cluster, nil
+}
+
+// queryCluster performs the detection for DetectClusterContext, without caching.
+func queryCluster(ctx context.Context, elasticURL string) (*Cluster, error) {
+	parsed, err := url.Parse(elasticURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %s", err)
+	}
+	parts := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	if len(parts) < 1 || len(parts) > 2 || parts[0] == "" {
+		return nil, fmt.Errorf("expected URL in the form http://host:port/index/ or http://host:port/index/type/, not %s", elasticURL)
+	}
+	root, err := parsed.Parse(strings.Repeat("../", len(parts)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct root URL: %s", err)
+	}
+
+	var info struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	req, err := newRequest("GET", root.String(), nil, false)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create request: %s", err)
+	}
+	resp, err := httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine cluster version: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unable to determine cluster version: error %d from %s", resp.StatusCode, root)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read cluster version: %s", err)
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return nil, fmt.Errorf("unable to decode cluster version: %s", err)
+	}
+
+	cluster := &Cluster{
+		Distribution: "elasticsearch",
+		Version:      info.Version.Number,
+		// Requests ask for compressed responses. When the cluster sends those, HTTP compression is
+		// enabled, which means that it also accepts compressed requests.
+		Compression: resp.Uncompressed,
+		root:        root,
+		index:       parts[0],
+	}
+	if info.Version.Distribution != "" {
+		cluster.Distribution = info.Version.Distribution
+	}
+	cluster.Major, err = strconv.Atoi(strings.SplitN(cluster.Version, ".", 2)[0])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse cluster version %q: %s", cluster.Version, err)
+	}
+
+	logger := log.WithFields(log.Fields{
+		"distribution": cluster.Distribution,
+		"version":      cluster.Version,
+		"compression":  cluster.Compression,
+	})
+	switch {
+	case !cluster.Typeless() && len(parts) == 2:
+		cluster.docType = parts[1]
+	case !cluster.Typeless():
+		cluster.docType = "_doc"
+	case len(parts) == 2 && parts[1] != "_doc":
+		logger.WithField("type", parts[1]).Warning("cluster does not support document types, ignoring type in URL")
+	}
+
+	logger.Debug("detected ElasticSearch cluster")
+	return cluster, nil
+}
+
+// Typeless returns true when the cluster doesn't support document types in its APIs.
+func (c *Cluster) Typeless() bool {
+	return c.Distribution == "opensearch" || c.Major >= 7
+}
+
+// url returns the URL of the path, relative to the root URL of the cluster.
+func (c *Cluster) url(path string) *url.URL {
+	resolved, err := c.root.Parse(path)
+	if err != nil {
+		// Paths are constructed by this package, so this shouldn't happen.
+		panic(fmt.Sprintf("unable to construct URL for %q: %s", path, err))
+	}
+	return resolved
+}
+
+// indexURL returns the URL of the path within the index, for example "_mapping".
+func (c *Cluster) indexURL(path string) *url.URL {
+	return c.url(c.index + "/" + path)
+}
+
+// typeURL returns the URL of the path within the document type on clusters that have types, and
+// within the index on typeless clusters, for example "_search" or "_bulk".
+func (c *Cluster) typeURL(path string) *url.URL {
+	if c.Typeless() {
+		return c.indexURL(path)
+	}
+	return c.indexURL(c.docType + "/" + path)
+}
+
+// documentURL returns the URL for a document with the given ID, or the URL to POST new documents
+// to when the ID is empty.
+func (c *Cluster) documentURL(ID string) *url.URL {
+	if c.Typeless() {
+		return c.indexURL("_doc/" + url.PathEscape(ID))
+	}
+	return c.indexURL(c.docType + "/" + url.PathEscape(ID))
+}
+
+// requestJSON performs a HTTP request with optional JSON payload, and decodes the JSON response
+// into result if it's not nil. Returns the HTTP status code.
+func (c *Cluster) requestJSON(method string, url *url.URL, payload, result interface{}) (int, error) {
+	var body []byte
+	if payload != nil {
+		payloadBytes, err := json.Marshal(payload)
+		if err != nil {
+			return 0, fmt.Errorf("unable to marshal JSON: %s", err)
+		}
+		body = payloadBytes
+	}
+
+	req, err := newRequest(method, url.String(), body, c.Compression)
+	if err != nil {
+		return 0, fmt.Errorf("unable to create request: %s", err)
+	}
+
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error performing HTTP request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, fmt.Errorf("error reading HTTP response body: %s", err)
+	}
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("error %d from %s %s: %s", resp.StatusCode, method, url, respBody)
+	}
+	if result != nil {
+		if err := json.Unmarshal(respBody, result); err != nil {
+			return resp.StatusCode, fmt.Errorf("unable to decode JSON: %s", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// hitsTotal is the total number of search hits. ElasticSearch 6 returns a number, while typeless
+// clusters return an object like {"value": 47, "relation": "eq"}.
+type hitsTotal int
+
+func (h *hitsTotal) UnmarshalJSON(data []byte) error {
+	var number int
+	if err := json.Unmarshal(data, &number); err == nil {
+		*h = hitsTotal(number)
+		return nil
+	}
+
+	var object struct {
+		Value int `json:"value"`
+	}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return fmt.Errorf("unable to decode hits.total: %s", err)
+	}
+	*h = hitsTotal(object.Value)
+	return nil
+}
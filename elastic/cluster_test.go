@@ -0,0 +1,112 @@
+package elastic
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	"gopkg.in/jarcoal/httpmock.v1"
+)
+
+type ClusterTestSuite struct{}
+
+var _ = check.Suite(&ClusterTestSuite{})
+
+func (s *ClusterTestSuite) SetUpTest(c *check.C) {
+	httpmock.ActivateNonDefault(client)
+}
+
+func (s *ClusterTestSuite) TearDownTest(c *check.C) {
+	httpmock.DeactivateAndReset()
+}
+
+// mockCluster makes the cluster at rootURL report the given version and distribution, and
+// forgets previously detected clusters.
+func mockCluster(rootURL, version, distribution string) {
+	clusters.Lock()
+	clusters.byURL = map[string]*Cluster{}
+	clusters.Unlock()
+
+	info := map[string]interface{}{
+		"version": map[string]string{"number": version, "distribution": distribution},
+	}
+	responder, _ := httpmock.NewJsonResponder(200, info)
+	httpmock.RegisterResponder("GET", rootURL, responder)
+}
+
+func (s *ClusterTestSuite) TestElastic6(t *check.C) {
+	mockCluster("http://elastic.test/", "6.1.2", "")
+
+	cluster, err := DetectCluster("http://elastic.test/cloudstats/stats/")
+	assert.Nil(t, err)
+	assert.Equal(t, "elasticsearch", cluster.Distribution)
+	assert.Equal(t, 6, cluster.Major)
+	assert.False(t, cluster.Typeless())
+	assert.Equal(t, "http://elastic.test/cloudstats/stats/", cluster.documentURL("").String())
+	assert.Equal(t, "http://elastic.test/cloudstats/stats/_bulk", cluster.typeURL("_bulk").String())
+	assert.Equal(t, "http://elastic.test/cloudstats/", cluster.indexURL("").String())
+
+	// Without type in the URL, the type should default to _doc.
+	cluster, err = DetectCluster("http://elastic.test/cloudstats/")
+	assert.Nil(t, err)
+	assert.Equal(t, "http://elastic.test/cloudstats/_doc/abc", cluster.documentURL("abc").String())
+}
+
+func (s *ClusterTestSuite) TestTypeless(t *check.C) {
+	mockCluster("http://elastic.test/", "7.10.2", "")
+
+	// The type in the URL should be ignored.
+	cluster, err := DetectCluster("http://elastic.test/cloudstats/stats/")
+	assert.Nil(t, err)
+	assert.True(t, cluster.Typeless())
+	assert.Equal(t, "http://elastic.test/cloudstats/_doc/", cluster.documentURL("").String())
+	assert.Equal(t, "http://elastic.test/cloudstats/_bulk", cluster.typeURL("_bulk").String())
+	assert.Equal(t, "http://elastic.test/cloudstats/_search", cluster.typeURL("_search").String())
+}
+
+func (s *ClusterTestSuite) TestInvalidURL(t *check.C) {
+	mockCluster("http://elastic.test/", "8.11.0", "")
+
+	_, err := DetectCluster("http://elastic.test/")
+	assert.NotNil(t, err)
+	_, err = DetectCluster("http://elastic.test/prefix/cloudstats/stats/")
+	assert.NotNil(t, err)
+}
+
+func (s *ClusterTestSuite) TestOpenSearch(t *check.C) {
+	mockCluster("http://elastic.test/", "2.11.0", "opensearch")
+
+	cluster, err := DetectCluster("http://elastic.test/cloudstats/")
+	assert.Nil(t, err)
+	assert.Equal(t, "opensearch", cluster.Distribution)
+	assert.True(t, cluster.Typeless())
+}
+
+func (s *ClusterTestSuite) TestDetectWithoutLock(t *check.C) {
+	mockCluster("http://other.test/", "7.10.2", "")
+
+	// Detecting another cluster while the first one is being queried should not block.
+	var otherErr error
+	httpmock.RegisterResponder("GET", "http://elastic.test/",
+		func(req *http.Request) (*http.Response, error) {
+			_, otherErr = DetectCluster("http://other.test/cloudstats/")
+			return httpmock.NewJsonResponse(200, map[string]interface{}{
+				"version": map[string]string{"number": "6.1.2"},
+			})
+		})
+
+	cluster, err := DetectCluster("http://elastic.test/cloudstats/")
+	assert.Nil(t, err)
+	assert.Nil(t, otherErr)
+	assert.Equal(t, 6, cluster.Major)
+}
+
+func (s *ClusterTestSuite) TestHitsTotal(t *check.C) {
+	var response scrollResponse
+	assert.Nil(t, json.Unmarshal([]byte(`{"hits": {"total": 47, "hits": []}}`), &response))
+	assert.Equal(t, hitsTotal(47), response.Hits.Total)
+
+	assert.Nil(t, json.Unmarshal([]byte(`{"hits": {"total": {"value": 327, "relation": "eq"}, "hits": []}}`), &response))
+	assert.Equal(t, hitsTotal(327), response.Hits.Total)
+}
@@ -1,6 +1,9 @@
 package elastic
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 // Stats represents the JSON document pushed to ElasticSearch
 type Stats struct {
@@ -8,17 +11,49 @@ type Stats struct {
 	SchemaVersion int       `json:"stats_schema_version" bson:"stats_schema_version"`
 	Timestamp     time.Time `json:"timestamp" bson:"timestamp"`
 
+	// Sections lists the collectors that contributed to this document; see SectionFields.
+	// Documents from before this was recorded do not have it, and contain all sections.
+	Sections []string `json:"collected_sections,omitempty" bson:"collected_sections,omitempty"`
+	// Partial is true when only some of the collectors were selected to run with -only. Such
+	// documents are merged into existing documents with the same timestamp.
+	Partial bool `json:"partial,omitempty" bson:"partial,omitempty"`
+	// Estimated lists the sections whose values were estimated afterwards by -fill-gaps, because
+	// they could not be collected at the time.
+	Estimated []string `json:"estimated_sections,omitempty" bson:"estimated_sections,omitempty"`
+
 	Files struct {
-		ExpiredLinkCount                int              `json:"expired_link_count" bson:"expired_link_count"`
+		ExpiredLinkCount int `json:"expired_link_count" bson:"expired_link_count"`
+		// ExpiringLinkCount counts the links that expire within each window, like "24h" or "7d".
+		ExpiringLinkCount          map[string]int `json:"expiring_link_count,omitempty" bson:"expiring_link_count,omitempty"`
+		ExpiredLinkCountPerBackend map[string]int `json:"expired_link_count_per_backend,omitempty" bson:"expired_link_count_per_backend,omitempty"`
+		// ExpiredLinkCountPerAge counts the expired links by how long ago they expired, using the
+		// same windows; "more" counts links that expired longer ago than the largest window.
+		ExpiredLinkCountPerAge          map[string]int   `json:"expired_link_count_per_age,omitempty" bson:"expired_link_count_per_age,omitempty"`
 		NoLinkCount                     int              `json:"no_link_count" bson:"no_link_count"`
 		TotalBytesStorageUsed           int64            `json:"total_bytes_storage_used" bson:"total_bytes_storage_used"`
 		TotalBytesStorageUsedPerBackend map[string]int64 `json:"total_bytes_storage_used_per_backend" bson:"total_bytes_storage_used_per_backend"`
 		FileCountTotal                  int              `json:"file_count_total" bson:"file_count_total"`
 		FileCountPerStatus              map[string]int   `json:"file_count_per_status" bson:"file_count_per_status"`
 		FileCountPerBackend             map[string]int   `json:"file_count_per_backend" bson:"file_count_per_backend"`
-		// These I really, really want to get in there, but require much more extensive querying.
-		// OrphanFileCount                 int32            `json:"orphan_file_count" bson:"orphan_file_count"`
-		// TotalOrphanFileSizeInBytes      int64            `json:"total_orphan_file_size_in_bytes" bson:"total_orphan_file_size_in_bytes"`
+
+		// FileCountPerSize is a histogram of file sizes. The keys are the upper bounds of the
+		// buckets, like "16KiB", and "more" for the files above the last bucket.
+		FileCountPerSize  map[string]int   `json:"file_count_per_size,omitempty" bson:"file_count_per_size,omitempty"`
+		TotalBytesPerSize map[string]int64 `json:"total_bytes_per_size,omitempty" bson:"total_bytes_per_size,omitempty"`
+		// Counts per content type family: "image", "video", "blend", "archive" or "other".
+		FileCountPerContentType  map[string]int   `json:"file_count_per_content_type,omitempty" bson:"file_count_per_content_type,omitempty"`
+		TotalBytesPerContentType map[string]int64 `json:"total_bytes_per_content_type,omitempty" bson:"total_bytes_per_content_type,omitempty"`
+		// LargestFiles lists the largest files, largest first.
+		LargestFiles []LargestFile `json:"largest_files,omitempty" bson:"largest_files,omitempty"`
+
+		// Orphan files are not referenced by any node, project, user or other file. Finding them
+		// requires much more extensive querying, so they are counted by a separate, optional
+		// collector. Like the subscriber count, the counts are omitted when it did not run rather
+		// than stored as 0; whether it ran is recorded in Sections.
+		OrphanFileCount            int              `json:"orphan_file_count,omitempty" bson:"orphan_file_count,omitempty"`
+		TotalOrphanFileSizeInBytes int64            `json:"total_orphan_file_size_in_bytes,omitempty" bson:"total_orphan_file_size_in_bytes,omitempty"`
+		OrphanFileCountPerBackend  map[string]int   `json:"orphan_file_count_per_backend,omitempty" bson:"orphan_file_count_per_backend,omitempty"`
+		TotalOrphanBytesPerBackend map[string]int64 `json:"total_orphan_bytes_per_backend,omitempty" bson:"total_orphan_bytes_per_backend,omitempty"`
 	} `json:"files" bson:"files"`
 
 	Projects struct {
@@ -27,6 +62,12 @@ type Stats struct {
 		HomeProjectCount  int `json:"home_project_count" bson:"home_project_count"`
 		TotalCount        int `json:"total_count" bson:"total_count"`
 		TotalDeletedCount int `json:"total_deleted_count" bson:"total_deleted_count"`
+
+		// Storage used by files per project category: "public", "private", "home" or "deleted".
+		FileCountPerCategory map[string]int   `json:"file_count_per_category,omitempty" bson:"file_count_per_category,omitempty"`
+		BytesPerCategory     map[string]int64 `json:"total_bytes_per_category,omitempty" bson:"total_bytes_per_category,omitempty"`
+		// TopStorage lists the projects that use the most storage, largest first.
+		TopStorage []ProjectStorage `json:"top_storage,omitempty" bson:"top_storage,omitempty"`
 	} `json:"projects" bson:"projects"`
 
 	Nodes struct {
@@ -39,6 +80,8 @@ type Stats struct {
 		TotalRealUserCount int            `json:"total_real_user_count" bson:"total_real_user_count"`
 		CountPerType       map[string]int `json:"count_per_type" bson:"count_per_type"`
 		BlenderSyncCount   int            `json:"blender_sync_count" bson:"blender_sync_count"`
+		// BlenderSync describes the Blender Sync usage and the storage of home projects.
+		BlenderSync *BlenderSync `json:"blender_sync,omitempty" bson:"blender_sync,omitempty"`
 
 		// SubscriberCount comes from the Store, which can be unreachable at times. Rather than
 		// passing an explicit count of 0 to ElasticSearch, it's better to omit the key completely
@@ -47,6 +90,30 @@ type Stats struct {
 	} `json:"users" bson:"users"`
 
 	BlenderID *BlenderID `json:"blender_id,omitempty" bson:"blender_id,omitempty"`
+
+	// FetchAttempts maps external sources ("store", "blenderid") to the number of attempts it took
+	// to get their statistics. Sources that could not be reached are omitted.
+	FetchAttempts map[string]int `json:"fetch_attempts,omitempty" bson:"fetch_attempts,omitempty"`
+
+	// ProjectStorage is the storage used by every project, when the breakdown was requested. It is
+	// not part of the document, but stored separately by the sinks; see ProjectStorage.
+	ProjectStorage []ProjectStorage `json:"-" bson:"-"`
+}
+
+// ProjectStorage is the storage used by the files of one project. Besides being listed in the
+// statistics document for the largest projects, these are stored as separate documents for all
+// projects, in the cloudstats_projects MongoDB collection and ElasticSearch index.
+type ProjectStorage struct {
+	ID        string    `json:"-" bson:"_id,omitempty"` // used by MongoDB but not by ElasticSearch.
+	Timestamp time.Time `json:"timestamp" bson:"timestamp"`
+
+	Project             string           `json:"project" bson:"project"`
+	Name                string           `json:"name" bson:"name"`
+	Category            string           `json:"category" bson:"category"`
+	FileCount           int              `json:"file_count" bson:"file_count"`
+	TotalBytes          int64            `json:"total_bytes" bson:"total_bytes"`
+	FileCountPerBackend map[string]int   `json:"file_count_per_backend" bson:"file_count_per_backend"`
+	BytesPerBackend     map[string]int64 `json:"total_bytes_per_backend" bson:"total_bytes_per_backend"`
 }
 
 // BlenderID models the stats from Blender ID
@@ -57,6 +124,35 @@ type BlenderID struct {
 	TotalCount            int                    `json:"total_user_count" bson:"total_user_count"`
 }
 
+// LargestFile describes one of the largest files.
+type LargestFile struct {
+	ID          string `json:"id" bson:"id"`
+	Project     string `json:"project,omitempty" bson:"project,omitempty"`
+	Filename    string `json:"filename" bson:"filename"`
+	ContentType string `json:"content_type" bson:"content_type"`
+	// Family is the content type family, like "video".
+	Family  string `json:"content_type_family" bson:"content_type_family"`
+	Backend string `json:"backend" bson:"backend"`
+	Size    int64  `json:"size" bson:"size"`
+}
+
+// BlenderSync models the usage of Blender Sync, which stores Blender settings in home projects.
+type BlenderSync struct {
+	// UserCountPerVersion counts the users that synced settings per Blender version. Dots in the
+	// version are replaced by underscores, like "2_79".
+	UserCountPerVersion map[string]int `json:"user_count_per_version" bson:"user_count_per_version"`
+	// SyncedBytes is the total size of the synced files.
+	SyncedBytes int64 `json:"synced_bytes" bson:"synced_bytes"`
+	// HomeProjectBytes is the total size of all files in home projects.
+	HomeProjectBytes int64 `json:"home_project_bytes" bson:"home_project_bytes"`
+	// HomeProjectCountPerSize is a histogram of the storage per home project. The keys are the
+	// upper bounds of the buckets, like "1MiB", and "empty" and "more" for the first and last.
+	HomeProjectCountPerSize map[string]int `json:"home_project_count_per_size" bson:"home_project_count_per_size"`
+	// OverQuotaCount counts the users whose home project uses more than Quota bytes.
+	OverQuotaCount int   `json:"over_quota_count" bson:"over_quota_count"`
+	Quota          int64 `json:"quota_bytes" bson:"quota_bytes"`
+}
+
 // BlenderIDPrivacyPolicy is a subdocument of BlenderID and counts user agreements to the privacy policy.
 type BlenderIDPrivacyPolicy struct {
 	Latest   int `json:"latest"`
@@ -64,6 +160,118 @@ type BlenderIDPrivacyPolicy struct {
 	Never    int `json:"never"`
 }
 
+// DocumentID returns a deterministic ID for the statistics of the instance at the timestamp, so
+// that collecting them again replaces the existing document instead of adding a duplicate.
+func DocumentID(instance string, timestamp time.Time) string {
+	return instance + "-" + timestamp.UTC().Format("20060102T150405Z")
+}
+
+// SectionFields maps collector names to the document fields they fill.
+// This is used to merge partially collected documents into existing ones.
+var SectionFields = map[string][]string{
+	"files": {
+		"files.expired_link_count",
+		"files.expiring_link_count",
+		"files.expired_link_count_per_backend",
+		"files.expired_link_count_per_age",
+		"files.no_link_count",
+		"files.total_bytes_storage_used",
+		"files.total_bytes_storage_used_per_backend",
+		"files.file_count_total",
+		"files.file_count_per_status",
+		"files.file_count_per_backend",
+		"files.file_count_per_size",
+		"files.total_bytes_per_size",
+		"files.file_count_per_content_type",
+		"files.total_bytes_per_content_type",
+		"files.largest_files",
+	},
+	"orphans": {
+		"files.orphan_file_count",
+		"files.total_orphan_file_size_in_bytes",
+		"files.orphan_file_count_per_backend",
+		"files.total_orphan_bytes_per_backend",
+	},
+	"projects": {
+		"projects.public_count",
+		"projects.private_count",
+		"projects.home_project_count",
+		"projects.total_count",
+		"projects.total_deleted_count",
+	},
+	"projectstorage": {
+		"projects.file_count_per_category",
+		"projects.total_bytes_per_category",
+		"projects.top_storage",
+	},
+	"nodes":       {"nodes"},
+	"users":       {"users.total_user_count", "users.total_real_user_count", "users.count_per_type"},
+	"blendersync": {"users.blender_sync_count", "users.blender_sync"},
+	"store":       {"users.subscriber_count", "fetch_attempts.store"},
+	"blenderid":   {"blender_id", "fetch_attempts.blenderid"},
+}
+
+// Collected reports whether the field at the dotted JSON path, like "files.orphan_file_count",
+// was filled by one of the sections in s.Sections. The fields of sections that were not collected
+// are zero, which should not be exported as if it was measured. Fields that belong to no section,
+// and all fields of documents without s.Sections, count as collected. A parent like "users" counts
+// as collected when any of the section fields below it was.
+func (s *Stats) Collected(path string) bool {
+	if len(s.Sections) == 0 {
+		return true
+	}
+	owned := false
+	for section, fields := range SectionFields {
+		for _, field := range fields {
+			if field != path && !strings.HasPrefix(path, field+".") && !strings.HasPrefix(field, path+".") {
+				continue
+			}
+			for _, collected := range s.Sections {
+				if collected == section {
+					return true
+				}
+			}
+			owned = true
+		}
+	}
+	return !owned
+}
+
+// keyNames maps the JSON names of map fields in Stats to a name for their keys.
+var keyNames = map[string]string{
+	"total_bytes_storage_used_per_backend": "backend",
+	"file_count_per_backend":               "backend",
+	"file_count_per_status":                "status",
+	"expiring_link_count":                  "window",
+	"expired_link_count_per_backend":       "backend",
+	"expired_link_count_per_age":           "age",
+	"file_count_per_size":                  "size",
+	"total_bytes_per_size":                 "size",
+	"file_count_per_content_type":          "content_type",
+	"total_bytes_per_content_type":         "content_type",
+	"orphan_file_count_per_backend":        "backend",
+	"total_orphan_bytes_per_backend":       "backend",
+	"total_bytes_per_backend":              "backend",
+	"file_count_per_category":              "category",
+	"total_bytes_per_category":             "category",
+	"public_node_count_per_type":           "node_type",
+	"user_count_per_version":               "version",
+	"home_project_count_per_size":          "size",
+	"count_per_type":                       "type",
+	"fetch_attempts":                       "source",
+}
+
+// KeyName returns a name for the keys of the map field with the given JSON name, for example
+// "backend" for "file_count_per_backend". This is used for labels and tags when exporting the
+// statistics to other systems. Returns "key" for unknown fields.
+func KeyName(jsonName string) string {
+	name, found := keyNames[jsonName]
+	if !found {
+		return "key"
+	}
+	return name
+}
+
 type postResponse struct {
 	Index   string `json:"_index" bson:"_index"`
 	Type    string `json:"_type" bson:"_type"`
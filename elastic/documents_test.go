@@ -0,0 +1,84 @@
+package elastic
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	"gopkg.in/jarcoal/httpmock.v1"
+)
+
+type DocumentIDTestSuite struct{}
+
+var _ = check.Suite(&DocumentIDTestSuite{})
+
+func (s *DocumentIDTestSuite) TestDocumentID(t *check.C) {
+	timestamp := time.Date(2018, 7, 4, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, "cloud-20180704T000000Z", DocumentID("cloud", timestamp))
+
+	// The ID shouldn't depend on the time zone.
+	amsterdam := time.FixedZone("CEST", 2*3600)
+	assert.Equal(t, "cloud-20180704T000000Z", DocumentID("cloud", timestamp.In(amsterdam)))
+}
+
+func (s *DocumentIDTestSuite) TestCollected(t *check.C) {
+	stats := Stats{}
+	assert.True(t, stats.Collected("files.orphan_file_count"))
+
+	stats.Sections = []string{"files", "store"}
+	assert.True(t, stats.Collected("files.file_count_total"))
+	assert.False(t, stats.Collected("files.orphan_file_count"))
+	assert.True(t, stats.Collected("files"))
+	assert.False(t, stats.Collected("nodes"))
+	assert.False(t, stats.Collected("nodes.total_public_node_count"))
+	assert.True(t, stats.Collected("users"))
+	assert.True(t, stats.Collected("users.subscriber_count"))
+	assert.False(t, stats.Collected("users.total_user_count"))
+	assert.False(t, stats.Collected("blender_id.total_user_count"))
+	assert.True(t, stats.Collected("stats_schema_version"))
+}
+
+func (s *DocumentIDTestSuite) TestOrphansOmitted(t *check.C) {
+	// The orphans collector is optional, so documents without its section should leave its
+	// counts out instead of reporting zero orphans.
+	stats := Stats{Sections: []string{"files"}}
+	stats.Files.FileCountTotal = 5
+	asJSON, err := json.Marshal(stats)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(asJSON), "orphan")
+	assert.Contains(t, string(asJSON), `"file_count_total":5`)
+}
+
+// DocumentsTestSuite pushes documents to a mocked cluster.
+type DocumentsTestSuite struct{}
+
+var _ = check.Suite(&DocumentsTestSuite{})
+
+func (s *DocumentsTestSuite) SetUpTest(c *check.C) {
+	httpmock.ActivateNonDefault(client)
+	mockCluster("http://elastic.test/", "7.10.2", "")
+}
+
+func (s *DocumentsTestSuite) TearDownTest(c *check.C) {
+	httpmock.DeactivateAndReset()
+}
+
+func (s *DocumentsTestSuite) TestPushWithID(t *check.C) {
+	puts := 0
+	httpmock.RegisterResponder("PUT", "http://elastic.test/cloudstats/_doc/cloud-20180704T000000Z",
+		func(req *http.Request) (*http.Response, error) {
+			puts++
+			return httpmock.NewStringResponse(200, `{"_id": "cloud-20180704T000000Z", "result": "updated"}`), nil
+		})
+
+	timestamp := time.Date(2018, 7, 4, 0, 0, 0, 0, time.UTC)
+	stats := Stats{ID: DocumentID("cloud", timestamp), Timestamp: timestamp}
+	for idx := 0; idx < 2; idx++ {
+		ID, err := Push("http://elastic.test/cloudstats/", stats)
+		assert.Nil(t, err)
+		assert.Equal(t, "cloud-20180704T000000Z", ID)
+	}
+	assert.Equal(t, 2, puts)
+}
@@ -0,0 +1,320 @@
+package elastic
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TemplateName is the name of the index template installed by EnsureTemplate.
+const TemplateName = "cloudstats"
+
+// MappingDifference describes a field whose mapping in ElasticSearch differs from the expected one.
+type MappingDifference struct {
+	Field string
+	// Expected and Actual are field types, like "long" or "object". An empty string means that
+	// the field is not expected or missing, respectively.
+	Expected string
+	Actual   string
+}
+
+func (d MappingDifference) String() string {
+	switch {
+	case d.Actual == "":
+		return fmt.Sprintf("%s: missing, expected %s", d.Field, d.Expected)
+	case d.Expected == "":
+		return fmt.Sprintf("%s: unexpected field of type %s", d.Field, d.Actual)
+	}
+	return fmt.Sprintf("%s: expected %s, got %s", d.Field, d.Expected, d.Actual)
+}
+
+// Mapping returns the properties of the ElasticSearch mapping of the Stats document.
+func Mapping() map[string]interface{} {
+	return propertiesOf(reflect.TypeOf(Stats{}))
+}
+
+// mapFields returns the dotted paths of map fields, with the ElasticSearch type of their values.
+// The keys of these maps (like storage backends) are not known in advance, so they are mapped
+// with dynamic templates.
+func mapFields() map[string]string {
+	fields := map[string]string{}
+	var walk func(prefix string, structType reflect.Type)
+	walk = func(prefix string, structType reflect.Type) {
+		for idx := 0; idx < structType.NumField(); idx++ {
+			field := structType.Field(idx)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			fieldType := field.Type
+			if fieldType.Kind() == reflect.Ptr {
+				fieldType = fieldType.Elem()
+			}
+			if fieldType.Kind() == reflect.Slice {
+				// Arrays of objects have the same mapping as a single object.
+				fieldType = fieldType.Elem()
+			}
+			switch {
+			case fieldType.Kind() == reflect.Map:
+				fields[prefix+name] = fieldTypeName(fieldType.Elem())
+			case fieldType.Kind() == reflect.Struct && fieldType != reflect.TypeOf(time.Time{}):
+				walk(prefix+name+".", fieldType)
+			}
+		}
+	}
+	walk("", reflect.TypeOf(Stats{}))
+	return fields
+}
+
+func propertiesOf(structType reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for idx := 0; idx < structType.NumField(); idx++ {
+		field := structType.Field(idx)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType.Kind() == reflect.Slice {
+			// Arrays of objects have the same mapping as a single object.
+			fieldType = fieldType.Elem()
+		}
+		switch typeName := fieldTypeName(fieldType); typeName {
+		case "object":
+			if fieldType.Kind() == reflect.Map {
+				properties[name] = map[string]interface{}{"type": "object"}
+			} else {
+				properties[name] = map[string]interface{}{"properties": propertiesOf(fieldType)}
+			}
+		case "":
+			continue
+		default:
+			properties[name] = map[string]interface{}{"type": typeName}
+		}
+	}
+	return properties
+}
+
+// fieldTypeName returns the ElasticSearch type for the Go type.
+func fieldTypeName(fieldType reflect.Type) string {
+	if fieldType == reflect.TypeOf(time.Time{}) {
+		return "date"
+	}
+	switch fieldType.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		// Always use long, as byte counts easily exceed the range of an integer.
+		return "long"
+	case reflect.Float32, reflect.Float64:
+		return "double"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "keyword"
+	case reflect.Slice:
+		return fieldTypeName(fieldType.Elem())
+	case reflect.Struct, reflect.Map:
+		return "object"
+	}
+	return ""
+}
+
+// template returns the index template for the statistics index of the cluster.
+func template(cluster *Cluster) map[string]interface{} {
+	dynamicTemplates := []interface{}{}
+	paths := []string{}
+	fields := mapFields()
+	for path := range fields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		dynamicTemplates = append(dynamicTemplates, map[string]interface{}{
+			path: map[string]interface{}{
+				"path_match": path + ".*",
+				"mapping":    map[string]interface{}{"type": fields[path]},
+			},
+		})
+	}
+	dynamicTemplates = append(dynamicTemplates, map[string]interface{}{
+		"strings_as_keywords": map[string]interface{}{
+			"match_mapping_type": "string",
+			"mapping":            map[string]interface{}{"type": "keyword"},
+		},
+	})
+
+	mapping := map[string]interface{}{
+		"dynamic_templates": dynamicTemplates,
+		"properties":        Mapping(),
+	}
+	tmpl := map[string]interface{}{
+		"index_patterns": []string{cluster.index},
+		"mappings":       mapping,
+	}
+	if !cluster.Typeless() {
+		tmpl["mappings"] = map[string]interface{}{cluster.docType: mapping}
+	}
+
+	// Version the template by its contents, so that any change to the Stats struct is installed.
+	asJSON, _ := json.Marshal(tmpl)
+	tmpl["version"] = int(crc32.ChecksumIEEE(asJSON) & 0x7fffffff)
+	return tmpl
+}
+
+// EnsureTemplate installs the index template for the index in elasticURL, unless the same version
+// is already installed. When the index already exists, new fields are added to its mapping;
+// changing the type of existing fields requires resetting and reindexing.
+func EnsureTemplate(elasticURL string) error {
+	cluster, err := DetectCluster(elasticURL)
+	if err != nil {
+		return err
+	}
+	expected := template(cluster)
+	logger := log.WithFields(log.Fields{
+		"template": TemplateName,
+		"version":  expected["version"],
+	})
+
+	templateURL := cluster.url("_template/" + TemplateName)
+	installed := map[string]struct {
+		Version int `json:"version"`
+	}{}
+	status, err := cluster.requestJSON("GET", templateURL, nil, &installed)
+	if err != nil && status != http.StatusNotFound {
+		return fmt.Errorf("unable to get index template: %s", err)
+	}
+	if current, found := installed[TemplateName]; found && current.Version == expected["version"] {
+		logger.Debug("index template is up to date")
+		return nil
+	}
+
+	logger.Info("installing index template")
+	if _, err := cluster.requestJSON("PUT", templateURL, expected, nil); err != nil {
+		return fmt.Errorf("unable to install index template: %s", err)
+	}
+
+	// The template only applies to new indices, so also update the mapping of an existing one.
+	status, err = cluster.requestJSON("HEAD", cluster.indexURL(""), nil, nil)
+	if status == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to check whether index exists: %s", err)
+	}
+	mappingURL := cluster.indexURL("_mapping")
+	mapping := expected["mappings"]
+	if !cluster.Typeless() {
+		mappingURL = cluster.indexURL("_mapping/" + cluster.docType)
+		mapping = mapping.(map[string]interface{})[cluster.docType]
+	}
+	if _, err := cluster.requestJSON("PUT", mappingURL, mapping, nil); err != nil {
+		return fmt.Errorf("unable to update mapping of index %s, reset and reindex to fix: %s", cluster.index, err)
+	}
+	logger.WithField("index", cluster.index).Info("updated mapping of existing index")
+	return nil
+}
+
+// CheckMapping compares the live mapping of the index in elasticURL with the expected mapping.
+func CheckMapping(elasticURL string) ([]MappingDifference, error) {
+	cluster, err := DetectCluster(elasticURL)
+	if err != nil {
+		return nil, err
+	}
+
+	type properties struct {
+		Properties map[string]interface{} `json:"properties"`
+	}
+	response := map[string]struct {
+		Mappings json.RawMessage `json:"mappings"`
+	}{}
+	if _, err := cluster.requestJSON("GET", cluster.indexURL("_mapping"), nil, &response); err != nil {
+		return nil, fmt.Errorf("unable to get mapping: %s", err)
+	}
+
+	// The response is keyed by the real index name, which can differ when using an alias.
+	for _, indexMapping := range response {
+		if cluster.Typeless() {
+			live := properties{}
+			if err := json.Unmarshal(indexMapping.Mappings, &live); err != nil {
+				return nil, fmt.Errorf("unable to decode mapping: %s", err)
+			}
+			return compareMappings(Mapping(), live.Properties, mapFields()), nil
+		}
+
+		perType := map[string]properties{}
+		if err := json.Unmarshal(indexMapping.Mappings, &perType); err != nil {
+			return nil, fmt.Errorf("unable to decode mapping: %s", err)
+		}
+		live, found := perType[cluster.docType]
+		if !found {
+			return nil, fmt.Errorf("index %s has no mapping for type %s", cluster.index, cluster.docType)
+		}
+		return compareMappings(Mapping(), live.Properties, mapFields()), nil
+	}
+	return nil, fmt.Errorf("index %s not found in mapping response", cluster.index)
+}
+
+// compareMappings compares two sets of mapping properties. Fields below the paths in mapFields
+// are expected to have the type of the map values.
+func compareMappings(expected, actual map[string]interface{}, mapFields map[string]string) []MappingDifference {
+	expectedTypes := flattenMapping("", expected)
+	actualTypes := flattenMapping("", actual)
+
+	differences := []MappingDifference{}
+	for field, expectedType := range expectedTypes {
+		if actualType := actualTypes[field]; actualType != expectedType {
+			differences = append(differences, MappingDifference{field, expectedType, actualType})
+		}
+	}
+	for field, actualType := range actualTypes {
+		if _, found := expectedTypes[field]; found {
+			continue
+		}
+		if dot := strings.LastIndex(field, "."); dot > 0 {
+			if valueType, isMapKey := mapFields[field[:dot]]; isMapKey {
+				if actualType != valueType {
+					differences = append(differences, MappingDifference{field, valueType, actualType})
+				}
+				continue
+			}
+		}
+		differences = append(differences, MappingDifference{field, "", actualType})
+	}
+
+	sort.Slice(differences, func(i, j int) bool { return differences[i].Field < differences[j].Field })
+	return differences
+}
+
+// flattenMapping maps dotted field paths to their type.
+func flattenMapping(prefix string, properties map[string]interface{}) map[string]string {
+	types := map[string]string{}
+	for name, value := range properties {
+		field, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		path := prefix + name
+		fieldType, _ := field["type"].(string)
+		if subProperties, hasProperties := field["properties"].(map[string]interface{}); hasProperties {
+			if fieldType == "" {
+				fieldType = "object"
+			}
+			for subPath, subType := range flattenMapping(path+".", subProperties) {
+				types[subPath] = subType
+			}
+		}
+		types[path] = fieldType
+	}
+	return types
+}
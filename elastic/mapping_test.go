@@ -0,0 +1,134 @@
+package elastic
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	"gopkg.in/jarcoal/httpmock.v1"
+)
+
+type MappingTestSuite struct{}
+
+var _ = check.Suite(&MappingTestSuite{})
+
+func (s *MappingTestSuite) SetUpTest(c *check.C) {
+	httpmock.ActivateNonDefault(client)
+	mockCluster("http://elastic.test/", "6.1.2", "")
+}
+
+func (s *MappingTestSuite) TearDownTest(c *check.C) {
+	httpmock.DeactivateAndReset()
+}
+
+func (s *MappingTestSuite) TestMapping(t *check.C) {
+	types := flattenMapping("", Mapping())
+
+	assert.Equal(t, "date", types["timestamp"])
+	assert.Equal(t, "long", types["files.total_bytes_storage_used"])
+	assert.Equal(t, "object", types["files.total_bytes_storage_used_per_backend"])
+	assert.Equal(t, "long", types["blender_id.privacy_policy_agreed.latest"])
+	assert.Equal(t, "keyword", types["collected_sections"])
+	assert.Equal(t, "boolean", types["partial"])
+	assert.Equal(t, "long", types["projects.top_storage.total_bytes"])
+
+	assert.Equal(t, "long", mapFields()["files.total_bytes_storage_used_per_backend"])
+	assert.Equal(t, "long", mapFields()["projects.top_storage.total_bytes_per_backend"])
+}
+
+func (s *MappingTestSuite) TestCompareMappings(t *check.C) {
+	live := map[string]interface{}{}
+	liveJSON := `{
+		"timestamp": {"type": "date"},
+		"stats_schema_version": {"type": "long"},
+		"files": {"properties": {
+			"total_bytes_storage_used": {"type": "integer"},
+			"total_bytes_storage_used_per_backend": {"properties": {
+				"gcs": {"type": "long"},
+				"local": {"type": "float"}
+			}}
+		}},
+		"extra": {"type": "text"}
+	}`
+	assert.Nil(t, json.Unmarshal([]byte(liveJSON), &live))
+
+	expected := map[string]interface{}{}
+	expectedJSON := `{
+		"timestamp": {"type": "date"},
+		"stats_schema_version": {"type": "long"},
+		"files": {"properties": {
+			"total_bytes_storage_used": {"type": "long"},
+			"total_bytes_storage_used_per_backend": {"type": "object"},
+			"file_count_total": {"type": "long"}
+		}}
+	}`
+	assert.Nil(t, json.Unmarshal([]byte(expectedJSON), &expected))
+
+	differences := compareMappings(expected, live,
+		map[string]string{"files.total_bytes_storage_used_per_backend": "long"})
+	assert.Equal(t, []MappingDifference{
+		{"extra", "", "text"},
+		{"files.file_count_total", "long", ""},
+		{"files.total_bytes_storage_used", "long", "integer"},
+		{"files.total_bytes_storage_used_per_backend.local", "long", "float"},
+	}, differences)
+}
+
+func (s *MappingTestSuite) TestEnsureTemplate(t *check.C) {
+	httpmock.RegisterResponder("GET", "http://elastic.test/_template/cloudstats",
+		httpmock.NewStringResponder(404, `{}`))
+	httpmock.RegisterResponder("HEAD", "http://elastic.test/cloudstats/",
+		httpmock.NewStringResponder(200, ``))
+
+	var installed map[string]interface{}
+	httpmock.RegisterResponder("PUT", "http://elastic.test/_template/cloudstats",
+		func(req *http.Request) (*http.Response, error) {
+			assert.Nil(t, json.NewDecoder(req.Body).Decode(&installed))
+			return httpmock.NewStringResponse(200, `{"acknowledged": true}`), nil
+		})
+	mappingUpdated := false
+	httpmock.RegisterResponder("PUT", "http://elastic.test/cloudstats/_mapping/stats",
+		func(req *http.Request) (*http.Response, error) {
+			mappingUpdated = true
+			return httpmock.NewStringResponse(200, `{"acknowledged": true}`), nil
+		})
+
+	assert.Nil(t, EnsureTemplate("http://elastic.test/cloudstats/stats/"))
+	assert.Equal(t, []interface{}{"cloudstats"}, installed["index_patterns"])
+	assert.NotNil(t, installed["version"])
+	assert.True(t, mappingUpdated)
+}
+
+func (s *MappingTestSuite) TestTemplateUpToDate(t *check.C) {
+	cluster, err := DetectCluster("http://elastic.test/cloudstats/stats/")
+	assert.Nil(t, err)
+	version := template(cluster)["version"]
+	responder, _ := httpmock.NewJsonResponder(200, map[string]interface{}{
+		"cloudstats": map[string]interface{}{"version": version},
+	})
+	httpmock.RegisterResponder("GET", "http://elastic.test/_template/cloudstats", responder)
+
+	// Any other request would fail, as there is no responder for it.
+	assert.Nil(t, EnsureTemplate("http://elastic.test/cloudstats/stats/"))
+}
+
+func (s *MappingTestSuite) TestTypelessMapping(t *check.C) {
+	mockCluster("http://elastic.test/", "7.10.2", "")
+	cluster, err := DetectCluster("http://elastic.test/cloudstats/")
+	assert.Nil(t, err)
+
+	mappings := template(cluster)["mappings"].(map[string]interface{})
+	assert.NotNil(t, mappings["properties"])
+
+	responder, _ := httpmock.NewJsonResponder(200, map[string]interface{}{
+		"cloudstats-v1": map[string]interface{}{
+			"mappings": map[string]interface{}{"properties": Mapping()},
+		},
+	})
+	httpmock.RegisterResponder("GET", "http://elastic.test/cloudstats/_mapping", responder)
+
+	differences, err := CheckMapping("http://elastic.test/cloudstats/")
+	assert.Nil(t, err)
+	assert.Empty(t, differences)
+}
@@ -0,0 +1,134 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ProjectsSuffix is appended to the name of the statistics index to get the name of the index
+// with the storage statistics per project.
+const ProjectsSuffix = "_projects"
+
+// ProjectsURL returns the URL of the per-project index next to the statistics index in
+// elasticURL, for example "http://localhost:9200/cloudstats_projects/" for
+// "http://localhost:9200/cloudstats/".
+func ProjectsURL(elasticURL string) (string, error) {
+	parsed, err := url.Parse(elasticURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL: %s", err)
+	}
+	parts := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	if parts[0] == "" {
+		return "", fmt.Errorf("expected URL in the form http://host:port/index/, not %s", elasticURL)
+	}
+	// The index is the first path segment; a type name may contain the index name as well.
+	index := strings.Index(parsed.Path, parts[0]) + len(parts[0])
+	parsed.Path = parsed.Path[:index] + ProjectsSuffix + parsed.Path[index:]
+	return parsed.String(), nil
+}
+
+// PushProjects stores the per-project storage statistics in the per-project index next to the
+// statistics index in elasticURL, using the bulk API. Documents with the same ID are replaced.
+func PushProjects(ctx context.Context, elasticURL string, projects []ProjectStorage) error {
+	projectsURL, err := ProjectsURL(elasticURL)
+	if err != nil {
+		return err
+	}
+	cluster, err := DetectClusterContext(ctx, projectsURL)
+	if err != nil {
+		return err
+	}
+	bulkURL := cluster.typeURL("_bulk")
+	batchSize := DefaultBulkOptions().BatchSize
+
+	failed := 0
+	for start := 0; start < len(projects); start += batchSize {
+		end := start + batchSize
+		if end > len(projects) {
+			end = len(projects)
+		}
+		batchFailed, err := pushProjectBatch(ctx, bulkURL, cluster.Compression, projects[start:end])
+		if err != nil {
+			return err
+		}
+		failed += batchFailed
+	}
+
+	log.WithFields(log.Fields{
+		"url":      projectsURL,
+		"projects": len(projects),
+		"failed":   failed,
+	}).Info("pushed project storage statistics to ElasticSearch")
+	if failed > 0 {
+		return fmt.Errorf("%d of %d project documents could not be indexed", failed, len(projects))
+	}
+	return nil
+}
+
+// pushProjectBatch sends one bulk request, and returns the number of documents that failed.
+func pushProjectBatch(ctx context.Context, bulkURL *url.URL, compress bool, projects []ProjectStorage) (int, error) {
+	payload := bytes.Buffer{}
+	encoder := json.NewEncoder(&payload)
+	for _, project := range projects {
+		action := map[string]map[string]string{"index": {}}
+		if project.ID != "" {
+			action["index"]["_id"] = project.ID
+		}
+		if err := encoder.Encode(action); err != nil {
+			return 0, err
+		}
+		if err := encoder.Encode(project); err != nil {
+			return 0, err
+		}
+	}
+
+	req, err := newRequest("POST", bulkURL.String(), payload.Bytes(), compress)
+	if err != nil {
+		return 0, fmt.Errorf("unable to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err := httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, fmt.Errorf("error performing HTTP request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("error reading HTTP response body: %s", err)
+	}
+	if resp.StatusCode >= 300 {
+		return 0, fmt.Errorf("error %d from %s: %s", resp.StatusCode, bulkURL, body)
+	}
+
+	var response bulkResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return 0, fmt.Errorf("unable to decode JSON: %s", err)
+	}
+	failed := 0
+	for _, resultPerAction := range response.Items {
+		result := resultPerAction["index"]
+		if result.Status < 300 {
+			continue
+		}
+		failed++
+		reason := ""
+		if result.Error != nil {
+			reason = result.Error.Type + ": " + result.Error.Reason
+		}
+		log.WithFields(log.Fields{
+			"ID":     result.ID,
+			"status": result.Status,
+			"reason": reason,
+		}).Error("unable to index project document in ElasticSearch")
+	}
+	return failed, nil
+}
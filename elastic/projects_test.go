@@ -0,0 +1,79 @@
+package elastic
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	"gopkg.in/jarcoal/httpmock.v1"
+)
+
+type ProjectsTestSuite struct{}
+
+var _ = check.Suite(&ProjectsTestSuite{})
+
+func (s *ProjectsTestSuite) SetUpTest(c *check.C) {
+	httpmock.ActivateNonDefault(client)
+	mockCluster("http://elastic.test/", "7.10.2", "")
+}
+
+func (s *ProjectsTestSuite) TearDownTest(c *check.C) {
+	httpmock.DeactivateAndReset()
+}
+
+func (s *ProjectsTestSuite) TestProjectsURL(t *check.C) {
+	for elasticURL, expected := range map[string]string{
+		"http://elastic.test/cloudstats/":            "http://elastic.test/cloudstats_projects/",
+		"http://elastic.test/cloudstats/stats/":      "http://elastic.test/cloudstats_projects/stats/",
+		"http://elastic.test/cloudstats":             "http://elastic.test/cloudstats_projects",
+		"http://elastic.test/cloudstats/cloudstats/": "http://elastic.test/cloudstats_projects/cloudstats/",
+	} {
+		projectsURL, err := ProjectsURL(elasticURL)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, projectsURL)
+	}
+
+	_, err := ProjectsURL("http://elastic.test/")
+	assert.NotNil(t, err)
+}
+
+func (s *ProjectsTestSuite) TestPushProjects(t *check.C) {
+	timestamp := time.Date(2018, 7, 4, 0, 0, 0, 0, time.UTC)
+	projects := []ProjectStorage{
+		{ID: "5b3b5c8a00000000000000aa-20180704T000000Z", Timestamp: timestamp, Project: "5b3b5c8a00000000000000aa", TotalBytes: 1024},
+		{ID: "5b3b5c8a00000000000000bb-20180704T000000Z", Timestamp: timestamp, Project: "5b3b5c8a00000000000000bb", TotalBytes: 12},
+	}
+
+	var lines []string
+	httpmock.RegisterResponder("POST", "http://elastic.test/cloudstats_projects/_bulk",
+		func(req *http.Request) (*http.Response, error) {
+			body, _ := ioutil.ReadAll(req.Body)
+			scanner := bufio.NewScanner(bytes.NewReader(body))
+			for scanner.Scan() {
+				lines = append(lines, scanner.Text())
+			}
+			return httpmock.NewStringResponse(200, `{"errors": true, "items": [
+				{"index": {"_id": "5b3b5c8a00000000000000aa-20180704T000000Z", "status": 201}},
+				{"index": {"_id": "5b3b5c8a00000000000000bb-20180704T000000Z", "status": 400,
+				           "error": {"type": "mapper_parsing_exception", "reason": "broken"}}}
+			]}`), nil
+		})
+
+	err := PushProjects(context.Background(), "http://elastic.test/cloudstats/", projects)
+	assert.EqualError(t, err, "1 of 2 project documents could not be indexed")
+
+	if assert.Len(t, lines, 4) {
+		assert.Equal(t, `{"index":{"_id":"5b3b5c8a00000000000000aa-20180704T000000Z"}}`, lines[0])
+		var doc map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(lines[1]), &doc))
+		assert.Equal(t, "5b3b5c8a00000000000000aa", doc["project"])
+		assert.Equal(t, float64(1024), doc["total_bytes"])
+		assert.NotContains(t, doc, "_id")
+	}
+}
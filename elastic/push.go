@@ -1,7 +1,7 @@
 package elastic
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -13,13 +13,12 @@ import (
 )
 
 // sendJSON sends a JSON document to some URL via HTTP.
-// :param tweakrequest: can be used to tweak the request before sending it, for
-//    example by adding authentication headers. May be nil.
+// :param compress: whether the document may be gzip-compressed.
 // :param responsehandler: is called when a non-error response has been read.
 //    May be nil.
-func sendJSON(logprefix, method string, url *url.URL,
+func sendJSON(ctx context.Context, logprefix, method string, url *url.URL,
 	payload interface{},
-	tweakrequest func(req *http.Request),
+	compress bool,
 	responsehandler func(resp *http.Response, body []byte) error,
 ) error {
 	logger := log.WithFields(log.Fields{
@@ -32,19 +31,13 @@ func sendJSON(logprefix, method string, url *url.URL,
 		return err
 	}
 
-	// TODO Sybren: enable GZip compression.
-	req, err := http.NewRequest(method, url.String(), bytes.NewBuffer(payloadBytes))
+	req, err := newRequest(method, url.String(), payloadBytes, compress)
 	if err != nil {
 		logger.WithError(err).Errorf("%s: Unable to create request", logprefix)
 		return err
 	}
-	req.Header.Add("Content-Type", "application/json")
-	if tweakrequest != nil {
-		tweakrequest(req)
-	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := httpClient().Do(req.WithContext(ctx))
 	if err != nil {
 		logger.WithError(err).Errorf("%s: error performing HTTP request", logprefix)
 		return err
@@ -75,12 +68,18 @@ func sendJSON(logprefix, method string, url *url.URL,
 }
 
 // Push sends the give stats object to ElasticSearch for storage, and returns the document ID.
+// When the stats have an ID, the document with that ID is replaced if it exists.
 func Push(elasticURL string, stats interface{}) (string, error) {
-	// Figure out the URL to POST to.
-	postURL, err := url.Parse(elasticURL)
+	return PushContext(context.Background(), elasticURL, stats)
+}
+
+// PushContext is like Push, but aborts the request when the context is done.
+func PushContext(ctx context.Context, elasticURL string, stats interface{}) (string, error) {
+	cluster, err := DetectClusterContext(ctx, elasticURL)
 	if err != nil {
-		return "", fmt.Errorf("invalid URL: %s", err)
+		return "", err
 	}
+	postURL := cluster.documentURL("")
 
 	var ID string
 	handleResponse := func(resp *http.Response, body []byte) error {
@@ -115,13 +114,7 @@ func Push(elasticURL string, stats interface{}) (string, error) {
 		log.WithField("ID", strID).Debug("found a pre-existing ID field, going to use that")
 
 		method = "PUT"
-		url, err = url.Parse(strID)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"_id":      strID,
-				"base_url": postURL.String(),
-			}).Fatal("unable to construct URL for this _id")
-		}
+		url = cluster.documentURL(strID)
 	}
 
 	switch typed := stats.(type) {
@@ -142,11 +135,11 @@ func Push(elasticURL string, stats interface{}) (string, error) {
 		useID(typed.ID)
 		typed.ID = ""
 	default:
-		log.WithField("payload", stats).Panic("unknown payload type")
+		return "", fmt.Errorf("unknown payload type %T", stats)
 	}
 
 	log.WithField("url", url).Debug("Pushing to ElasticSearch")
-	err = sendJSON("stats push: ", method, url, stats, nil, handleResponse)
+	err = sendJSON(ctx, "stats push: ", method, url, stats, cluster.Compression, handleResponse)
 	if err != nil {
 		return "", fmt.Errorf("unable to send JSON: %s", err)
 	}
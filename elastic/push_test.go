@@ -31,7 +31,9 @@ func (s *PushTestSuite) SetUpTest(c *check.C) {
 
 func (s *PushTestSuite) TearDownTest(c *check.C) {
 	log.Info("tearing down test, deleting index.")
-	ResetIndex(s.url)
+	if err := ResetIndex(s.url); err != nil {
+		c.Error(err)
+	}
 }
 
 func (s *PushTestSuite) get(c *check.C, ID string) *ElasticResponse {
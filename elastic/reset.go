@@ -1,47 +1,33 @@
 package elastic
 
 import (
+	"fmt"
 	"net/http"
-	"net/url"
 
 	log "github.com/sirupsen/logrus"
 )
 
 // ResetIndex deletes all Cloud stats from ElasticSearch.
-func ResetIndex(elasticURL string) {
-	logger := log.WithField("url", elasticURL)
-
-	url, err := url.Parse(elasticURL)
+func ResetIndex(elasticURL string) error {
+	cluster, err := DetectCluster(elasticURL)
 	if err != nil {
-		logger.WithError(err).Fatal("unable to parse Elastic URL")
-		return
+		return fmt.Errorf("unable to connect to Elastic: %s", err)
 	}
+	url := cluster.indexURL("")
+	logger := log.WithField("url", url.String())
 
-	url, err = url.Parse("..")
-	if err != nil {
-		logger.WithError(err).Fatal("unable to construct URL to index")
-		return
-	}
-	logger = log.WithField("url", url.String())
-
-	client := &http.Client{}
-
-	req, err := http.NewRequest("DELETE", url.String(), nil)
+	req, err := newRequest("DELETE", url.String(), nil, false)
 	if err != nil {
-		logger.WithError(err).Fatal("unable to create DELETE request")
-		return
+		return fmt.Errorf("unable to create DELETE request: %s", err)
 	}
-	resp, err := client.Do(req)
+	resp, err := httpClient().Do(req)
 	if err != nil {
-		logger.WithError(err).Fatal("unable to perform DELETE request")
-		return
+		return fmt.Errorf("unable to perform DELETE request: %s", err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
-		logger.WithFields(log.Fields{
-			"code": resp.StatusCode,
-			"text": resp.Status,
-		}).Fatal("error from DELETE request")
-		return
+		return fmt.Errorf("error from DELETE %s: %s", url, resp.Status)
 	}
 	logger.WithField("code", resp.StatusCode).Info("ElasticSearch index deleted OK")
+	return nil
 }
@@ -1,9 +1,10 @@
 package elastic
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -22,8 +23,8 @@ type fetchAllQuery struct {
 type scrollResponse struct {
 	ScrollID string `json:"_scroll_id"`
 	Hits     struct {
-		Total int   `json:"total"`
-		Hits  []Hit `json:"hits"`
+		Total hitsTotal `json:"total"`
+		Hits  []Hit     `json:"hits"`
 	} `json:"hits"`
 }
 
@@ -38,7 +39,7 @@ type Hit struct {
 
 var errHTTPError = errors.New("HTTP error communicating with Elastic")
 
-func fetch(client *http.Client, searchURL string, size int, lastScrollID *string) (*scrollResponse, error) {
+func fetch(ctx context.Context, client *http.Client, searchURL string, size int, lastScrollID *string) (*scrollResponse, error) {
 	logger := log.WithField("url", searchURL)
 	payload := fetchAllQuery{}
 	if *lastScrollID == "" {
@@ -58,14 +59,13 @@ func fetch(client *http.Client, searchURL string, size int, lastScrollID *string
 	}
 
 	logger.WithField("payload", string(payloadBytes)).Debug("Elastic request payload")
-	req, err := http.NewRequest("GET", searchURL, bytes.NewBuffer(payloadBytes))
+	req, err := newRequest("GET", searchURL, payloadBytes, false)
 	if err != nil {
 		logger.WithError(err).Error("unable to create request")
 		return nil, errHTTPError
 	}
-	req.Header.Add("Content-Type", "application/json")
 
-	resp, err := client.Do(req)
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
 		logger.WithError(err).Error("unable to GET from Elastic")
 		return nil, errHTTPError
@@ -108,7 +108,7 @@ func deleteScroll(client *http.Client, elasticURL *url.URL, scrollID string) {
 	}
 
 	logger = log.WithField("url", url.String())
-	req, err := http.NewRequest("GET", url.String(), nil)
+	req, err := newRequest("GET", url.String(), nil, false)
 	if err != nil {
 		logger.WithError(err).Warning("unable to create request for scroll deletion")
 		return
@@ -125,28 +125,36 @@ func deleteScroll(client *http.Client, elasticURL *url.URL, scrollID string) {
 	logger.Debug("ElasticSearch scroll deleted OK")
 }
 
-// ReverseImport pulls data from ElasticSearch and sends it to the returned channel.
-func ReverseImport(elasticURL string) chan Hit {
-	url, err := url.Parse(elasticURL)
+// ReverseImport pulls data from ElasticSearch and sends it to the returned channel. After the
+// hits channel is closed, the error channel receives the error that stopped the import, if any,
+// and is then closed as well.
+func ReverseImport(elasticURL string) (<-chan Hit, <-chan error) {
+	return ReverseImportContext(context.Background(), elasticURL)
+}
+
+// ReverseImportContext is like ReverseImport, but stops with the context's error when the context
+// is done.
+func ReverseImportContext(ctx context.Context, elasticURL string) (<-chan Hit, <-chan error) {
+	ch := make(chan Hit)
+	errs := make(chan error, 1)
+
+	cluster, err := DetectClusterContext(ctx, elasticURL)
 	if err != nil {
-		log.WithError(err).WithField("url", elasticURL).Fatal("error parsing URL")
+		close(ch)
+		errs <- fmt.Errorf("unable to connect to Elastic: %s", err)
+		close(errs)
+		return ch, errs
 	}
 	log.WithField("elastic", elasticURL).Warning("reverse-importing from ElasticSearch")
 
-	fetchURL, err := url.Parse("_search?scroll=1m")
-	if err != nil {
-		log.WithError(err).WithField("url", elasticURL).Fatal("unable to construct fetch URL")
-	}
-	scrollURL, err := url.Parse("/_search/scroll")
-	if err != nil {
-		log.WithError(err).WithField("url", elasticURL).Fatal("unable to construct scroll URL")
-	}
+	fetchURL := cluster.typeURL("_search?scroll=1m")
+	scrollURL := cluster.url("_search/scroll")
 	requestURL := fetchURL.String()
 
-	client := http.Client{}
-
-	ch := make(chan Hit)
+	// The same client is used for the whole scroll, also when it is reconfigured meanwhile.
+	client := httpClient()
 	go func() {
+		defer close(errs)
 		defer close(ch)
 
 		resultsPerPage := 500
@@ -156,22 +164,32 @@ func ReverseImport(elasticURL string) chan Hit {
 		defer func() {
 			// Delete the scroll with a DELETE HTTP request.
 			if lastScrollID != "" {
-				deleteScroll(&client, url, lastScrollID)
+				deleteScroll(client, cluster.root, lastScrollID)
 			}
 		}()
 
 		for {
-			resp, err := fetch(&client, requestURL, resultsPerPage, &lastScrollID)
+			resp, err := fetch(ctx, client, requestURL, resultsPerPage, &lastScrollID)
+			if ctx.Err() != nil {
+				errs <- ctx.Err()
+				return
+			}
 			if err != nil {
-				log.Fatal("aborting due to communication error with Elastic")
+				errs <- fmt.Errorf("aborting after %d documents: %s", seenResults, err)
+				return
 			}
 
 			for idx := range resp.Hits.Hits {
-				ch <- resp.Hits.Hits[idx]
+				select {
+				case ch <- resp.Hits.Hits[idx]:
+				case <-ctx.Done():
+					errs <- ctx.Err()
+					return
+				}
 			}
 
 			seenResults += len(resp.Hits.Hits)
-			if seenResults >= resp.Hits.Total {
+			if seenResults >= int(resp.Hits.Total) {
 				log.WithFields(log.Fields{
 					"seen":  seenResults,
 					"total": resp.Hits.Total,
@@ -185,5 +203,5 @@ func ReverseImport(elasticURL string) chan Hit {
 		}
 	}()
 
-	return ch
+	return ch, errs
 }
@@ -0,0 +1,81 @@
+package elastic
+
+import (
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	"gopkg.in/jarcoal/httpmock.v1"
+)
+
+type ReverseTestSuite struct{}
+
+var _ = check.Suite(&ReverseTestSuite{})
+
+func (s *ReverseTestSuite) SetUpTest(c *check.C) {
+	httpmock.ActivateNonDefault(client)
+	mockCluster("http://elastic.test/", "7.10.2", "")
+}
+
+func (s *ReverseTestSuite) TearDownTest(c *check.C) {
+	httpmock.DeactivateAndReset()
+}
+
+func (s *ReverseTestSuite) TestReverseImport(t *check.C) {
+	httpmock.RegisterResponder("GET", "http://elastic.test/cloudstats/_search?scroll=1m",
+		httpmock.NewStringResponder(200, `{"_scroll_id": "scroll-1", "hits": {"total": {"value": 3},
+			"hits": [{"_id": "a", "_source": {}}, {"_id": "b", "_source": {}}]}}`))
+	httpmock.RegisterResponder("GET", "http://elastic.test/_search/scroll",
+		httpmock.NewStringResponder(200, `{"_scroll_id": "scroll-1", "hits": {"total": {"value": 3},
+			"hits": [{"_id": "c", "_source": {}}]}}`))
+	httpmock.RegisterResponder("GET", "http://elastic.test/_search/scroll/scroll-1",
+		httpmock.NewStringResponder(200, `{}`))
+
+	hits, errs := ReverseImport("http://elastic.test/cloudstats/")
+	ids := []string{}
+	for hit := range hits {
+		ids = append(ids, hit.ID)
+	}
+	assert.Nil(t, <-errs)
+	assert.Equal(t, []string{"a", "b", "c"}, ids)
+}
+
+func (s *ReverseTestSuite) TestReverseImportError(t *check.C) {
+	httpmock.RegisterResponder("GET", "http://elastic.test/cloudstats/_search?scroll=1m",
+		httpmock.NewStringResponder(200, `{"_scroll_id": "scroll-1", "hits": {"total": {"value": 3},
+			"hits": [{"_id": "a", "_source": {}}]}}`))
+	httpmock.RegisterResponder("GET", "http://elastic.test/_search/scroll",
+		httpmock.NewStringResponder(500, `{"error": "oops"}`))
+	httpmock.RegisterResponder("GET", "http://elastic.test/_search/scroll/scroll-1",
+		httpmock.NewStringResponder(200, `{}`))
+
+	hits, errs := ReverseImport("http://elastic.test/cloudstats/")
+	seen := 0
+	for range hits {
+		seen++
+	}
+	assert.Equal(t, 1, seen)
+	assert.NotNil(t, <-errs)
+	_, open := <-errs
+	assert.False(t, open)
+}
+
+func (s *ReverseTestSuite) TestReverseImportUnreachable(t *check.C) {
+	hits, errs := ReverseImport("http://unreachable.test/cloudstats/")
+	_, open := <-hits
+	assert.False(t, open)
+	assert.NotNil(t, <-errs)
+}
+
+func (s *ReverseTestSuite) TestResetIndexError(t *check.C) {
+	httpmock.RegisterResponder("DELETE", "http://elastic.test/cloudstats/",
+		httpmock.NewStringResponder(403, `{"error": "forbidden"}`))
+	assert.NotNil(t, ResetIndex("http://elastic.test/cloudstats/"))
+
+	httpmock.RegisterResponder("DELETE", "http://elastic.test/cloudstats/",
+		httpmock.NewStringResponder(404, `{}`))
+	assert.Nil(t, ResetIndex("http://elastic.test/cloudstats/"))
+}
+
+func (s *ReverseTestSuite) TestPushUnknownPayload(t *check.C) {
+	_, err := Push("http://elastic.test/cloudstats/", 47)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	"github.com/armadillica/pillar-statscollector/mongo"
+	"github.com/armadillica/pillar-statscollector/pillar"
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Policies for gaps that are too old to fill with the current values.
+const (
+	gapPolicyInterpolate = "interpolate"
+	gapPolicySkip        = "skip"
+)
+
+// gapSource is an external source whose statistics are omitted from the statistics document when
+// it cannot be reached.
+type gapSource struct {
+	// name is the name of the collector, like "store".
+	name string
+	// field is the path of the field that is missing from the document.
+	field string
+	// fetch returns the fields to set with the current values, like the collector would.
+	fetch func(ctx context.Context) (bson.M, error)
+	// interpolate returns the fields to set with values estimated from the surrounding documents.
+	interpolate func(before, after *elastic.Stats, at time.Time) bson.M
+}
+
+// gapSources returns the configured external sources.
+func gapSources() []gapSource {
+	options := collectOptions(nil)
+	sources := []gapSource{}
+
+	if options.StoreURL != "" {
+		sources = append(sources, gapSource{
+			name:  "store",
+			field: "users.subscriber_count",
+			fetch: func(ctx context.Context) (bson.M, error) {
+				count, attempts, err := pillar.FetchSubscriberCount(ctx, options)
+				if err != nil {
+					return nil, err
+				}
+				return bson.M{"users.subscriber_count": count, "fetch_attempts.store": attempts}, nil
+			},
+			interpolate: func(before, after *elastic.Stats, at time.Time) bson.M {
+				count := interpolate(before.Users.SubscriberCount, after.Users.SubscriberCount,
+					before.Timestamp, after.Timestamp, at)
+				return bson.M{"users.subscriber_count": count}
+			},
+		})
+	}
+
+	if options.BlenderIDURL != "" {
+		sources = append(sources, gapSource{
+			name:  "blenderid",
+			field: "blender_id",
+			fetch: func(ctx context.Context) (bson.M, error) {
+				blenderID, attempts, err := pillar.FetchBlenderID(ctx, options)
+				if err != nil {
+					return nil, err
+				}
+				return bson.M{"blender_id": blenderID, "fetch_attempts.blenderid": attempts}, nil
+			},
+			interpolate: func(before, after *elastic.Stats, at time.Time) bson.M {
+				return bson.M{"blender_id": interpolateBlenderID(before, after, at)}
+			},
+		})
+	}
+	return sources
+}
+
+// interpolate returns the linear interpolation at the given time between valueA at timeA and
+// valueB at timeB.
+func interpolate(valueA, valueB int, timeA, timeB, at time.Time) int {
+	span := timeB.Sub(timeA)
+	if span <= 0 {
+		return valueA
+	}
+	fraction := float64(at.Sub(timeA)) / float64(span)
+	return valueA + int(math.Round(fraction*float64(valueB-valueA)))
+}
+
+// interpolateBlenderID interpolates every Blender ID count between two documents.
+func interpolateBlenderID(before, after *elastic.Stats, at time.Time) *elastic.BlenderID {
+	a, b := before.BlenderID, after.BlenderID
+	interp := func(valueA, valueB int) int {
+		return interpolate(valueA, valueB, before.Timestamp, after.Timestamp, at)
+	}
+	return &elastic.BlenderID{
+		ConfirmedEmailCount:   interp(a.ConfirmedEmailCount, b.ConfirmedEmailCount),
+		UnconfirmedEmailCount: interp(a.UnconfirmedEmailCount, b.UnconfirmedEmailCount),
+		TotalCount:            interp(a.TotalCount, b.TotalCount),
+		PrivacyPolicyAgreed: elastic.BlenderIDPrivacyPolicy{
+			Latest:   interp(a.PrivacyPolicyAgreed.Latest, b.PrivacyPolicyAgreed.Latest),
+			Obsolete: interp(a.PrivacyPolicyAgreed.Obsolete, b.PrivacyPolicyAgreed.Obsolete),
+			Never:    interp(a.PrivacyPolicyAgreed.Never, b.PrivacyPolicyAgreed.Never),
+		},
+	}
+}
+
+// fillGaps fills in the statistics of external sources that are missing from stored documents.
+// Recent gaps are filled with the current values; older gaps are handled according to the
+// configured policy. Updated documents are pushed to the other sinks again. With -nopush,
+// the gaps are only logged.
+func fillGaps(ctx context.Context, mgoStats *mgo.Session) error {
+	output, err := newSinks(mgoStats, "mongo", true)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	filled, skipped := 0, 0
+
+	var pushErr error
+	for _, source := range gapSources() {
+		logger := log.WithFields(log.Fields{"source": source.name, "field": source.field})
+		docs, err := mongo.Missing(mgoStats, source.field)
+		if err != nil {
+			pushErr = fmt.Errorf("unable to find gaps in %s: %s", source.field, err)
+			break
+		}
+		logger.WithField("gaps", len(docs)).Info("found documents with missing statistics")
+
+		// The current values are only fetched once, and only when there are recent gaps.
+		var current bson.M
+		for _, doc := range docs {
+			if ctx.Err() != nil {
+				pushErr = ctx.Err()
+				break
+			}
+			ID := doc["_id"]
+			stats, err := statsFromBSON(doc)
+			if err != nil {
+				logger.WithError(err).WithField("id", ID).Error("unable to convert document, skipping")
+				skipped++
+				continue
+			}
+			docLogger := logger.WithFields(log.Fields{"id": ID, "timestamp": stats.Timestamp})
+
+			var set bson.M
+			var collected, estimated []string
+			switch {
+			case now.Sub(stats.Timestamp) <= config.FillGaps.MaxAge:
+				if current == nil {
+					if current, err = source.fetch(ctx); err != nil {
+						pushErr = fmt.Errorf("unable to fetch current %s statistics: %s", source.name, err)
+						break
+					}
+				}
+				set = current
+				// Documents without collected sections have all of them.
+				if len(stats.Sections) > 0 {
+					collected = []string{source.name}
+				}
+			case config.FillGaps.Policy == gapPolicyInterpolate:
+				before, after, err := mongo.Nearest(mgoStats, source.field, stats.Timestamp)
+				if err != nil {
+					pushErr = fmt.Errorf("unable to find documents around %s: %s", stats.Timestamp, err)
+					break
+				}
+				if before == nil || after == nil {
+					docLogger.Info("no statistics on both sides of the gap, unable to interpolate")
+					skipped++
+					continue
+				}
+				set = source.interpolate(before, after, stats.Timestamp)
+				estimated = []string{source.name}
+			default:
+				skipped++
+				continue
+			}
+			if pushErr != nil {
+				break
+			}
+
+			if cliArgs.nopush {
+				docLogger.WithField("values", set).Warning("would fill gap")
+				filled++
+				continue
+			}
+			updated, err := mongo.Fill(mgoStats, ID, set, collected, estimated)
+			if err != nil {
+				pushErr = fmt.Errorf("unable to fill gap in document %v: %s", ID, err)
+				break
+			}
+			filled++
+			docLogger.WithField("estimated", len(estimated) > 0).Debug("filled gap")
+
+			// Documents with an ObjectID were never pushed with that ID, so pushing them again would
+			// create duplicates.
+			if _, isString := ID.(string); !isString {
+				docLogger.Warning("document has no string ID, not pushing it to the other sinks")
+				continue
+			}
+			updatedStats, err := statsFromBSON(updated)
+			if err != nil {
+				docLogger.WithError(err).Error("unable to convert updated document, not pushing it")
+				continue
+			}
+			if pushErr = output.Push(ctx, &updatedStats); pushErr != nil {
+				break
+			}
+		}
+		if pushErr != nil {
+			break
+		}
+	}
+
+	if closeErr := output.Close(); pushErr == nil {
+		pushErr = closeErr
+	}
+	if pushErr != nil {
+		return fmt.Errorf("unable to fill gaps: %s", pushErr)
+	}
+	log.WithFields(log.Fields{"filled": filled, "skipped": skipped}).Warning("done filling gaps")
+	return nil
+}
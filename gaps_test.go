@@ -0,0 +1,55 @@
+package main
+
+import (
+	"time"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+)
+
+type GapsTestSuite struct{}
+
+var _ = check.Suite(&GapsTestSuite{})
+
+func (s *GapsTestSuite) TestInterpolate(t *check.C) {
+	monday := time.Date(2018, 7, 2, 0, 0, 0, 0, time.UTC)
+	friday := monday.Add(4 * 24 * time.Hour)
+
+	assert.Equal(t, 100, interpolate(100, 200, monday, friday, monday))
+	assert.Equal(t, 125, interpolate(100, 200, monday, friday, monday.Add(24*time.Hour)))
+	assert.Equal(t, 150, interpolate(100, 200, monday, friday, monday.Add(48*time.Hour)))
+	assert.Equal(t, 200, interpolate(100, 200, monday, friday, friday))
+
+	// Decreasing values and rounding.
+	assert.Equal(t, 7, interpolate(10, 0, monday, friday, monday.Add(30*time.Hour)))
+
+	// Documents with the same timestamp shouldn't cause a division by zero.
+	assert.Equal(t, 100, interpolate(100, 200, monday, monday, monday))
+}
+
+func (s *GapsTestSuite) TestInterpolateBlenderID(t *check.C) {
+	before := &elastic.Stats{
+		Timestamp: time.Date(2018, 7, 2, 0, 0, 0, 0, time.UTC),
+		BlenderID: &elastic.BlenderID{
+			ConfirmedEmailCount: 1000,
+			TotalCount:          1100,
+			PrivacyPolicyAgreed: elastic.BlenderIDPrivacyPolicy{Latest: 10, Never: 1090},
+		},
+	}
+	after := &elastic.Stats{
+		Timestamp: time.Date(2018, 7, 4, 0, 0, 0, 0, time.UTC),
+		BlenderID: &elastic.BlenderID{
+			ConfirmedEmailCount: 1010,
+			TotalCount:          1120,
+			PrivacyPolicyAgreed: elastic.BlenderIDPrivacyPolicy{Latest: 30, Never: 1090},
+		},
+	}
+
+	estimated := interpolateBlenderID(before, after, time.Date(2018, 7, 3, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, 1005, estimated.ConfirmedEmailCount)
+	assert.Equal(t, 0, estimated.UnconfirmedEmailCount)
+	assert.Equal(t, 1110, estimated.TotalCount)
+	assert.Equal(t, 20, estimated.PrivacyPolicyAgreed.Latest)
+	assert.Equal(t, 1090, estimated.PrivacyPolicyAgreed.Never)
+}
@@ -0,0 +1,191 @@
+package influx
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// measurement collects the fields of a single section of the statistics document.
+type measurement struct {
+	fields map[string]string
+	// tagged maps tag name → tag value → field name → field value.
+	tagged map[string]map[string]map[string]string
+	// collected reports whether the field at a dotted JSON path belongs to a collected section.
+	collected func(path string) bool
+}
+
+// Lines converts the statistics to InfluxDB line protocol, with timestamps in seconds.
+// Every section of the statistics document (files, projects, ...) becomes a measurement of the
+// same name. Map fields become separate lines, tagged with the map key, for example backend=gcs.
+// Only the fields of the collected sections are written, so that skipped collectors don't show up
+// as zeroes.
+func Lines(stats elastic.Stats) []byte {
+	buffer := bytes.Buffer{}
+	timestamp := strconv.FormatInt(stats.Timestamp.Unix(), 10)
+
+	value := reflect.ValueOf(stats)
+	valueType := value.Type()
+	for idx := 0; idx < valueType.NumField(); idx++ {
+		name := jsonName(valueType.Field(idx))
+		section := value.Field(idx)
+		if name == "" || !isStruct(section) || !stats.Collected(name) {
+			continue
+		}
+		if section.Kind() == reflect.Ptr {
+			if section.IsNil() {
+				// Missing data (for example from Blender ID) is omitted, not written as zero.
+				continue
+			}
+			section = section.Elem()
+		}
+
+		m := measurement{
+			fields:    map[string]string{},
+			tagged:    map[string]map[string]map[string]string{},
+			collected: stats.Collected,
+		}
+		m.addStruct("", name, section)
+		m.write(&buffer, measurementEscaper.Replace(name), timestamp)
+	}
+
+	return buffer.Bytes()
+}
+
+// addStruct adds the fields of the struct, which is at the dotted JSON path in the document.
+func (m *measurement) addStruct(prefix, path string, value reflect.Value) {
+	valueType := value.Type()
+	for idx := 0; idx < valueType.NumField(); idx++ {
+		field := valueType.Field(idx)
+		name := jsonName(field)
+		if name == "" || !m.collected(path+"."+name) {
+			continue
+		}
+		fieldValue := value.Field(idx)
+		omitEmpty := strings.Contains(field.Tag.Get("json"), ",omitempty")
+
+		switch {
+		case fieldValue.Kind() == reflect.Map:
+			m.addMap(prefix+name, name, fieldValue)
+		case isStruct(fieldValue):
+			if fieldValue.Kind() == reflect.Ptr {
+				if fieldValue.IsNil() {
+					continue
+				}
+				fieldValue = fieldValue.Elem()
+			}
+			m.addStruct(prefix+name+"_", path+"."+name, fieldValue)
+		default:
+			formatted, ok := formatValue(fieldValue)
+			if !ok || omitEmpty && isZero(fieldValue) {
+				continue
+			}
+			m.fields[prefix+name] = formatted
+		}
+	}
+}
+
+// addMap adds the map as fields of tagged series. The tag name is looked up by the JSON name of
+// the map, as the field name can be prefixed with the name of a sub-struct.
+func (m *measurement) addMap(name, jsonName string, value reflect.Value) {
+	if value.Type().Key().Kind() != reflect.String {
+		return
+	}
+
+	tagName := elastic.KeyName(jsonName)
+	for _, key := range value.MapKeys() {
+		formatted, ok := formatValue(value.MapIndex(key))
+		if !ok || key.String() == "" {
+			continue
+		}
+		if m.tagged[tagName] == nil {
+			m.tagged[tagName] = map[string]map[string]string{}
+		}
+		if m.tagged[tagName][key.String()] == nil {
+			m.tagged[tagName][key.String()] = map[string]string{}
+		}
+		m.tagged[tagName][key.String()][name] = formatted
+	}
+}
+
+func (m *measurement) write(buffer *bytes.Buffer, name, timestamp string) {
+	writeLine(buffer, name, m.fields, timestamp)
+
+	for _, tagName := range sortedKeys(m.tagged) {
+		perValue := m.tagged[tagName]
+		for _, tagValue := range sortedKeys(perValue) {
+			series := name + "," + keyEscaper.Replace(tagName) + "=" + keyEscaper.Replace(tagValue)
+			writeLine(buffer, series, perValue[tagValue], timestamp)
+		}
+	}
+}
+
+func writeLine(buffer *bytes.Buffer, series string, fields map[string]string, timestamp string) {
+	if len(fields) == 0 {
+		return
+	}
+	buffer.WriteString(series)
+	for idx, name := range sortedKeys(fields) {
+		if idx == 0 {
+			buffer.WriteByte(' ')
+		} else {
+			buffer.WriteByte(',')
+		}
+		buffer.WriteString(keyEscaper.Replace(name))
+		buffer.WriteByte('=')
+		buffer.WriteString(fields[name])
+	}
+	buffer.WriteByte(' ')
+	buffer.WriteString(timestamp)
+	buffer.WriteByte('\n')
+}
+
+// formatValue returns the numeric value formatted as line protocol field value.
+func formatValue(value reflect.Value) (string, bool) {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(value.Int(), 10) + "i", true
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(value.Float(), 'g', -1, 64), true
+	}
+	return "", false
+}
+
+func isZero(value reflect.Value) bool {
+	return value.Interface() == reflect.Zero(value.Type()).Interface()
+}
+
+// isStruct returns true for structs and pointers to structs, except time.Time.
+func isStruct(value reflect.Value) bool {
+	valueType := value.Type()
+	if valueType.Kind() == reflect.Ptr {
+		valueType = valueType.Elem()
+	}
+	return valueType.Kind() == reflect.Struct && valueType.PkgPath() != "time"
+}
+
+func jsonName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
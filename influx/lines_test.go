@@ -0,0 +1,134 @@
+package influx
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	"gopkg.in/jarcoal/httpmock.v1"
+)
+
+type LinesTestSuite struct{}
+
+var _ = check.Suite(&LinesTestSuite{})
+
+func testStats() elastic.Stats {
+	stats := elastic.Stats{
+		Timestamp: time.Date(2018, 7, 4, 0, 0, 0, 0, time.UTC),
+	}
+	stats.Files.ExpiredLinkCount = 3
+	stats.Files.TotalBytesStorageUsedPerBackend = map[string]int64{"gcs": 1024, "local": 12}
+	stats.Files.FileCountPerBackend = map[string]int{"gcs": 2}
+	stats.Nodes.PublicCountPerNodeType = map[string]int{"group asset": 47}
+	stats.Projects.TotalCount = 5
+	return stats
+}
+
+func (s *LinesTestSuite) TestLines(t *check.C) {
+	output := string(Lines(testStats()))
+
+	assert.Contains(t, output, "files expired_link_count=3i,file_count_total=0i,no_link_count=0i,total_bytes_storage_used=0i 1530662400\n")
+	assert.Contains(t, output,
+		"files,backend=gcs file_count_per_backend=2i,total_bytes_storage_used_per_backend=1024i 1530662400\n"+
+			"files,backend=local total_bytes_storage_used_per_backend=12i 1530662400\n")
+	assert.Contains(t, output, "nodes,node_type=group\\ asset public_node_count_per_type=47i 1530662400\n")
+	assert.Contains(t, output, "projects home_project_count=0i,private_count=0i,public_count=0i,total_count=5i,total_deleted_count=0i 1530662400\n")
+
+	// Missing Blender ID statistics should not be written as zeroes.
+	assert.NotContains(t, output, "blender_id")
+	assert.NotContains(t, output, "blender_sync_synced_bytes")
+	// Non-numeric fields should be skipped.
+	assert.NotContains(t, output, "collected_sections")
+}
+
+func (s *LinesTestSuite) TestCollectedSections(t *check.C) {
+	stats := testStats()
+	stats.Sections = []string{"files", "nodes"}
+	output := string(Lines(stats))
+
+	assert.Contains(t, output, "files expired_link_count=3i,")
+	assert.Contains(t, output, "nodes,node_type=group\\ asset public_node_count_per_type=47i 1530662400\n")
+	// The skipped sections should not be written as zeroes.
+	assert.NotContains(t, output, "orphan_file_count")
+	assert.NotContains(t, output, "projects")
+	assert.NotContains(t, output, "users")
+}
+
+func (s *LinesTestSuite) TestNestedMap(t *check.C) {
+	stats := testStats()
+	stats.Users.BlenderSync = &elastic.BlenderSync{
+		UserCountPerVersion: map[string]int{"2_79": 4},
+		SyncedBytes:         1024,
+	}
+	output := string(Lines(stats))
+
+	// Maps in sub-structs are tagged by the JSON name of the map, not by the prefixed name.
+	assert.Contains(t, output, "users,version=2_79 blender_sync_user_count_per_version=4i 1530662400\n")
+	assert.Contains(t, output, "blender_sync_synced_bytes=1024i")
+}
+
+func (s *LinesTestSuite) TestLinesBlenderID(t *check.C) {
+	stats := testStats()
+	stats.BlenderID = &elastic.BlenderID{TotalCount: 47}
+	stats.BlenderID.PrivacyPolicyAgreed.Latest = 5
+
+	output := string(Lines(stats))
+	assert.Contains(t, output, "blender_id ")
+	assert.Contains(t, output, "privacy_policy_agreed_latest=5i")
+	assert.Contains(t, output, "total_user_count=47i")
+}
+
+func (s *LinesTestSuite) TestPush(t *check.C) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+	defer SetBasicAuth("", "")
+
+	var body, query, username string
+	httpmock.RegisterResponder("POST", "http://influx.test/write",
+		func(req *http.Request) (*http.Response, error) {
+			contents, _ := ioutil.ReadAll(req.Body)
+			body = string(contents)
+			query = req.URL.RawQuery
+			username, _, _ = req.BasicAuth()
+			return httpmock.NewStringResponse(204, ""), nil
+		})
+
+	SetBasicAuth("stats", "secret")
+	assert.Nil(t, Push("http://influx.test/write?db=cloudstats", testStats(), testStats()))
+	assert.Equal(t, "db=cloudstats&precision=s", query)
+	assert.Equal(t, "stats", username)
+	assert.Equal(t, string(Lines(testStats()))+string(Lines(testStats())), body)
+}
+
+func (s *LinesTestSuite) TestPushError(t *check.C) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	httpmock.RegisterResponder("POST", "http://influx.test/write",
+		httpmock.NewStringResponder(404, `{"error":"database not found: \"cloudstats\""}`))
+
+	err := Push("http://influx.test/write?db=cloudstats", testStats())
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "database not found")
+}
+
+func (s *LinesTestSuite) TestPushCancelled(t *check.C) {
+	// A hanging InfluxDB should not block the push beyond the context.
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := PushContext(ctx, server.URL+"/write?db=cloudstats", testStats())
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "context deadline exceeded")
+}
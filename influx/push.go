@@ -0,0 +1,91 @@
+package influx
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultTimeout is the timeout of requests to InfluxDB.
+const DefaultTimeout = 1 * time.Minute
+
+// httpClient is used for all requests to InfluxDB. The timeout prevents a hanging InfluxDB from
+// blocking the run when no deadline is given.
+var httpClient = &http.Client{Timeout: DefaultTimeout}
+
+var credentials struct {
+	username string
+	password string
+}
+
+// SetBasicAuth sets the username and password used for all requests to InfluxDB.
+// An empty username disables authentication.
+func SetBasicAuth(username, password string) {
+	credentials.username = username
+	credentials.password = password
+}
+
+// Push writes the statistics documents to InfluxDB, using the HTTP write API at writeURL,
+// for example "http://localhost:8086/write?db=cloudstats". All documents are sent in one request.
+func Push(writeURL string, stats ...elastic.Stats) error {
+	return PushContext(context.Background(), writeURL, stats...)
+}
+
+// PushContext is like Push, but aborts the request when the context is done.
+func PushContext(ctx context.Context, writeURL string, stats ...elastic.Stats) error {
+	if len(stats) == 0 {
+		return nil
+	}
+
+	postURL, err := url.Parse(writeURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %s", err)
+	}
+	query := postURL.Query()
+	query.Set("precision", "s")
+	postURL.RawQuery = query.Encode()
+	logger := log.WithFields(log.Fields{
+		"url":       writeURL,
+		"documents": len(stats),
+	})
+
+	payload := bytes.Buffer{}
+	for _, doc := range stats {
+		payload.Write(Lines(doc))
+	}
+
+	req, err := http.NewRequest("POST", postURL.String(), &payload)
+	if err != nil {
+		return fmt.Errorf("unable to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if credentials.username != "" {
+		req.SetBasicAuth(credentials.username, credentials.password)
+	}
+
+	logger.Debug("pushing to InfluxDB")
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error performing HTTP request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		logger.WithFields(log.Fields{
+			"code": resp.StatusCode,
+			"body": string(body),
+		}).Warning("error response from InfluxDB")
+		return fmt.Errorf("error %d writing to InfluxDB: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+
+	logger.Info("stored stats in InfluxDB")
+	return nil
+}
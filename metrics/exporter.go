@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	log "github.com/sirupsen/logrus"
+)
+
+// CollectFunc collects the current statistics.
+type CollectFunc func() (elastic.Stats, error)
+
+// Exporter serves the most recently collected statistics as Prometheus metrics. Collecting takes
+// a while, so scrapes never wait for it: they are served from the cached statistics, while stale
+// statistics are refreshed in the background.
+type Exporter struct {
+	collect CollectFunc
+	maxAge  time.Duration
+
+	// refreshMutex prevents refreshes from running at the same time; mutex protects the rest.
+	refreshMutex sync.Mutex
+	background   sync.WaitGroup
+
+	mutex       sync.Mutex
+	stats       *elastic.Stats
+	collectedAt time.Time
+	lastError   error
+	refreshing  bool
+	// staleAfter is the age after which the statistics are reported as stale.
+	staleAfter time.Duration
+}
+
+// NewExporter returns an exporter that uses the collect function to obtain statistics.
+// When maxAge is not zero, statistics older than that are refreshed in the background when they
+// are scraped.
+func NewExporter(collect CollectFunc, maxAge time.Duration) *Exporter {
+	return &Exporter{
+		collect:    collect,
+		maxAge:     maxAge,
+		staleAfter: maxAge,
+	}
+}
+
+// Refresh collects new statistics. When this fails, the previous statistics are kept.
+// Scrapes are served from the previous statistics while refreshing.
+func (e *Exporter) Refresh() error {
+	e.mutex.Lock()
+	e.refreshing = true
+	e.mutex.Unlock()
+	return e.refresh()
+}
+
+// refresh collects new statistics; e.refreshing should be set by the caller.
+func (e *Exporter) refresh() error {
+	e.refreshMutex.Lock()
+	defer e.refreshMutex.Unlock()
+
+	startTime := time.Now()
+	stats, err := e.collect()
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.refreshing = false
+	e.lastError = err
+	if err != nil {
+		log.WithError(err).Error("unable to refresh statistics for Prometheus")
+		return err
+	}
+
+	e.stats = &stats
+	e.collectedAt = time.Now()
+	log.WithField("duration", e.collectedAt.Sub(startTime)).Info("refreshed statistics for Prometheus")
+	return nil
+}
+
+// refreshInBackground starts a refresh, unless one is running already. Assumes the mutex is locked.
+func (e *Exporter) refreshInBackground() {
+	if e.refreshing {
+		return
+	}
+	e.refreshing = true
+	e.background.Add(1)
+	go func() {
+		defer e.background.Done()
+		e.refresh()
+	}()
+}
+
+// RefreshEvery refreshes the statistics right away and then periodically, until the done channel
+// is closed. Statistics older than twice the interval are reported as stale.
+func (e *Exporter) RefreshEvery(interval time.Duration, done <-chan struct{}) {
+	e.mutex.Lock()
+	e.staleAfter = 2 * interval
+	e.mutex.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	e.Refresh()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			e.Refresh()
+		}
+	}
+}
+
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	age := time.Since(e.collectedAt)
+	if e.maxAge > 0 && (e.stats == nil || age > e.maxAge) {
+		e.refreshInBackground()
+	}
+	if e.stats == nil {
+		http.Error(w, "no statistics collected yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	buffer := bytes.Buffer{}
+	if err := Write(&buffer, *e.stats); err != nil {
+		log.WithError(err).Error("unable to write Prometheus metrics")
+		http.Error(w, "unable to write metrics", http.StatusInternalServerError)
+		return
+	}
+
+	ew := errWriter{w: &buffer}
+	up := 1.0
+	if e.lastError != nil {
+		up = 0.0
+	}
+	stale := 0.0
+	if e.staleAfter > 0 && age > e.staleAfter {
+		stale = 1.0
+	}
+	ew.gauge(Prefix+"_last_refresh_success", "Whether the last refresh of the statistics succeeded.", "",
+		[]sample{{value: up}})
+	ew.gauge(Prefix+"_age_seconds", "Time since the statistics were collected.", "",
+		[]sample{{value: age.Seconds()}})
+	ew.gauge(Prefix+"_stale", "Whether the statistics are older than the cache TTL or twice the refresh interval.", "",
+		[]sample{{value: stale}})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buffer.Bytes())
+}
@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+)
+
+// Prefix is prepended to the names of all metrics.
+const Prefix = "cloudstats"
+
+// Write writes the statistics in the Prometheus text exposition format. Every numeric field
+// becomes a gauge named after its JSON path, for example cloudstats_files_expired_link_count.
+// Map fields become labelled series of a single gauge. Only the fields of the collected sections
+// are written, so that skipped collectors don't show up as zeroes.
+func Write(w io.Writer, stats elastic.Stats) error {
+	ew := errWriter{w: w}
+	ew.gauge(Prefix+"_timestamp_seconds", "Timestamp of the statistics.", "",
+		[]sample{{value: float64(stats.Timestamp.Unix())}})
+	writeStruct(&ew, stats.Collected, Prefix, "", reflect.ValueOf(stats))
+	return ew.err
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+type sample struct {
+	labelValue string
+	value      float64
+}
+
+// errWriter remembers the first write error, so that we don't have to check every write.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...interface{}) {
+	if ew.err != nil {
+		return
+	}
+	_, ew.err = fmt.Fprintf(ew.w, format, args...)
+}
+
+func (ew *errWriter) gauge(name, help, labelName string, samples []sample) {
+	ew.printf("# HELP %s %s\n", name, help)
+	ew.printf("# TYPE %s gauge\n", name)
+	for _, s := range samples {
+		value := strconv.FormatFloat(s.value, 'g', -1, 64)
+		if labelName == "" {
+			ew.printf("%s %s\n", name, value)
+		} else {
+			ew.printf("%s{%s=\"%s\"} %s\n", name, labelName, labelEscaper.Replace(s.labelValue), value)
+		}
+	}
+}
+
+// writeStruct writes the numeric fields of a (pointer to a) struct, recursing into sub-structs.
+// Fields of sections that were not collected are skipped; path is the dotted JSON path of value.
+func writeStruct(ew *errWriter, collected func(path string) bool, prefix, path string, value reflect.Value) {
+	if value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			// Missing data (for example from Blender ID) is omitted, not exported as zero.
+			return
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return
+	}
+
+	valueType := value.Type()
+	for idx := 0; idx < valueType.NumField(); idx++ {
+		field := valueType.Field(idx)
+		jsonName := strings.Split(field.Tag.Get("json"), ",")[0]
+		if jsonName == "" || jsonName == "-" {
+			continue
+		}
+		fieldPath := jsonName
+		if path != "" {
+			fieldPath = path + "." + jsonName
+		}
+		if !collected(fieldPath) {
+			continue
+		}
+		name := prefix + "_" + jsonName
+		fieldValue := value.Field(idx)
+		help := fmt.Sprintf("Value of %s in the statistics document.", strings.Replace(
+			strings.TrimPrefix(name, Prefix+"_"), "_", " ", -1))
+
+		switch fieldValue.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			ew.gauge(name, help, "", []sample{{value: float64(fieldValue.Int())}})
+		case reflect.Float32, reflect.Float64:
+			ew.gauge(name, help, "", []sample{{value: fieldValue.Float()}})
+		case reflect.Map:
+			writeMap(ew, name, help, jsonName, fieldValue)
+		case reflect.Struct, reflect.Ptr:
+			if fieldValue.Type() == timeType {
+				continue
+			}
+			writeStruct(ew, collected, name, fieldPath, fieldValue)
+		}
+	}
+}
+
+// writeMap writes a map with string keys and numeric values as labelled series.
+func writeMap(ew *errWriter, name, help, jsonName string, value reflect.Value) {
+	if value.Type().Key().Kind() != reflect.String || value.Len() == 0 {
+		return
+	}
+
+	samples := []sample{}
+	for _, key := range value.MapKeys() {
+		elem := value.MapIndex(key)
+		s := sample{labelValue: key.String()}
+		switch elem.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			s.value = float64(elem.Int())
+		case reflect.Float32, reflect.Float64:
+			s.value = elem.Float()
+		default:
+			return
+		}
+		samples = append(samples, s)
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].labelValue < samples[j].labelValue })
+
+	ew.gauge(name, help, elastic.KeyName(jsonName), samples)
+}
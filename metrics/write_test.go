@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+)
+
+type WriteTestSuite struct{}
+
+var _ = check.Suite(&WriteTestSuite{})
+
+func testStats() elastic.Stats {
+	stats := elastic.Stats{
+		Timestamp: time.Date(2018, 7, 4, 0, 0, 0, 0, time.UTC),
+	}
+	stats.Files.ExpiredLinkCount = 3
+	stats.Files.TotalBytesStorageUsed = 123456789012
+	stats.Files.TotalBytesStorageUsedPerBackend = map[string]int64{"gcs": 123456789000, "local": 12}
+	stats.Files.FileCountPerStatus = map[string]int{"complete": 5, "weird \"status\"": 1}
+	stats.Nodes.PublicCountPerNodeType = map[string]int{"asset": 47}
+	stats.Users.CountPerType = map[string]int{"subscriber": 20}
+	return stats
+}
+
+func (s *WriteTestSuite) TestWrite(t *check.C) {
+	buffer := bytes.Buffer{}
+	assert.Nil(t, Write(&buffer, testStats()))
+	output := buffer.String()
+
+	assert.Contains(t, output, "# TYPE cloudstats_files_expired_link_count gauge\ncloudstats_files_expired_link_count 3\n")
+	assert.Contains(t, output, "cloudstats_files_total_bytes_storage_used 1.23456789012e+11\n")
+	assert.Contains(t, output, "cloudstats_timestamp_seconds 1.5306624e+09\n")
+	assert.Contains(t, output,
+		"cloudstats_files_total_bytes_storage_used_per_backend{backend=\"gcs\"} 1.23456789e+11\n"+
+			"cloudstats_files_total_bytes_storage_used_per_backend{backend=\"local\"} 12\n")
+	assert.Contains(t, output, "cloudstats_files_file_count_per_status{status=\"weird \\\"status\\\"\"} 1\n")
+	assert.Contains(t, output, "cloudstats_nodes_public_node_count_per_type{node_type=\"asset\"} 47\n")
+	assert.Contains(t, output, "cloudstats_users_count_per_type{type=\"subscriber\"} 20\n")
+
+	// Missing Blender ID statistics should not be exported as zeroes.
+	assert.NotContains(t, output, "blender_id")
+	// Non-numeric fields should be skipped.
+	assert.NotContains(t, output, "collected_sections")
+}
+
+func (s *WriteTestSuite) TestWriteBlenderID(t *check.C) {
+	stats := testStats()
+	stats.BlenderID = &elastic.BlenderID{TotalCount: 47}
+	stats.BlenderID.PrivacyPolicyAgreed.Latest = 5
+
+	buffer := bytes.Buffer{}
+	assert.Nil(t, Write(&buffer, stats))
+	output := buffer.String()
+
+	assert.Contains(t, output, "cloudstats_blender_id_total_user_count 47\n")
+	assert.Contains(t, output, "cloudstats_blender_id_privacy_policy_agreed_latest 5\n")
+}
+
+func (s *WriteTestSuite) TestWriteCollectedSections(t *check.C) {
+	stats := testStats()
+	stats.Sections = []string{"files", "users"}
+
+	buffer := bytes.Buffer{}
+	assert.Nil(t, Write(&buffer, stats))
+	output := buffer.String()
+
+	assert.Contains(t, output, "cloudstats_files_expired_link_count 3\n")
+	assert.Contains(t, output, "cloudstats_users_count_per_type{type=\"subscriber\"} 20\n")
+	// The skipped sections should not be exported as zeroes.
+	assert.NotContains(t, output, "orphan_file_count")
+	assert.NotContains(t, output, "cloudstats_nodes")
+	assert.NotContains(t, output, "cloudstats_projects")
+	assert.NotContains(t, output, "subscriber_count")
+	assert.NotContains(t, output, "blender_sync_count")
+}
+
+func (s *WriteTestSuite) TestExporterCaching(t *check.C) {
+	collectCount := 0
+	var collectErr error
+	collect := func() (elastic.Stats, error) {
+		collectCount++
+		return testStats(), collectErr
+	}
+	exporter := NewExporter(collect, time.Hour)
+
+	scrape := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		exporter.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		return recorder
+	}
+
+	// The first scrape should start collecting in the background, the second should use the cache.
+	assert.Equal(t, http.StatusServiceUnavailable, scrape().Code)
+	exporter.background.Wait()
+	assert.Equal(t, 1, collectCount)
+	resp := scrape()
+	assert.Equal(t, http.StatusOK, resp.Code)
+	exporter.background.Wait()
+	assert.Equal(t, 1, collectCount)
+	assert.True(t, strings.Contains(resp.Body.String(), "cloudstats_last_refresh_success 1\n"))
+	assert.True(t, strings.Contains(resp.Body.String(), "cloudstats_stale 0\n"))
+
+	// A failing refresh should keep the previous statistics.
+	collectErr = errors.New("no database")
+	assert.NotNil(t, exporter.Refresh())
+	resp = scrape()
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.True(t, strings.Contains(resp.Body.String(), "cloudstats_last_refresh_success 0\n"))
+	assert.True(t, strings.Contains(resp.Body.String(), "cloudstats_files_expired_link_count 3\n"))
+}
+
+func (s *WriteTestSuite) TestExporterRefreshInBackground(t *check.C) {
+	release := make(chan struct{})
+	collectCount := 0
+	exporter := NewExporter(func() (elastic.Stats, error) {
+		collectCount++
+		<-release
+		return testStats(), nil
+	}, time.Hour)
+	close(release)
+	assert.Nil(t, exporter.Refresh())
+
+	// Make the statistics stale; scrapes should not wait for the refresh that they start.
+	release = make(chan struct{})
+	exporter.mutex.Lock()
+	exporter.collectedAt = time.Now().Add(-2 * time.Hour)
+	exporter.mutex.Unlock()
+
+	for idx := 0; idx < 3; idx++ {
+		recorder := httptest.NewRecorder()
+		exporter.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.True(t, strings.Contains(recorder.Body.String(), "cloudstats_stale 1\n"))
+	}
+
+	close(release)
+	exporter.background.Wait()
+	assert.Equal(t, 2, collectCount)
+}
+
+func (s *WriteTestSuite) TestExporterWithoutStats(t *check.C) {
+	exporter := NewExporter(func() (elastic.Stats, error) {
+		return elastic.Stats{}, errors.New("no database")
+	}, time.Hour)
+
+	recorder := httptest.NewRecorder()
+	exporter.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	exporter.background.Wait()
+}
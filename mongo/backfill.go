@@ -0,0 +1,62 @@
+package mongo
+
+import (
+	"time"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// CheckpointCollection names the MongoDB collection that stores the progress of backfills.
+const CheckpointCollection = "cloudstats_backfill"
+
+// Checkpoint records the progress of a backfill, so that an interrupted backfill can resume.
+type Checkpoint struct {
+	ID string `bson:"_id"`
+	// Completed is the latest timestamp for which statistics were collected.
+	Completed time.Time `bson:"completed"`
+	// Failed lists the timestamps before Completed for which collecting statistics failed.
+	Failed  []time.Time `bson:"failed"`
+	Updated time.Time   `bson:"updated"`
+}
+
+// Timestamps returns the timestamps of the documents in the stats collection between begin
+// (exclusive) and end (inclusive), sorted in ascending order.
+func Timestamps(mgoStats *mgo.Session, begin, end time.Time) ([]time.Time, error) {
+	var result struct {
+		Timestamp time.Time `bson:"timestamp"`
+	}
+	query := bson.M{"timestamp": bson.M{"$gt": begin, "$lte": end}}
+	iter := coll(mgoStats).Find(query).Select(bson.M{"timestamp": 1}).Sort("timestamp").Iter()
+
+	timestamps := []time.Time{}
+	for iter.Next(&result) {
+		timestamps = append(timestamps, result.Timestamp.UTC())
+	}
+	return timestamps, iter.Close()
+}
+
+// LoadCheckpoint returns the checkpoint with the given ID, or an empty checkpoint with that ID
+// when there is none.
+func LoadCheckpoint(mgoStats *mgo.Session, ID string) (Checkpoint, error) {
+	checkpoint := Checkpoint{}
+	err := mgoStats.DB("").C(CheckpointCollection).FindId(ID).One(&checkpoint)
+	if err == mgo.ErrNotFound {
+		return Checkpoint{ID: ID}, nil
+	}
+	if err != nil {
+		return Checkpoint{ID: ID}, err
+	}
+	checkpoint.Completed = checkpoint.Completed.UTC()
+	for idx := range checkpoint.Failed {
+		checkpoint.Failed[idx] = checkpoint.Failed[idx].UTC()
+	}
+	return checkpoint, nil
+}
+
+// SaveCheckpoint stores the checkpoint, replacing the previous one with the same ID.
+func SaveCheckpoint(mgoStats *mgo.Session, checkpoint Checkpoint) error {
+	checkpoint.Updated = time.Now().UTC()
+	_, err := mgoStats.DB("").C(CheckpointCollection).UpsertId(checkpoint.ID, checkpoint)
+	return err
+}
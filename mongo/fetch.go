@@ -1,18 +1,30 @@
 package mongo
 
 import (
+	"context"
+	"fmt"
+	"time"
+
 	log "github.com/sirupsen/logrus"
 	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
-// All returns all documents in the stats collection.
-func All(mgoStats *mgo.Session) chan bson.M {
+// All returns all documents in the stats collection. After the documents channel is closed, the
+// error channel receives the error that stopped the query, if any, and is then closed as well.
+func All(mgoStats *mgo.Session) (<-chan bson.M, <-chan error) {
+	return AllContext(context.Background(), mgoStats)
+}
+
+// AllContext is like All, but stops with the context's error when the context is done.
+func AllContext(ctx context.Context, mgoStats *mgo.Session) (<-chan bson.M, <-chan error) {
 	log.Warn("retrieving all documents in MongoDB")
 	c := mgoStats.DB("").C(StatsCollection)
 	ch := make(chan bson.M)
+	errs := make(chan error, 1)
 
 	go func() {
+		defer close(errs)
 		defer close(ch)
 
 		result := &bson.M{}
@@ -21,14 +33,21 @@ func All(mgoStats *mgo.Session) chan bson.M {
 		q := c.Find(bson.M{})
 		count, err := q.Count()
 		if err != nil {
-			log.WithError(err).Fatal("error counting documents in MongoDB")
+			errs <- fmt.Errorf("error counting documents in MongoDB: %s", err)
+			return
 		}
 
 		iter := q.Iter()
 		for iter.Next(result) {
 			seen++
 			log.WithField("id", (*result)["_id"]).Debug("found document in MongoDB")
-			ch <- *result
+			select {
+			case ch <- *result:
+			case <-ctx.Done():
+				iter.Close()
+				errs <- ctx.Err()
+				return
+			}
 
 			if seen%100 == 0 {
 				log.WithFields(log.Fields{
@@ -42,10 +61,21 @@ func All(mgoStats *mgo.Session) chan bson.M {
 			result = &bson.M{}
 		}
 		if err := iter.Close(); err != nil {
-			log.WithError(err).Fatal("error querying MongoDB")
+			errs <- fmt.Errorf("error querying MongoDB after %d documents: %s", seen, err)
+			return
 		}
 		log.WithField("seen", seen).Info("all documents in MongoDB retrieved")
 	}()
 
-	return ch
+	return ch, errs
+}
+
+// LatestTimestamp returns the timestamp of the most recent document in the stats collection.
+// Returns mgo.ErrNotFound when there are no documents.
+func LatestTimestamp(mgoStats *mgo.Session) (time.Time, error) {
+	var result struct {
+		Timestamp time.Time `bson:"timestamp"`
+	}
+	err := coll(mgoStats).Find(nil).Select(bson.M{"timestamp": 1}).Sort("-timestamp").One(&result)
+	return result.Timestamp.UTC(), err
 }
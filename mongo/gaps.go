@@ -0,0 +1,68 @@
+package mongo
+
+import (
+	"time"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Missing returns the documents in the stats collection that don't have the field, which is a
+// dotted path like "users.subscriber_count", sorted by timestamp.
+func Missing(mgoStats *mgo.Session, field string) ([]bson.M, error) {
+	docs := []bson.M{}
+	err := coll(mgoStats).Find(bson.M{field: bson.M{"$exists": false}}).Sort("timestamp").All(&docs)
+	return docs, err
+}
+
+// Nearest returns the documents closest before and after the timestamp that do have the field.
+// Either is nil when there is no such document.
+func Nearest(mgoStats *mgo.Session, field string, timestamp time.Time) (before, after *elastic.Stats, err error) {
+	find := func(timestampQuery bson.M, sort string) (*elastic.Stats, error) {
+		query := bson.M{field: bson.M{"$exists": true}, "timestamp": timestampQuery}
+		stats := elastic.Stats{}
+		// The ID is not needed, and older documents have ObjectIDs that don't fit in Stats.ID.
+		err := coll(mgoStats).Find(query).Select(bson.M{"_id": 0}).Sort(sort).One(&stats)
+		if err == mgo.ErrNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		stats.Timestamp = stats.Timestamp.UTC()
+		return &stats, nil
+	}
+
+	if before, err = find(bson.M{"$lt": timestamp}, "-timestamp"); err != nil {
+		return nil, nil, err
+	}
+	if after, err = find(bson.M{"$gt": timestamp}, "timestamp"); err != nil {
+		return nil, nil, err
+	}
+	return before, after, nil
+}
+
+// Fill sets the fields of the document with the given ID, adds the sections to its collected or
+// estimated sections, and returns the updated document.
+func Fill(mgoStats *mgo.Session, ID interface{}, set bson.M, collected, estimated []string) (bson.M, error) {
+	update := bson.M{"$set": set}
+	addToSet := bson.M{}
+	if len(collected) > 0 {
+		addToSet["collected_sections"] = bson.M{"$each": collected}
+	}
+	if len(estimated) > 0 {
+		addToSet["estimated_sections"] = bson.M{"$each": estimated}
+	}
+	if len(addToSet) > 0 {
+		update["$addToSet"] = addToSet
+	}
+
+	c := coll(mgoStats)
+	if err := c.UpdateId(ID, update); err != nil {
+		return nil, err
+	}
+	doc := bson.M{}
+	err := c.FindId(ID).One(&doc)
+	return doc, err
+}
@@ -2,3 +2,6 @@ package mongo
 
 // StatsCollection names the MongoDB collection we use to store the statsistics documents.
 const StatsCollection = "cloudstats"
+
+// ProjectsCollection names the MongoDB collection that stores the storage statistics per project.
+const ProjectsCollection = "cloudstats_projects"
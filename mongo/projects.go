@@ -0,0 +1,39 @@
+package mongo
+
+import (
+	"fmt"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// projectIndices are the indices of the projects collection, for querying the storage of one
+// project over time, and of all projects at one time.
+var projectIndices = []mgo.Index{
+	{Key: []string{"project", "timestamp"}},
+	{Key: []string{"timestamp", "-total_bytes"}},
+}
+
+// PushProjects stores the per-project storage statistics in the projects collection, replacing
+// documents with the same ID.
+func PushProjects(mgoStats *mgo.Session, projects []elastic.ProjectStorage) error {
+	c := mgoStats.DB("").C(ProjectsCollection)
+	for _, index := range projectIndices {
+		if err := c.EnsureIndex(index); err != nil {
+			return fmt.Errorf("unable to create index on %s: %s", ProjectsCollection, err)
+		}
+	}
+
+	bulk := c.Bulk()
+	bulk.Unordered()
+	for _, project := range projects {
+		bulk.Upsert(bson.M{"_id": project.ID}, project)
+	}
+	if _, err := bulk.Run(); err != nil {
+		return fmt.Errorf("unable to store project storage statistics: %s", err)
+	}
+	log.WithField("projects", len(projects)).Debug("stored project storage statistics in Mongo")
+	return nil
+}
@@ -1,7 +1,10 @@
 package mongo
 
 import (
+	"context"
 	"errors"
+	"strings"
+	"time"
 
 	"github.com/armadillica/pillar-statscollector/elastic"
 	log "github.com/sirupsen/logrus"
@@ -34,20 +37,127 @@ func PushHit(mgoStats *mgo.Session, hit elastic.Hit) error {
 	return nil
 }
 
-// Push stores a stats document in MongoDB.
+// Push stores a stats document in MongoDB, replacing the document with the same ID if it exists.
+// A partial document is merged into an existing document with the same timestamp, if there is one;
+// in that case the stats are updated to reflect the merged document.
 func Push(mgoStats *mgo.Session, stats *elastic.Stats) error {
+	if stats.Partial {
+		merged, err := mergePartial(coll(mgoStats), stats)
+		if err != nil {
+			log.WithError(err).Error("unable to merge partial statistics in Mongo")
+			return errMongoStoreError
+		}
+		if merged {
+			return nil
+		}
+	}
+
 	if stats.ID == "" {
 		stats.ID = bson.NewObjectId().Hex()
 	}
 	log.WithField("stats", stats).Debug("storing in MongoDB")
 
 	c := coll(mgoStats)
-	err := c.Insert(stats)
+	info, err := c.UpsertId(stats.ID, stats)
 	if err != nil {
 		log.WithError(err).Error("unable to store statistics in Mongo")
 		return errMongoStoreError
 	}
 
-	log.WithField("id", stats.ID).Debug("stored document in Mongo")
+	log.WithFields(log.Fields{
+		"id":       stats.ID,
+		"replaced": info.Matched > 0,
+	}).Debug("stored document in Mongo")
 	return nil
 }
+
+// PushContext is like Push, but fails when the context is done. MongoDB operations cannot be
+// interrupted, so the deadline of the context is used as socket timeout instead.
+func PushContext(ctx context.Context, mgoStats *mgo.Session, stats *elastic.Stats) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+		mgoStats = mgoStats.Copy()
+		defer mgoStats.Close()
+		mgoStats.SetSocketTimeout(time.Until(deadline))
+	}
+	return Push(mgoStats, stats)
+}
+
+// mergePartial updates the existing document with the same timestamp with the sections of the
+// partial stats document, and then loads the merged document into stats.
+// Returns false when there is no existing document to merge with.
+func mergePartial(c *mgo.Collection, stats *elastic.Stats) (bool, error) {
+	existing := elastic.Stats{}
+	err := c.Find(bson.M{"timestamp": stats.Timestamp}).Sort("-_id").One(&existing)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	logger := log.WithFields(log.Fields{
+		"id":       existing.ID,
+		"sections": stats.Sections,
+	})
+
+	// Round-trip through BSON to be able to look up fields by their path.
+	asBSON, err := bson.Marshal(stats)
+	if err != nil {
+		return false, err
+	}
+	doc := bson.M{}
+	if err := bson.Unmarshal(asBSON, &doc); err != nil {
+		return false, err
+	}
+
+	set := bson.M{}
+	unset := bson.M{}
+	for _, section := range stats.Sections {
+		for _, field := range elastic.SectionFields[section] {
+			if value, found := lookup(doc, field); found {
+				set[field] = value
+			} else {
+				unset[field] = ""
+			}
+		}
+	}
+
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	// Documents without collected sections have all of them, and should stay that way.
+	if len(existing.Sections) > 0 {
+		update["$addToSet"] = bson.M{"collected_sections": bson.M{"$each": stats.Sections}}
+	}
+
+	logger.Debug("merging partial statistics into existing document")
+	if err := c.UpdateId(existing.ID, update); err != nil {
+		return false, err
+	}
+	merged := elastic.Stats{}
+	if err := c.FindId(existing.ID).One(&merged); err != nil {
+		return false, err
+	}
+	// The per-project storage is not part of the document.
+	merged.ProjectStorage = stats.ProjectStorage
+	*stats = merged
+	logger.Info("merged partial statistics into existing document in Mongo")
+	return true, nil
+}
+
+// lookup returns the value in the document at the dotted path, such as "users.subscriber_count".
+func lookup(doc bson.M, path string) (interface{}, bool) {
+	parts := strings.SplitN(path, ".", 2)
+	value, found := doc[parts[0]]
+	if !found || len(parts) == 1 {
+		return value, found
+	}
+	subdoc, ok := value.(bson.M)
+	if !ok {
+		return nil, false
+	}
+	return lookup(subdoc, parts[1])
+}
@@ -1,6 +1,8 @@
 package mongo
 
 import (
+	"time"
+
 	"github.com/armadillica/pillar-statscollector/elastic"
 	"github.com/stretchr/testify/assert"
 
@@ -63,3 +65,61 @@ func (s *PushTestSuite) TestStoreWithID(t *check.C) {
 	assert.Equal(t, stats.ID, found.ID)
 	assert.Equal(t, 3214, found.Users.SubscriberCount)
 }
+
+func (s *PushTestSuite) TestUpsert(t *check.C) {
+	timestamp := time.Date(2018, 7, 4, 0, 0, 0, 0, time.UTC)
+	stats := elastic.Stats{ID: elastic.DocumentID("cloud", timestamp), Timestamp: timestamp}
+	stats.Users.SubscriberCount = 3214
+	assert.Nil(t, Push(s.session, &stats))
+
+	// Pushing a document with the same ID again should replace it.
+	again := elastic.Stats{ID: elastic.DocumentID("cloud", timestamp), Timestamp: timestamp}
+	again.Users.SubscriberCount = 3215
+	assert.Nil(t, Push(s.session, &again))
+
+	count, err := coll(s.session).Count()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	found := elastic.Stats{}
+	assert.Nil(t, coll(s.session).FindId(stats.ID).One(&found))
+	assert.Equal(t, 3215, found.Users.SubscriberCount)
+}
+
+func (s *PushTestSuite) TestMergePartial(t *check.C) {
+	timestamp := time.Date(2018, 7, 4, 0, 0, 0, 0, time.UTC)
+
+	full := elastic.Stats{Timestamp: timestamp, Sections: []string{"files", "store", "users"}}
+	full.Files.FileCountTotal = 47
+	full.Users.SubscriberCount = 3214
+	full.Users.TotalCount = 5000
+	assert.Nil(t, Push(s.session, &full))
+
+	partial := elastic.Stats{Timestamp: timestamp, Sections: []string{"files"}, Partial: true}
+	partial.Files.FileCountTotal = 48
+	assert.Nil(t, Push(s.session, &partial))
+
+	// The partial document should have been merged into the full one.
+	assert.Equal(t, full.ID, partial.ID)
+	assert.False(t, partial.Partial)
+	assert.Equal(t, 48, partial.Files.FileCountTotal)
+	assert.Equal(t, 3214, partial.Users.SubscriberCount)
+	assert.Equal(t, 5000, partial.Users.TotalCount)
+
+	count, err := coll(s.session).Count()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func (s *PushTestSuite) TestPartialWithoutExisting(t *check.C) {
+	partial := elastic.Stats{Timestamp: time.Now().UTC(), Sections: []string{"files"}, Partial: true}
+	partial.Files.FileCountTotal = 48
+	assert.Nil(t, Push(s.session, &partial))
+	assert.NotEqual(t, "", partial.ID)
+
+	found := elastic.Stats{}
+	err := coll(s.session).FindId(partial.ID).One(&found)
+	assert.Nil(t, err)
+	assert.True(t, found.Partial)
+	assert.Equal(t, 48, found.Files.FileCountTotal)
+}
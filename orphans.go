@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/armadillica/pillar-statscollector/pillar"
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// orphanWriter writes the orphan files report in a specific format.
+type orphanWriter interface {
+	Write(orphan pillar.OrphanFile) error
+	Close() error
+}
+
+// orphanFormat returns the format of the report, which is taken from the file extension when
+// it isn't given explicitly.
+func orphanFormat(filename, format string) (string, error) {
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(filename)), ".")
+	}
+	switch format {
+	case "json", "csv":
+		return format, nil
+	case "":
+		return "", fmt.Errorf("unable to determine the report format of %q, use -orphans-report-format", filename)
+	default:
+		return "", fmt.Errorf("unknown report format %q, expected \"json\" or \"csv\"", format)
+	}
+}
+
+func newOrphanWriter(w io.Writer, format string) orphanWriter {
+	if format == "csv" {
+		return newCSVOrphanWriter(w)
+	}
+	return &jsonOrphanWriter{w: w}
+}
+
+// jsonOrphanWriter writes a JSON array of orphan files. The array is written one file at a time,
+// so that the report doesn't have to fit in memory.
+type jsonOrphanWriter struct {
+	w       io.Writer
+	written int
+	err     error
+}
+
+func (jw *jsonOrphanWriter) write(parts ...[]byte) {
+	for _, part := range parts {
+		if jw.err != nil {
+			return
+		}
+		_, jw.err = jw.w.Write(part)
+	}
+}
+
+func (jw *jsonOrphanWriter) Write(orphan pillar.OrphanFile) error {
+	asJSON, err := json.Marshal(orphan)
+	if err != nil {
+		return err
+	}
+	separator := []byte(",\n")
+	if jw.written == 0 {
+		separator = []byte("[\n")
+	}
+	jw.write(separator, asJSON)
+	jw.written++
+	return jw.err
+}
+
+func (jw *jsonOrphanWriter) Close() error {
+	if jw.written == 0 {
+		jw.write([]byte("[]\n"))
+	} else {
+		jw.write([]byte("\n]\n"))
+	}
+	return jw.err
+}
+
+// csvOrphanWriter writes the orphan files as CSV, with a header line.
+type csvOrphanWriter struct {
+	w *csv.Writer
+}
+
+func newCSVOrphanWriter(w io.Writer) *csvOrphanWriter {
+	cw := &csvOrphanWriter{csv.NewWriter(w)}
+	cw.w.Write([]string{"id", "project", "backend", "size"})
+	return cw
+}
+
+func (cw *csvOrphanWriter) Write(orphan pillar.OrphanFile) error {
+	project := ""
+	if orphan.Project != "" {
+		project = orphan.Project.Hex()
+	}
+	return cw.w.Write([]string{orphan.ID.Hex(), project, orphan.Backend, strconv.FormatInt(orphan.Size, 10)})
+}
+
+func (cw *csvOrphanWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// writeOrphansReport writes the orphan files to the given file, for cleaning them up.
+func writeOrphansReport(ctx context.Context, mgoCloud *mgo.Session, filename, format string, before *time.Time) error {
+	format, err := orphanFormat(filename, format)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("unable to create orphans report: %s", err)
+	}
+	defer file.Close()
+
+	logger := log.WithFields(log.Fields{"filename": filename, "format": format})
+	logger.Info("finding orphan files, this may take a while")
+
+	writer := newOrphanWriter(file, format)
+	count := 0
+	var totalBytes int64
+	err = pillar.FindOrphans(ctx, mgoCloud, before, func(orphan pillar.OrphanFile) error {
+		count++
+		totalBytes += orphan.Size
+		return writer.Write(orphan)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to find orphan files: %s", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("unable to write orphans report: %s", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("unable to write orphans report: %s", err)
+	}
+
+	logger.WithFields(log.Fields{
+		"orphans":     count,
+		"total_bytes": totalBytes,
+	}).Warning("wrote orphans report")
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/armadillica/pillar-statscollector/pillar"
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type OrphansTestSuite struct{}
+
+var _ = check.Suite(&OrphansTestSuite{})
+
+var testOrphans = []pillar.OrphanFile{
+	{ID: bson.ObjectIdHex("5b3b5c8a0000000000000001"), Project: bson.ObjectIdHex("5b3b5c8a00000000000000aa"), Backend: "gcs", Size: 1024},
+	{ID: bson.ObjectIdHex("5b3b5c8a0000000000000002"), Backend: "local", Size: 12},
+}
+
+func writeOrphans(t *check.C, format string, orphans []pillar.OrphanFile) string {
+	buffer := bytes.Buffer{}
+	writer := newOrphanWriter(&buffer, format)
+	for _, orphan := range orphans {
+		assert.Nil(t, writer.Write(orphan))
+	}
+	assert.Nil(t, writer.Close())
+	return buffer.String()
+}
+
+func (s *OrphansTestSuite) TestFormat(t *check.C) {
+	format, err := orphanFormat("/tmp/orphans.CSV", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "csv", format)
+
+	format, err = orphanFormat("/tmp/orphans.csv", "json")
+	assert.Nil(t, err)
+	assert.Equal(t, "json", format)
+
+	_, err = orphanFormat("/tmp/orphans", "")
+	assert.NotNil(t, err)
+	_, err = orphanFormat("/tmp/orphans.xml", "")
+	assert.NotNil(t, err)
+}
+
+func (s *OrphansTestSuite) TestJSON(t *check.C) {
+	output := writeOrphans(t, "json", testOrphans)
+	assert.Equal(t, "[\n"+
+		`{"id":"5b3b5c8a0000000000000001","project":"5b3b5c8a00000000000000aa","backend":"gcs","size":1024},`+"\n"+
+		`{"id":"5b3b5c8a0000000000000002","backend":"local","size":12}`+"\n]\n", output)
+
+	var parsed []pillar.OrphanFile
+	assert.Nil(t, json.Unmarshal([]byte(output), &parsed))
+	assert.Equal(t, testOrphans, parsed)
+
+	assert.Equal(t, "[]\n", writeOrphans(t, "json", nil))
+}
+
+func (s *OrphansTestSuite) TestCSV(t *check.C) {
+	assert.Equal(t,
+		"id,project,backend,size\n"+
+			"5b3b5c8a0000000000000001,5b3b5c8a00000000000000aa,gcs,1024\n"+
+			"5b3b5c8a0000000000000002,,local,12\n",
+		writeOrphans(t, "csv", testOrphans))
+}
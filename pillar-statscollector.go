@@ -1,53 +1,188 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/armadillica/pillar-statscollector/elastic"
 	"github.com/armadillica/pillar-statscollector/mongo"
 	"github.com/armadillica/pillar-statscollector/pillar"
+	"github.com/armadillica/pillar-statscollector/sink"
 	log "github.com/sirupsen/logrus"
 	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 const statscollectorVersion = "2.2"
 
+// cliArgs contains the CLI options that are not settings; those are stored in the global config.
 var cliArgs struct {
 	version         bool
 	verbose         bool
 	debug           bool
-	mongoURL        string
-	mongoStorageURL string
-	elasticURL      string
+	configFile      string
+	printConfig     bool
 	before          string
 	nopush          bool
 	allSince        string
+	until           string
+	step            string
 	reverseToMongo  bool
 	reindex         bool
 	resetIndex      bool
+	fillGaps        bool
+	orphansReport   string
+	orphansFormat   string
+	listCollectors  bool
+	checkMapping    bool
+	daemon          bool
+	serveMetrics    bool
+	blenderIDHeader headerFlag
+}
+
+// headerFlag is a repeatable CLI option for HTTP headers in the form "Name: value". Repeating a
+// header adds a value, like http.Header.Add.
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	lines := []string{}
+	for name, values := range h {
+		for _, value := range values {
+			lines = append(lines, name+": "+value)
+		}
+	}
+	return strings.Join(lines, ", ")
+}
+
+func (h headerFlag) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return fmt.Errorf("expected \"Name: value\", not %q", value)
+	}
+	http.Header(h).Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	return nil
+}
+
+// UnmarshalYAML accepts a single value or a list of values per header in the configuration file.
+func (h *headerFlag) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	raw := map[string]interface{}{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	headers := headerFlag{}
+	for name, value := range raw {
+		switch value := value.(type) {
+		case []interface{}:
+			for _, item := range value {
+				http.Header(headers).Add(name, fmt.Sprint(item))
+			}
+		default:
+			http.Header(headers).Add(name, fmt.Sprint(value))
+		}
+	}
+	*h = headers
+	return nil
 }
 
 func parseCliArgs() {
+	defaults := defaultConfig()
+
 	flag.BoolVar(&cliArgs.version, "version", false, "Shows the application version, then exits.")
 	flag.BoolVar(&cliArgs.verbose, "verbose", false, "Enable info-level logging.")
 	flag.BoolVar(&cliArgs.debug, "debug", false, "Enable debug-level logging.")
+	flag.StringVar(&cliArgs.configFile, "config", "", "YAML configuration file to load. Settings from the file are overridden by STATSCOLL_* environment variables, which are overridden by CLI options.")
+	flag.BoolVar(&cliArgs.printConfig, "print-config", false, "Shows the effective configuration with secrets redacted, then exits.")
 	flag.BoolVar(&cliArgs.nopush, "nopush", false, "Log statistics, but don't push to ElasticSearch.")
-	flag.StringVar(&cliArgs.mongoURL, "mongo", "mongodb://localhost/cloud", "URL of the MongoDB database to read from.")
-	flag.StringVar(&cliArgs.mongoStorageURL, "storage", "", "URL of the MongoDB database to store the Cloud statistics to. Defaults to the -mongo option value.")
-	flag.StringVar(&cliArgs.elasticURL, "elastic", "http://localhost:9200/cloudstats/stats/", "URL of the ElasticSearch instance to push to.")
+	flag.String("instance", defaults.Instance, "Name of the Pillar instance, used in the IDs of documents collected with -before, -allsince and when catching up.")
+	flag.String("mongo", defaults.Mongo.URL, "URL of the MongoDB database to read from.")
+	flag.String("storage", "", "URL of the MongoDB database to store the Cloud statistics to. Defaults to the -mongo option value.")
+	flag.String("elastic", defaults.Elastic.URL, "URL of the ElasticSearch instance to push to.")
+	flag.String("elastic-username", "", "Username to authenticate with ElasticSearch. Configure the password, or an API key instead, in the configuration file or environment.")
+	flag.String("elastic-ca-file", "", "PEM file with the certificate authorities to trust for ElasticSearch connections.")
+	flag.String("elastic-cert-file", "", "PEM file with the client certificate for ElasticSearch connections.")
+	flag.String("elastic-key-file", "", "PEM file with the private key of the client certificate.")
+	flag.Bool("elastic-insecure", false, "Do not verify the certificate of ElasticSearch; only use this for testing.")
+	flag.Duration("elastic-timeout", defaults.Elastic.Timeout, "Timeout for requests to ElasticSearch.")
+	flag.Bool("elastic-compress", defaults.Elastic.Compress, "Compress requests to ElasticSearch with gzip, when the cluster supports it.")
+	flag.Int("elastic-bulk-size", defaults.Elastic.BulkSize, "Maximum number of documents per ElasticSearch bulk request, used by -reindex and -allsince.")
+	flag.Duration("elastic-flush-interval", defaults.Elastic.FlushInterval, "Maximum time documents are queued before they are bulk-pushed to ElasticSearch.")
+	flag.String("influx", defaults.Influx.URL, "URL of the InfluxDB write API to push to, when the \"influx\" sink is enabled.")
+	flag.String("influx-username", "", "Username to authenticate with InfluxDB. Configure the password in the configuration file or environment.")
 	flag.StringVar(&cliArgs.before, "before", "", "Only consider objects created before this timestamp; expected in RFC 3339 format.")
-	flag.StringVar(&cliArgs.allSince, "allsince", "", "Collect daily statistics since this timestamp until now; expected in RFC 3339 format.")
+	flag.StringVar(&cliArgs.allSince, "allsince", "", "Collect statistics since this timestamp, for every step that doesn't have statistics yet; expected in RFC 3339 format. An interrupted run resumes where it stopped.")
+	flag.StringVar(&cliArgs.until, "until", "", "End of the period collected by -allsince; expected in RFC 3339 format. Defaults to now.")
+	flag.StringVar(&cliArgs.step, "step", "daily", "Interval between the statistics collected by -allsince; \"hourly\", \"daily\", \"weekly\" or \"monthly\".")
 	flag.BoolVar(&cliArgs.reverseToMongo, "reverse", false, "Query ElasticSearch and store data in MongoDB, which is the reverse of normal operations.")
-	flag.BoolVar(&cliArgs.reindex, "reindex", false, "Reindex ElasticSearch from data stored in MongoDB.")
+	flag.BoolVar(&cliArgs.reindex, "reindex", false, "Reindex ElasticSearch and/or InfluxDB (depending on -sinks) from data stored in MongoDB.")
 	flag.BoolVar(&cliArgs.resetIndex, "reset", false, "Reset the ElasticSearch index (i.e. erase all data in there).")
+	flag.StringVar(&cliArgs.orphansReport, "orphans-report", "", "Write the files that are not referenced by any node, project, user or other file to this JSON or CSV file, then exits.")
+	flag.StringVar(&cliArgs.orphansFormat, "orphans-report-format", "", "Format of the -orphans-report file, \"json\" or \"csv\"; defaults to the file extension.")
+	flag.BoolVar(&cliArgs.fillGaps, "fill-gaps", false, "Fill in missing Blender Store and Blender ID statistics in the documents stored in MongoDB, and push the updated documents to the other sinks.")
+	flag.Duration("fill-gaps-max-age", defaults.FillGaps.MaxAge, "Maximum age of documents whose gaps are filled with the current values.")
+	flag.String("fill-gaps-policy", defaults.FillGaps.Policy, "How -fill-gaps handles older documents: \"interpolate\" estimates the values from the surrounding documents, \"skip\" leaves them alone.")
+	flag.String("sinks", strings.Join(defaults.Sinks, ","), "Comma-separated list of destinations to push statistics to; \"mongo\", \"elastic\" and/or \"influx\".")
+	flag.String("required-sinks", strings.Join(defaults.RequiredSinks, ","), "Comma-separated list of sinks that make the run fail when pushing to them fails; failures of other sinks are only logged.")
+	flag.Int("concurrency", defaults.Collectors.Concurrency, "Maximum number of collectors to run at the same time.")
+	flag.Duration("collector-timeout", defaults.Collectors.Timeout, "Maximum duration of each collector; 0 means no limit.")
+	flag.Int("top-projects", defaults.Collectors.TopProjects, "Number of projects using the most storage to include in the statistics document.")
+	flag.Bool("project-breakdown", defaults.Collectors.ProjectBreakdown, "Store the storage statistics of every project in the cloudstats_projects MongoDB collection and ElasticSearch index.")
+	flag.Int("blender-sync-quota-mib", defaults.Collectors.BlenderSyncQuotaMiB, "Home project storage per user in MiB above which users are counted as over quota; 0 disables counting.")
+	flag.Int("file-size-bucket-base", defaults.Collectors.FileSizeBuckets.Base, "Upper bound in bytes of the first bucket of the file size histogram.")
+	flag.Int("file-size-bucket-factor", defaults.Collectors.FileSizeBuckets.Factor, "Factor between the upper bounds of consecutive buckets of the file size histogram.")
+	flag.Int("file-size-bucket-count", defaults.Collectors.FileSizeBuckets.Count, "Number of buckets of the file size histogram, besides the bucket for larger files; 0 disables the histogram.")
+	flag.Int("largest-files", defaults.Collectors.LargestFiles, "Number of largest files to include in the statistics document.")
+	flag.String("link-expiry-windows", durationList(defaults.Collectors.LinkExpiryWindows), "Comma-separated list of periods for which links that expire within them are counted, like \"1h,24h\"; these are also the buckets of the age distribution of expired links.")
+	flag.Duration("run-timeout", defaults.RunTimeout, "Maximum duration of collecting and pushing one statistics document; 0 means no limit.")
+	flag.String("only", "", "Comma-separated list of collectors to run; defaults to all collectors. The result is merged into an existing document with the same timestamp, so this requires -before or -allsince.")
+	flag.String("skip", "", "Comma-separated list of collectors not to run. Their sections are left out of the statistics document.")
+	flag.String("enable", "", "Comma-separated list of optional collectors to run next to the default ones, like \"orphans\".")
+	flag.String("store-url", defaults.Store.URL, "URL of the Blender Store product counter; pass an empty string to not query the store.")
+	flag.String("blenderid-url", defaults.BlenderID.URL, "URL of the Blender ID statistics; pass an empty string to not query Blender ID.")
+	flag.String("blenderid-token", "", "Bearer token to authenticate with Blender ID.")
+	flag.Int("retry-attempts", defaults.Retry.Attempts, "Maximum number of attempts to query the Blender Store and Blender ID.")
+	flag.Duration("retry-delay", defaults.Retry.Delay, "Delay before retrying a failed request to the Blender Store or Blender ID; doubles for every next retry.")
+	flag.Duration("retry-max-delay", defaults.Retry.MaxDelay, "Maximum delay between retries, also when the server asks to wait longer.")
+	cliArgs.blenderIDHeader = headerFlag{}
+	flag.Var(cliArgs.blenderIDHeader, "blenderid-header", "Additional HTTP header to send to Blender ID, as \"Name: value\"; can be given multiple times.")
+	flag.BoolVar(&cliArgs.daemon, "daemon", false, "Keep running, and collect statistics according to the schedule.")
+	flag.String("schedule", defaults.Daemon.Schedule, "Schedule for daemon mode; a cron expression like \"0 4 * * *\" or \"@daily\", or an interval like \"6h\".")
+	flag.Bool("catch-up", defaults.Daemon.CatchUp, "In daemon mode, collect statistics for runs that were missed while the daemon was not running.")
+	flag.BoolVar(&cliArgs.serveMetrics, "serve-metrics", false, "Serve the current statistics as Prometheus metrics, instead of pushing them.")
+	flag.String("metrics-listen", defaults.Metrics.Listen, "Address to serve Prometheus metrics on, when running with -serve-metrics.")
+	flag.BoolVar(&cliArgs.checkMapping, "check-mapping", false, "Compares the mapping of the ElasticSearch index with the expected mapping, then exits.")
+	flag.BoolVar(&cliArgs.listCollectors, "list-collectors", false, "Lists the registered statistics collectors, then exits.")
 	flag.Parse()
+}
+
+// splitList splits a comma-separated list, ignoring empty items.
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
 
-	if cliArgs.mongoStorageURL == "" {
-		cliArgs.mongoStorageURL = cliArgs.mongoURL
+// durationList formats durations as comma-separated list, the inverse of parsing them with
+// splitList.
+func durationList(durations []time.Duration) string {
+	items := make([]string, len(durations))
+	for idx, duration := range durations {
+		items[idx] = duration.String()
 	}
+	return strings.Join(items, ",")
 }
 
 func configLogging() {
@@ -65,37 +200,100 @@ func configLogging() {
 	log.SetLevel(level)
 }
 
-func collectAllSince(session *mgo.Session, beginTimestamp time.Time) error {
-	log.Warningf("Collecting daily statistics since %s, this may take a while", beginTimestamp)
-	now := time.Now().UTC()
-	stepSize := 24 * time.Hour
-	before := beginTimestamp
-	pushCount := 0
+// collectOptions returns the options for collecting statistics before the given timestamp.
+func collectOptions(timestamp *time.Time) pillar.Options {
+	return pillar.Options{
+		Before:      timestamp,
+		Concurrency: config.Collectors.Concurrency,
+		Only:        config.Collectors.Only,
+		Skip:        config.Collectors.Skip,
+		Enable:      config.Collectors.Enable,
+
+		CollectorTimeout:  config.Collectors.Timeout,
+		TopProjects:       config.Collectors.TopProjects,
+		ProjectBreakdown:  config.Collectors.ProjectBreakdown,
+		FileSizeBuckets:   fileSizeBuckets(),
+		LargestFiles:      config.Collectors.LargestFiles,
+		LinkExpiryWindows: config.Collectors.LinkExpiryWindows,
+		BlenderSyncQuota:  int64(config.Collectors.BlenderSyncQuotaMiB) << 20,
+
+		StoreURL:         config.Store.URL,
+		BlenderIDURL:     config.BlenderID.URL,
+		BlenderIDToken:   config.BlenderID.Token,
+		BlenderIDHeaders: blenderIDHeaders(),
+
+		RetryAttempts: config.Retry.Attempts,
+		RetryDelay:    config.Retry.Delay,
+		MaxRetryDelay: config.Retry.MaxDelay,
+	}
+}
 
-	for {
-		if before.After(now) {
-			break
-		}
+// fileSizeBuckets returns the upper bounds of the configured file size histogram.
+func fileSizeBuckets() []int64 {
+	buckets := config.Collectors.FileSizeBuckets
+	if buckets.Count <= 0 {
+		return nil
+	}
+	return pillar.LogBuckets(int64(buckets.Base), buckets.Factor, buckets.Count)
+}
 
-		before = before.Add(stepSize).Round(24 * time.Hour)
-		err := singleRun(session, &before)
-		if err != nil {
-			return fmt.Errorf("running with before=%s: %s", before, err)
-		}
-		pushCount++
+// runContext returns a context that is limited to the configured run timeout.
+func runContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if config.RunTimeout <= 0 {
+		return context.WithCancel(parent)
 	}
+	return context.WithTimeout(parent, config.RunTimeout)
+}
 
-	log.Warnf("Done, pushed %d statistics documents", pushCount)
-	return nil
+// interruptContext returns a context that is cancelled on SIGINT or SIGTERM. After the first
+// signal the default behaviour is restored, so that a second signal stops the process immediately.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.WithField("signal", sig).Warning("cancelling, send the signal again to stop immediately")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
 }
 
-func singleRun(session *mgo.Session, timestamp *time.Time) error {
-	stats, err := pillar.CollectStats(session, timestamp)
+// singleRun collects statistics and pushes them to the sinks. The sinks may buffer the statistics,
+// so the caller should flush or close them afterwards.
+func singleRun(ctx context.Context, session *mgo.Session, output sink.Sink, timestamp *time.Time) error {
+	ctx, cancel := runContext(ctx)
+	defer cancel()
+
+	stats, err := pillar.CollectStatsContext(ctx, session, collectOptions(timestamp))
 	if err != nil {
 		return fmt.Errorf("error collecting statistics: %s", err)
 	}
+	// Statistics for a given timestamp get a deterministic ID, so that collecting them again
+	// replaces the existing documents.
+	if timestamp != nil {
+		stats.ID = elastic.DocumentID(config.Instance, *timestamp)
+	}
+
+	if err := output.Push(ctx, &stats); err != nil {
+		return fmt.Errorf("error pushing statistics: %s", err)
+	}
+	return nil
+}
 
-	return pushStats(session, stats)
+// blenderIDHeaders returns the configured Blender ID headers as http.Header.
+func blenderIDHeaders() http.Header {
+	headers := http.Header{}
+	for name, values := range config.BlenderID.Headers {
+		for _, value := range values {
+			headers.Add(name, value)
+		}
+	}
+	return headers
 }
 
 func importFromElastic(mgoWrite *mgo.Session) error {
@@ -103,77 +301,232 @@ func importFromElastic(mgoWrite *mgo.Session) error {
 	return nil
 }
 
-func pushStats(session *mgo.Session, stats elastic.Stats) error {
-	if cliArgs.nopush {
-		// Marshal the stats to JSON and log.
-		asJSON, err := json.MarshalIndent(&stats, "", "    ")
-		if err != nil {
-			return fmt.Errorf("unable to marshal to JSON: %s", err)
+// hasSink returns whether the statistics should be pushed to the named sink.
+func hasSink(name string) bool {
+	for _, sink := range config.Sinks {
+		if sink == name {
+			return true
 		}
-		log.Infof("Statistics:\n%s\n", string(asJSON))
-		log.Warning("Not pushing to ElasticSearch")
-		return nil
 	}
+	return false
+}
 
-	if err := mongo.Push(session, &stats); err != nil {
-		return fmt.Errorf("error pushing to MongoDB: %s", err)
+// sinkPolicy returns whether failing to push to the named sink should fail the run.
+func sinkPolicy(name string) sink.Policy {
+	for _, required := range config.RequiredSinks {
+		if required == name {
+			return sink.Required
+		}
 	}
+	return sink.BestEffort
+}
 
-	_, err := elastic.Push(cliArgs.elasticURL, stats)
-	if err != nil {
-		return fmt.Errorf("error pushing to ElasticSearch: %s", err)
+// influxBatchSize is the maximum number of documents sent to InfluxDB in one request.
+const influxBatchSize = 100
+
+// newSinks returns the configured sinks, except the excluded one. With bulk=true, ElasticSearch
+// is pushed to in batches, which is faster when pushing many documents. When running with
+// -nopush, the statistics are only logged.
+func newSinks(mgoStats *mgo.Session, exclude string, bulk bool) (*sink.Fanout, error) {
+	output := sink.NewFanout()
+	if cliArgs.nopush {
+		log.Warning("not pushing statistics, only logging them")
+		output.Add("log", sink.NewLog(), sink.Required)
+		return output, nil
 	}
 
-	return nil
+	// The MongoDB sink merges partial documents into existing ones, so it has to come first for
+	// the other sinks to receive the merged document.
+	names := append([]string{}, config.Sinks...)
+	sort.SliceStable(names, func(i, j int) bool { return names[i] == "mongo" && names[j] != "mongo" })
+
+	for _, name := range names {
+		if name == exclude {
+			continue
+		}
+		switch name {
+		case "mongo":
+			output.Add(name, sink.NewMongo(mgoStats), sinkPolicy(name))
+		case "elastic":
+			if !bulk {
+				output.Add(name, sink.NewElastic(config.Elastic.URL), sinkPolicy(name))
+				break
+			}
+			bulkSink, err := sink.NewElasticBulk(config.Elastic.URL, bulkOptions())
+			if err != nil {
+				return nil, fmt.Errorf("unable to create ElasticSearch sink: %s", err)
+			}
+			output.Add(name, bulkSink, sinkPolicy(name))
+		case "influx":
+			output.Add(name, sink.NewInflux(config.Influx.URL, influxBatchSize), sinkPolicy(name))
+		}
+	}
+	return output, nil
 }
 
-func connectMongoDB() (mgoCloud, mgoStats *mgo.Session) {
-	var err error
+// bulkOptions returns the configured options for pushing to ElasticSearch in batches.
+func bulkOptions() elastic.BulkOptions {
+	options := elastic.DefaultBulkOptions()
+	options.BatchSize = config.Elastic.BulkSize
+	options.FlushInterval = config.Elastic.FlushInterval
+	return options
+}
 
-	if cliArgs.mongoStorageURL == "" || cliArgs.mongoStorageURL == cliArgs.mongoURL {
-		log.WithField("url", cliArgs.mongoURL).Info("connecting to MongoDB for cloud+stats")
-		mgoCloud, err = mgo.Dial(cliArgs.mongoURL)
+// connectMongoDB connects to the MongoDB database(s). When no separate storage URL is configured,
+// mgoStats is the same session as mgoCloud.
+func connectMongoDB() (mgoCloud, mgoStats *mgo.Session, err error) {
+	if config.Mongo.StorageURL == "" || config.Mongo.StorageURL == config.Mongo.URL {
+		log.WithField("url", redactURL(config.Mongo.URL)).Info("connecting to MongoDB for cloud+stats")
+		mgoCloud, err = mgo.Dial(config.Mongo.URL)
 		if err != nil {
-			log.Panic(err)
+			return nil, nil, fmt.Errorf("unable to connect to MongoDB: %s", err)
 		}
 		mgoCloud.SetMode(mgo.Monotonic, true)
-		mgoStats = mgoCloud
-		return
+		return mgoCloud, mgoCloud, nil
 	}
 
-	log.WithField("url", cliArgs.mongoURL).Info("connecting to MongoDB for cloud")
-	mgoCloud, err = mgo.Dial(cliArgs.mongoURL)
+	log.WithField("url", redactURL(config.Mongo.URL)).Info("connecting to MongoDB for cloud")
+	mgoCloud, err = mgo.Dial(config.Mongo.URL)
 	if err != nil {
-		log.Panic(err)
+		return nil, nil, fmt.Errorf("unable to connect to MongoDB for cloud: %s", err)
 	}
 
-	log.WithField("url", cliArgs.mongoStorageURL).Info("connecting to MongoDB for stats")
-	mgoStats, err = mgo.Dial(cliArgs.mongoStorageURL)
+	log.WithField("url", redactURL(config.Mongo.StorageURL)).Info("connecting to MongoDB for stats")
+	mgoStats, err = mgo.Dial(config.Mongo.StorageURL)
 	if err != nil {
-		log.Panic(err)
+		mgoCloud.Close()
+		return nil, nil, fmt.Errorf("unable to connect to MongoDB for stats: %s", err)
 	}
 	mgoCloud.SetMode(mgo.Monotonic, true)
 	mgoStats.SetMode(mgo.Monotonic, true)
 
-	return
+	return mgoCloud, mgoStats, nil
 }
 
-func reverseToMongo(mgoStats *mgo.Session) {
-	ch := elastic.ReverseImport(cliArgs.elasticURL)
+func reverseToMongo(ctx context.Context, mgoStats *mgo.Session) error {
+	hits, errs := elastic.ReverseImportContext(ctx, config.Elastic.URL)
 	log.Debug("waiting for documents to arrive on the channel")
-	for hit := range ch {
-		mongo.PushHit(mgoStats, hit)
+	var pushErr error
+	for hit := range hits {
+		// Keep draining the channel after an error, so that the import goroutine can finish.
+		if pushErr != nil {
+			continue
+		}
+		pushErr = mongo.PushHit(mgoStats, hit)
+	}
+	if err := <-errs; err != nil {
+		return fmt.Errorf("unable to reverse-import: %s", err)
+	}
+	if pushErr != nil {
+		return fmt.Errorf("unable to reverse-import: %s", pushErr)
 	}
 	log.Info("done reverse-importing")
+	return nil
 }
 
-func reindex(mgoStats *mgo.Session) {
-	ch := mongo.All(mgoStats)
+// reindex replays all statistics stored in MongoDB into the other sinks.
+func reindex(ctx context.Context, mgoStats *mgo.Session) error {
+	output, err := newSinks(mgoStats, "mongo", true)
+	if err != nil {
+		return err
+	}
+	if output.Len() == 0 {
+		return errors.New("-reindex requires the elastic and/or influx sink")
+	}
+	docs, errs := mongo.AllContext(ctx, mgoStats)
 	log.Debug("waiting for documents to arrive on the channel")
-	for stats := range ch {
-		elastic.Push(cliArgs.elasticURL, stats)
+	var pushErr error
+	for doc := range docs {
+		// Keep draining the channel after an error, so that the query goroutine can finish.
+		if pushErr != nil {
+			continue
+		}
+		stats, err := statsFromBSON(doc)
+		if err != nil {
+			log.WithError(err).WithField("id", doc["_id"]).Error("unable to convert document, skipping")
+			continue
+		}
+		pushErr = output.Push(ctx, &stats)
+	}
+	if closeErr := output.Close(); pushErr == nil {
+		pushErr = closeErr
+	}
+	if err := <-errs; err != nil {
+		return fmt.Errorf("unable to reindex: %s", err)
+	}
+	if pushErr != nil {
+		return fmt.Errorf("unable to reindex: %s", pushErr)
 	}
 	log.Info("done reindexing")
+	return nil
+}
+
+// statsFromBSON converts a document from MongoDB to a Stats struct. String IDs are kept, so that
+// documents that were reverse-imported from ElasticSearch keep their ElasticSearch ID.
+func statsFromBSON(doc bson.M) (elastic.Stats, error) {
+	stats := elastic.Stats{}
+	if _, isString := doc["_id"].(string); !isString {
+		delete(doc, "_id")
+	}
+	asBSON, err := bson.Marshal(doc)
+	if err != nil {
+		return stats, err
+	}
+	err = bson.Unmarshal(asBSON, &stats)
+	return stats, err
+}
+
+// ensureTemplate installs the ElasticSearch index template, when statistics are pushed there.
+func ensureTemplate() {
+	if cliArgs.nopush || !hasSink("elastic") {
+		return
+	}
+	err := elastic.EnsureTemplate(config.Elastic.URL)
+	if err == nil {
+		return
+	}
+	if sinkPolicy("elastic") == sink.Required {
+		log.WithError(err).Fatal("unable to install ElasticSearch index template")
+	}
+	log.WithError(err).Warning("unable to install ElasticSearch index template")
+}
+
+// checkMapping shows the differences between the live and the expected ElasticSearch mapping.
+// Returns an error when there are differences.
+func checkMapping() error {
+	differences, err := elastic.CheckMapping(config.Elastic.URL)
+	if err != nil {
+		return err
+	}
+	if len(differences) == 0 {
+		fmt.Println("The ElasticSearch mapping is as expected.")
+		return nil
+	}
+	for _, difference := range differences {
+		fmt.Println(difference)
+	}
+	return fmt.Errorf("%d fields are not mapped as expected; use -reset -reindex to fix", len(differences))
+}
+
+func listCollectors() {
+	collectors, err := pillar.Collectors()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, coll := range collectors {
+		notes := []string{}
+		if dependencies := coll.Dependencies(); len(dependencies) > 0 {
+			notes = append(notes, "depends on "+strings.Join(dependencies, ", "))
+		}
+		if optional, ok := coll.(pillar.OptionalCollector); ok && optional.Optional() {
+			notes = append(notes, "optional")
+		}
+		if len(notes) == 0 {
+			fmt.Println(coll.Name())
+			continue
+		}
+		fmt.Printf("%s (%s)\n", coll.Name(), strings.Join(notes, "; "))
+	}
 }
 
 func main() {
@@ -182,34 +535,150 @@ func main() {
 		fmt.Println(statscollectorVersion)
 		return
 	}
+	if cliArgs.listCollectors {
+		listCollectors()
+		return
+	}
 
 	configLogging()
-	mgoCloud, mgoStats := connectMongoDB()
+
+	var err error
+	config, err = loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %s", err)
+	}
+	if cliArgs.printConfig {
+		if err := printConfig(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := applyConfig(config); err != nil {
+		log.Fatal(err)
+	}
+
+	if cliArgs.checkMapping {
+		if err := checkMapping(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	mgoCloud, mgoStats, err := connectMongoDB()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	if cliArgs.reverseToMongo && cliArgs.reindex {
 		log.Fatal("-reverse and -reindex are mutually exclusive")
 	}
 
-	if cliArgs.elasticURL[len(cliArgs.elasticURL)-1] != '/' {
-		log.WithField("url", cliArgs.elasticURL).Fatal("Elastic URL must end in a slash")
+	// The ElasticSearch URL is only used when pushing there, or when managing the index.
+	usesElastic := hasSink("elastic") || cliArgs.resetIndex || cliArgs.reverseToMongo
+	if usesElastic && !strings.HasSuffix(config.Elastic.URL, "/") {
+		log.WithField("url", config.Elastic.URL).Fatal("Elastic URL must end in a slash")
 	}
 
 	if cliArgs.reverseToMongo {
-		reverseToMongo(mgoStats)
+		ctx, cancel := interruptContext()
+		defer cancel()
+		if err := reverseToMongo(ctx, mgoStats); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if cliArgs.orphansReport != "" {
+		if cliArgs.daemon || cliArgs.serveMetrics || cliArgs.allSince != "" || cliArgs.resetIndex || cliArgs.reindex || cliArgs.fillGaps {
+			log.Fatal("-orphans-report cannot be combined with -daemon, -serve-metrics, -allsince, -reset, -reindex or -fill-gaps")
+		}
+		var before *time.Time
+		if cliArgs.before != "" {
+			parsed, parseErr := time.Parse(time.RFC3339, cliArgs.before)
+			if parseErr != nil {
+				log.Fatalf("Invalid argument -before %q: %s", cliArgs.before, parseErr)
+			}
+			before = &parsed
+		}
+		ctx, cancel := interruptContext()
+		defer cancel()
+		if err := writeOrphansReport(ctx, mgoCloud, cliArgs.orphansReport, cliArgs.orphansFormat, before); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if cliArgs.serveMetrics {
+		if cliArgs.daemon || cliArgs.before != "" || cliArgs.allSince != "" || cliArgs.resetIndex || cliArgs.reindex || cliArgs.fillGaps {
+			log.Fatal("-serve-metrics cannot be combined with -daemon, -before, -allsince, -reset, -reindex or -fill-gaps")
+		}
+		ctx, cancel := interruptContext()
+		defer cancel()
+		if err := serveMetrics(ctx, mgoCloud); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Partial documents are merged into the document with the same timestamp, which only exists
+	// when collecting for a given timestamp.
+	collecting := !cliArgs.fillGaps && !cliArgs.resetIndex && !cliArgs.reindex
+	if collecting && len(config.Collectors.Only) > 0 && cliArgs.before == "" && cliArgs.allSince == "" {
+		log.Fatal("-only requires -before or -allsince, to merge into the documents with that timestamp")
+	}
+
+	// Resetting deletes the index, so then the template is installed afterwards. This also means
+	// that a conflicting mapping of the index that is about to be deleted is not updated.
+	if !cliArgs.resetIndex {
+		ensureTemplate()
+	}
+
+	if cliArgs.daemon {
+		if cliArgs.before != "" || cliArgs.allSince != "" || cliArgs.resetIndex || cliArgs.reindex || cliArgs.fillGaps {
+			log.Fatal("-daemon cannot be combined with -before, -allsince, -reset, -reindex or -fill-gaps")
+		}
+		if err := runDaemon(mgoCloud, mgoStats); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// The daemon handles signals itself.
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	if cliArgs.fillGaps {
+		if cliArgs.before != "" || cliArgs.allSince != "" || cliArgs.resetIndex || cliArgs.reindex {
+			log.Fatal("-fill-gaps cannot be combined with -before, -allsince, -reset or -reindex")
+		}
+		if err := fillGaps(ctx, mgoStats); err != nil {
+			log.Fatal(err)
+		}
 		return
 	}
 
 	if cliArgs.resetIndex || cliArgs.reindex {
 		if cliArgs.resetIndex {
-			elastic.ResetIndex(cliArgs.elasticURL)
+			if err := elastic.ResetIndex(config.Elastic.URL); err != nil {
+				log.Fatal(err)
+			}
+			ensureTemplate()
 		}
 		if cliArgs.reindex {
-			reindex(mgoStats)
+			if err := reindex(ctx, mgoStats); err != nil {
+				log.Fatal(err)
+			}
 		}
 		return
 	}
 
-	var err error
+	output, err := newSinks(mgoStats, "", cliArgs.allSince != "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cliArgs.until != "" && cliArgs.allSince == "" {
+		log.Fatal("-until can only be used with -allsince")
+	}
 	if cliArgs.allSince != "" {
 		if cliArgs.before != "" {
 			log.Fatalf("Use either -before or -allsince, not both.")
@@ -219,19 +688,34 @@ func main() {
 		if parseErr != nil {
 			log.Fatalf("Invalid argument -allsince %q: %s", cliArgs.allSince, parseErr)
 		}
+		untilTimestamp := time.Now().UTC()
+		if cliArgs.until != "" {
+			untilTimestamp, parseErr = time.Parse(time.RFC3339, cliArgs.until)
+			if parseErr != nil {
+				log.Fatalf("Invalid argument -until %q: %s", cliArgs.until, parseErr)
+			}
+		}
+		step, stepErr := parseStep(cliArgs.step)
+		if stepErr != nil {
+			log.Fatalf("Invalid argument -step: %s", stepErr)
+		}
 
-		err = collectAllSince(mgoCloud, beginTimestamp)
+		err = backfill(ctx, mgoCloud, mgoStats, output, beginTimestamp, untilTimestamp, step)
 	} else {
 		if cliArgs.before == "" {
-			err = singleRun(mgoCloud, nil)
+			err = singleRun(ctx, mgoCloud, output, nil)
 		} else {
 			parsed, parseErr := time.Parse(time.RFC3339, cliArgs.before)
 			if parseErr != nil {
 				log.Fatalf("Invalid argument -before %q: %s", cliArgs.before, parseErr)
 			}
-			err = singleRun(mgoCloud, &parsed)
+			err = singleRun(ctx, mgoCloud, output, &parsed)
 		}
 	}
+	// Close the sinks also after a failure, so that their buffered documents are still pushed.
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
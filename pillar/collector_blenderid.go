@@ -1,6 +1,7 @@
 package pillar
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -9,33 +10,70 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// Connects to Blender ID to fetch user stats.
-func (c *collector) countBlenderID(blenderIDURL string) error {
-	log.WithField("url", blenderIDURL).Info("connecting to Blender ID")
+func init() {
+	Register(&builtinCollector{name: "blenderid", collect: func(c *collector) error {
+		// Blender ID can be unreachable at times; in that case we just omit its statistics.
+		if err := c.countBlenderID(); err != nil {
+			return Ignore(err)
+		}
+		return nil
+	}})
+}
 
-	resp, err := http.Get(blenderIDURL)
+// Connects to Blender ID to fetch user stats.
+// The token and headers from the options are optional, and are used to authenticate with Blender ID.
+func (c *collector) countBlenderID() error {
+	blenderID, attempts, err := FetchBlenderID(c.ctx, *c.target.options)
 	if err != nil {
-		return fmt.Errorf("error getting Blender ID stats: %s", err)
+		return err
+	}
+	c.update(func(stats *elastic.Stats) { stats.BlenderID = blenderID })
+	c.recordAttempts("blenderid", attempts)
+	return nil
+}
+
+// FetchBlenderID gets the current user statistics from Blender ID, as configured in the options.
+// Failed requests are retried; the number of attempts is returned as well.
+func FetchBlenderID(ctx context.Context, options Options) (*elastic.BlenderID, int, error) {
+	log.WithField("url", options.BlenderIDURL).Info("connecting to Blender ID")
+
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", options.BlenderIDURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range options.BlenderIDHeaders {
+			for _, value := range values {
+				req.Header.Add(name, value)
+			}
+		}
+		if options.BlenderIDToken != "" {
+			req.Header.Set("Authorization", "Bearer "+options.BlenderIDToken)
+		}
+		return req, nil
 	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("error %d getting Blender ID stats", resp.StatusCode)
+
+	body, attempts, err := getWithRetry(ctx, httpClient, options.retryPolicy(), newRequest)
+	if err != nil {
+		return nil, attempts, fmt.Errorf("error getting Blender ID stats after %d attempts: %s", attempts, err)
 	}
 
 	var blenderIDData blenderIDResponse
-	decoder := json.NewDecoder(resp.Body)
-	if err := decoder.Decode(&blenderIDData); err != nil {
-		return fmt.Errorf("error decoding response from Blender ID: %s", err)
+	if err := json.Unmarshal(body, &blenderIDData); err != nil {
+		return nil, attempts, fmt.Errorf("error decoding response from Blender ID: %s", err)
 	}
 
-	c.stats.BlenderID = &elastic.BlenderID{
+	blenderID := &elastic.BlenderID{
 		ConfirmedEmailCount:   blenderIDData.Users.ConfirmedEmailCount,
 		UnconfirmedEmailCount: blenderIDData.Users.UnconfirmedEmailCount,
 		TotalCount:            blenderIDData.Users.TotalCount,
-		PrivacyPolicyAgreed: elastic.BlenderIDPrivacyPolicy{
-			Latest:   blenderIDData.Users.PrivacyPolicyAgreed.Latest,
-			Obsolete: blenderIDData.Users.PrivacyPolicyAgreed.Obsolete,
-			Never:    blenderIDData.Users.PrivacyPolicyAgreed.Never,
-		},
 	}
-	return nil
+	if pp := blenderIDData.Users.PrivacyPolicyAgreed; pp != nil {
+		blenderID.PrivacyPolicyAgreed = elastic.BlenderIDPrivacyPolicy{
+			Latest:   pp.Latest,
+			Obsolete: pp.Obsolete,
+			Never:    pp.Never,
+		}
+	}
+	return blenderID, attempts, nil
 }
@@ -3,7 +3,9 @@ package pillar
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 
+	"github.com/armadillica/pillar-statscollector/elastic"
 	"github.com/stretchr/testify/assert"
 
 	log "github.com/sirupsen/logrus"
@@ -35,6 +37,21 @@ func (s *CollectorBIDTestSuite) TearDownTest(c *check.C) {
 	httpmock.DeactivateAndReset()
 }
 
+const testBlenderIDURL = "http://id.test/api/stats"
+
+func (s *CollectorBIDTestSuite) collect(t *check.C, token string, headers http.Header) elastic.Stats {
+	options := DefaultOptions()
+	options.StoreURL = ""
+	options.BlenderIDURL = testBlenderIDURL
+	options.BlenderIDToken = token
+	options.BlenderIDHeaders = headers
+	options.RetryDelay = time.Millisecond
+
+	stats, err := CollectStatsWithOptions(s.session, options)
+	assert.Nil(t, err)
+	return stats
+}
+
 func (s *CollectorBIDTestSuite) TestBIDRequestHappy(t *check.C) {
 	resp := blenderIDResponse{
 		Users: blenderIDUsers{
@@ -50,14 +67,9 @@ func (s *CollectorBIDTestSuite) TestBIDRequestHappy(t *check.C) {
 	}
 	responder, err := httpmock.NewJsonResponder(200, resp)
 	assert.Nil(t, err)
-	httpmock.RegisterResponder(
-		"GET", "https://www.blender.org/id/api/stats",
-		responder,
-	)
+	httpmock.RegisterResponder("GET", testBlenderIDURL, responder)
 
-	stats, err := CollectStats(s.session, nil)
-
-	assert.Nil(t, err)
+	stats := s.collect(t, "", nil)
 	if stats.BlenderID == nil {
 		assert.Fail(t, "stats.BlenderID is unexpectedly nil")
 		return
@@ -73,13 +85,13 @@ func (s *CollectorBIDTestSuite) TestBIDRequestHappy(t *check.C) {
 func (s *CollectorBIDTestSuite) TestBIDRequestUnhappy(t *check.C) {
 	httpmock.RegisterResponder(
 		"GET",
-		"https://www.blender.org/id/api/stats",
+		testBlenderIDURL,
 		httpmock.NewErrorResponder(http.ErrHandlerTimeout),
 	)
 
-	stats, err := CollectStats(s.session, nil)
-	assert.Nil(t, err)
+	stats := s.collect(t, "", nil)
 	assert.Nil(t, stats.BlenderID)
+	assert.NotContains(t, stats.Sections, "blenderid")
 
 	// Marshalling to JSON should exclude the Blender ID stats.
 	jsonBytes, err := json.Marshal(stats)
@@ -89,3 +101,21 @@ func (s *CollectorBIDTestSuite) TestBIDRequestUnhappy(t *check.C) {
 	_, ok := unmarshalled["blender_id"]
 	assert.False(t, ok)
 }
+
+func (s *CollectorBIDTestSuite) TestBIDRequestAuthenticated(t *check.C) {
+	httpmock.RegisterResponder("GET", testBlenderIDURL,
+		func(req *http.Request) (*http.Response, error) {
+			assert.Equal(t, "Bearer s3cr3t", req.Header.Get("Authorization"))
+			assert.Equal(t, "statscollector", req.Header.Get("X-Client"))
+			return httpmock.NewJsonResponse(200, blenderIDResponse{
+				Users: blenderIDUsers{TotalCount: 47},
+			})
+		})
+
+	stats := s.collect(t, "s3cr3t", http.Header{"X-Client": []string{"statscollector"}})
+	if stats.BlenderID == nil {
+		assert.Fail(t, "stats.BlenderID is unexpectedly nil")
+		return
+	}
+	assert.Equal(t, 47, stats.BlenderID.TotalCount)
+}
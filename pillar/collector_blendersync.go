@@ -0,0 +1,218 @@
+package pillar
+
+import (
+	"strings"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// syncGroupName is the name of the group node in home projects that contains the synced Blender
+// settings, with a subgroup per Blender version.
+const syncGroupName = "Blender Sync"
+
+// homeProjectSizeBuckets are the upper bounds of the histogram of home project storage.
+// Larger home projects are counted in the "more" bucket.
+var homeProjectSizeBuckets = []struct {
+	label string
+	max   int64
+}{
+	{"empty", 0},
+	{"1MiB", 1 << 20},
+	{"10MiB", 10 << 20},
+	{"100MiB", 100 << 20},
+	{"1GiB", 1 << 30},
+	{"10GiB", 10 << 30},
+}
+
+// sizeBucket returns the histogram bucket for a home project of the given size.
+func sizeBucket(bytes int64) string {
+	for _, bucket := range homeProjectSizeBuckets {
+		if bytes <= bucket.max {
+			return bucket.label
+		}
+	}
+	return "more"
+}
+
+// versionKey returns the map key for a Blender version. Dots would be interpreted as paths by
+// MongoDB and ElasticSearch, so they are replaced by underscores.
+func versionKey(version string) string {
+	if version == "" {
+		return noValueString
+	}
+	return strings.Replace(version, ".", "_", -1)
+}
+
+// syncGroupsPipeline returns the pipeline stages that find the version groups of the Blender Sync
+// groups in home projects, as "version" field. The home projects are filtered the same way as in
+// homeProjectStorage, so that every synced project is one user.
+func (c *collector) syncGroupsPipeline() []m {
+	return []m{
+		m{"$match": m{
+			"_deleted":  m{"$ne": true},
+			"node_type": "group",
+			"name":      syncGroupName,
+			"parent":    nil,
+		}},
+		m{"$lookup": m{
+			"from":         "projects",
+			"localField":   "project",
+			"foreignField": "_id",
+			"as":           "home_project",
+		}},
+		m{"$unwind": m{"path": "$home_project"}},
+		m{"$match": c.joinedQuery("home_project", m{
+			"home_project.category": "home",
+			"home_project._deleted": m{"$ne": true},
+		})},
+		m{"$lookup": m{
+			"from":         "nodes",
+			"localField":   "_id",
+			"foreignField": "parent",
+			"as":           "version",
+		}},
+		m{"$unwind": m{"path": "$version"}},
+		m{"$match": m{
+			"version._deleted":  m{"$ne": true},
+			"version.node_type": "group",
+		}},
+	}
+}
+
+func (c *collector) blenderSyncUsage() error {
+	log.Info("Aggregating Blender Sync usage")
+
+	blenderSync := &elastic.BlenderSync{
+		UserCountPerVersion:     map[string]int{},
+		HomeProjectCountPerSize: map[string]int{},
+		Quota:                   c.target.options.BlenderSyncQuota,
+	}
+	if err := c.blenderSyncVersions(blenderSync); err != nil {
+		return err
+	}
+	if err := c.blenderSyncBytes(blenderSync); err != nil {
+		return err
+	}
+	if err := c.homeProjectStorage(blenderSync); err != nil {
+		return err
+	}
+
+	c.update(func(stats *elastic.Stats) { stats.Users.BlenderSync = blenderSync })
+	return nil
+}
+
+// blenderSyncVersions counts the users that synced their settings per Blender version.
+func (c *collector) blenderSyncVersions(blenderSync *elastic.BlenderSync) error {
+	var perVersionResult struct {
+		Version string `bson:"_id"`
+		Users   int    `bson:"users"`
+	}
+
+	pipeline := append(c.syncGroupsPipeline(),
+		// Group per version and project (drops any duplicates).
+		m{"$group": m{"_id": m{"version": "$version.name", "project": "$project"}}},
+		m{"$group": m{
+			"_id":   "$_id.version",
+			"users": m{"$sum": 1},
+		}},
+	)
+	iter := c.nodesColl.Pipe(c.aggrPipe(pipeline)).Iter()
+	for iter.Next(&perVersionResult) {
+		blenderSync.UserCountPerVersion[versionKey(perVersionResult.Version)] += perVersionResult.Users
+	}
+	return iter.Close()
+}
+
+// blenderSyncBytes sums the size of the synced files.
+func (c *collector) blenderSyncBytes(blenderSync *elastic.BlenderSync) error {
+	var result struct {
+		TotalBytes int64 `bson:"total_bytes"`
+	}
+
+	pipeline := append(c.syncGroupsPipeline(),
+		// Join the assets in the version groups, and their files.
+		m{"$lookup": m{
+			"from":         "nodes",
+			"localField":   "version._id",
+			"foreignField": "parent",
+			"as":           "asset",
+		}},
+		m{"$unwind": m{"path": "$asset"}},
+		m{"$match": m{"asset._deleted": m{"$ne": true}}},
+		m{"$lookup": m{
+			"from":         "files",
+			"localField":   "asset.properties.file",
+			"foreignField": "_id",
+			"as":           "file",
+		}},
+		m{"$unwind": m{"path": "$file"}},
+		m{"$group": m{
+			"_id":         nil,
+			"total_bytes": m{"$sum": "$file.length_aggregate_in_bytes"},
+		}},
+	)
+	err := c.nodesColl.Pipe(c.aggrPipe(pipeline)).One(&result)
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	blenderSync.SyncedBytes = result.TotalBytes
+	return nil
+}
+
+// homeProjectStorage computes the histogram of storage per home project, and counts the users
+// whose home project exceeds the quota. Every user has at most one home project.
+func (c *collector) homeProjectStorage(blenderSync *elastic.BlenderSync) error {
+	var perProjectResult struct {
+		TotalBytes int64 `bson:"total_bytes"`
+	}
+
+	homeProjectQuery := c.query(m{"category": "home", "_deleted": m{"$ne": true}})
+	homeProjectCount, err := c.projColl.Find(homeProjectQuery).Count()
+	if err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+
+	pipe := c.filesColl.Pipe(c.aggrPipe([]m{
+		m{"$group": m{
+			"_id":         "$project",
+			"total_bytes": m{"$sum": "$length_aggregate_in_bytes"},
+		}},
+		m{"$lookup": m{
+			"from":         "projects",
+			"localField":   "_id",
+			"foreignField": "_id",
+			"as":           "project",
+		}},
+		m{"$unwind": m{"path": "$project"}},
+		// Filter the projects the same way as homeProjectQuery, so that the projects with files
+		// are a subset of the counted ones.
+		m{"$match": c.joinedQuery("project", m{
+			"project.category": "home",
+			"project._deleted": m{"$ne": true},
+		})},
+		m{"$project": m{"total_bytes": 1}},
+	}))
+	iter := pipe.Iter()
+
+	withFiles := 0
+	for iter.Next(&perProjectResult) {
+		bytes := perProjectResult.TotalBytes
+		withFiles++
+		blenderSync.HomeProjectBytes += bytes
+		blenderSync.HomeProjectCountPerSize[sizeBucket(bytes)]++
+		if blenderSync.Quota > 0 && bytes > blenderSync.Quota {
+			blenderSync.OverQuotaCount++
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	// Home projects without files don't show up in the aggregation.
+	if empty := homeProjectCount - withFiles; empty > 0 {
+		blenderSync.HomeProjectCountPerSize[sizeBucket(0)] += empty
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package pillar
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type BlenderSyncBucketsTestSuite struct{}
+
+var _ = check.Suite(&BlenderSyncBucketsTestSuite{})
+
+func (s *BlenderSyncBucketsTestSuite) TestSizeBucket(t *check.C) {
+	assert.Equal(t, "empty", sizeBucket(0))
+	assert.Equal(t, "1MiB", sizeBucket(1))
+	assert.Equal(t, "1MiB", sizeBucket(1<<20))
+	assert.Equal(t, "10MiB", sizeBucket(1<<20+1))
+	assert.Equal(t, "10GiB", sizeBucket(10<<30))
+	assert.Equal(t, "more", sizeBucket(10<<30+1))
+}
+
+func (s *BlenderSyncBucketsTestSuite) TestVersionKey(t *check.C) {
+	assert.Equal(t, "2_79", versionKey("2.79"))
+	assert.Equal(t, "2_80_beta", versionKey("2.80.beta"))
+	assert.Equal(t, "-none-", versionKey(""))
+}
+
+type CollectorBlenderSyncTestSuite struct {
+	session *mgo.Session
+}
+
+var _ = check.Suite(&CollectorBlenderSyncTestSuite{})
+
+func (s *CollectorBlenderSyncTestSuite) SetUpTest(c *check.C) {
+	session, err := mgo.Dial("mongodb://localhost/unittests")
+	if err != nil {
+		log.Panic(err)
+	}
+	s.session = session
+}
+
+func (s *CollectorBlenderSyncTestSuite) TearDownTest(c *check.C) {
+	s.session.DB("").DropDatabase()
+	s.session.Close()
+}
+
+// homeProject creates a home project with Blender Sync groups for the given versions, each
+// containing a startup.blend of the given size, and returns the project ID.
+func (s *CollectorBlenderSyncTestSuite) homeProject(t *check.C, size int64, versions ...string) bson.ObjectId {
+	db := s.session.DB("")
+	project := bson.NewObjectId()
+	assert.Nil(t, db.C("projects").Insert(bson.M{"_id": project, "category": "home", "is_private": true}))
+	if len(versions) == 0 {
+		return project
+	}
+
+	syncGroup := bson.NewObjectId()
+	assert.Nil(t, db.C("nodes").Insert(bson.M{
+		"_id": syncGroup, "project": project, "node_type": "group", "name": syncGroupName,
+	}))
+	for _, version := range versions {
+		versionGroup := bson.NewObjectId()
+		file := bson.NewObjectId()
+		assert.Nil(t, db.C("files").Insert(bson.M{
+			"_id": file, "project": project, "length_aggregate_in_bytes": size,
+		}))
+		assert.Nil(t, db.C("nodes").Insert(
+			bson.M{"_id": versionGroup, "project": project, "node_type": "group", "name": version, "parent": syncGroup},
+			bson.M{"project": project, "node_type": "asset", "name": "startup.blend", "parent": versionGroup,
+				"properties": bson.M{"file": file}},
+		))
+	}
+	return project
+}
+
+func (s *CollectorBlenderSyncTestSuite) TestBlenderSync(t *check.C) {
+	s.homeProject(t, 1000, "2.79", "2.80")
+	s.homeProject(t, 2<<30, "2.79")
+	s.homeProject(t, 0)
+
+	options := DefaultOptions()
+	options.Only = []string{"blendersync"}
+	stats, err := CollectStatsWithOptions(s.session, options)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2, stats.Users.BlenderSyncCount)
+	sync := stats.Users.BlenderSync
+	if assert.NotNil(t, sync) {
+		assert.Equal(t, map[string]int{"2_79": 2, "2_80": 1}, sync.UserCountPerVersion)
+		assert.Equal(t, int64(2000+2<<30), sync.SyncedBytes)
+		assert.Equal(t, int64(2000+2<<30), sync.HomeProjectBytes)
+		assert.Equal(t, map[string]int{"empty": 1, "1MiB": 1, "10GiB": 1}, sync.HomeProjectCountPerSize)
+		assert.Equal(t, 1, sync.OverQuotaCount)
+		assert.Equal(t, int64(DefaultBlenderSyncQuota), sync.Quota)
+	}
+}
+
+func (s *CollectorBlenderSyncTestSuite) TestOnlyHomeProjects(t *check.C) {
+	s.homeProject(t, 1000, "2.79")
+	project := s.homeProject(t, 1000, "2.79")
+	// A Blender Sync group in a regular project is not a user's synced settings.
+	db := s.session.DB("")
+	assert.Nil(t, db.C("projects").UpdateId(project, bson.M{"$set": bson.M{"category": "film"}}))
+
+	options := DefaultOptions()
+	options.Only = []string{"blendersync"}
+	stats, err := CollectStatsWithOptions(s.session, options)
+	assert.Nil(t, err)
+
+	sync := stats.Users.BlenderSync
+	if assert.NotNil(t, sync) {
+		assert.Equal(t, map[string]int{"2_79": 1}, sync.UserCountPerVersion)
+		assert.Equal(t, int64(1000), sync.SyncedBytes)
+	}
+}
+
+func (s *CollectorBlenderSyncTestSuite) TestHomeProjectsBefore(t *check.C) {
+	db := s.session.DB("")
+	before := time.Date(2018, 7, 4, 0, 0, 0, 0, time.UTC)
+	old := before.Add(-24 * time.Hour)
+	for _, created := range []time.Time{old, before.Add(time.Hour)} {
+		project := bson.NewObjectId()
+		assert.Nil(t, db.C("projects").Insert(bson.M{"_id": project, "_created": created, "category": "home"}))
+		// The files are older than the project they are moved to.
+		assert.Nil(t, db.C("files").Insert(bson.M{"project": project, "_created": old, "length_aggregate_in_bytes": 1000}))
+	}
+
+	options := DefaultOptions()
+	options.Only = []string{"blendersync"}
+	options.Before = &before
+	stats, err := CollectStatsWithOptions(s.session, options)
+	assert.Nil(t, err)
+
+	sync := stats.Users.BlenderSync
+	if assert.NotNil(t, sync) {
+		assert.Equal(t, int64(1000), sync.HomeProjectBytes)
+		assert.Equal(t, map[string]int{"1MiB": 1}, sync.HomeProjectCountPerSize)
+	}
+}
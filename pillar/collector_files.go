@@ -1,41 +1,85 @@
 package pillar
 
 import (
+	"fmt"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
 	log "github.com/sirupsen/logrus"
 )
 
-func (c *collector) filesTotalCount() error {
-	var err error
+func init() {
+	Register(&builtinCollector{name: "files", collect: (*collector).collectFiles})
+}
 
+func (c *collector) collectFiles() error {
+	if err := c.filesTotalCount(); err != nil {
+		return fmt.Errorf("filesTotalCount: %s", err)
+	}
+	if err := c.filesExpiredLinks(); err != nil {
+		return fmt.Errorf("filesExpiredLinks: %s", err)
+	}
+	if err := c.filesLinkExpiry(); err != nil {
+		return fmt.Errorf("filesLinkExpiry: %s", err)
+	}
+	if err := c.filesEmptyLinks(); err != nil {
+		return fmt.Errorf("filesEmptyLinks: %s", err)
+	}
+	if err := c.filesCountStatsPerStorageBackend(); err != nil {
+		return fmt.Errorf("filesCountStatsPerStorageBackend: %s", err)
+	}
+	if err := c.filesCountStatsPerStatus(); err != nil {
+		return fmt.Errorf("filesCountStatsPerStatus: %s", err)
+	}
+	if err := c.filesSizeHistogram(); err != nil {
+		return fmt.Errorf("filesSizeHistogram: %s", err)
+	}
+	if err := c.filesCountStatsPerContentType(); err != nil {
+		return fmt.Errorf("filesCountStatsPerContentType: %s", err)
+	}
+	if err := c.filesLargest(); err != nil {
+		return fmt.Errorf("filesLargest: %s", err)
+	}
+	return nil
+}
+
+func (c *collector) filesTotalCount() error {
 	log.Info("Counting files")
-	c.stats.Files.FileCountTotal, err = c.filesColl.Find(c.emptyQuery()).Count()
+	count, err := c.filesColl.Find(c.emptyQuery()).Count()
+	if err != nil {
+		return err
+	}
 
-	return err
+	c.update(func(stats *elastic.Stats) { stats.Files.FileCountTotal = count })
+	return nil
 }
 
 func (c *collector) filesExpiredLinks() error {
-	var err error
-
 	log.Info("Counting files with expired links")
-	c.stats.Files.ExpiredLinkCount, err = c.filesColl.Find(c.query(
+	count, err := c.filesColl.Find(c.query(
 		m{"link_expires": m{"$lt": c.now}},
 	)).Count()
+	if err != nil {
+		return err
+	}
 
-	return err
+	c.update(func(stats *elastic.Stats) { stats.Files.ExpiredLinkCount = count })
+	return nil
 }
 
 func (c *collector) filesEmptyLinks() error {
-	var err error
-
 	log.Info("Counting files with nil/empty links")
-	c.stats.Files.NoLinkCount, err = c.filesColl.Find(c.query(
+	count, err := c.filesColl.Find(c.query(
 		m{"$or": []m{
 			m{"link": nil},
 			m{"link": m{"$exists": false}},
 			m{"link": ""},
 		}})).Count()
+	if err != nil {
+		return err
+	}
 
-	return err
+	c.update(func(stats *elastic.Stats) { stats.Files.NoLinkCount = count })
+	return nil
 }
 
 func (c *collector) filesCountStatsPerStorageBackend() error {
@@ -56,21 +100,30 @@ func (c *collector) filesCountStatsPerStorageBackend() error {
 	}))
 	iter := pipe.Iter()
 
-	c.stats.Files.TotalBytesStorageUsed = 0
-	c.stats.Files.TotalBytesStorageUsedPerBackend = map[string]int64{}
-	c.stats.Files.FileCountPerBackend = map[string]int{}
+	var totalBytes int64
+	bytesPerBackend := map[string]int64{}
+	countPerBackend := map[string]int{}
 
 	for iter.Next(&perBackendResult) {
 		backend := perBackendResult.Backend
 		if backend == "" {
 			backend = noValueString
 		}
-		c.stats.Files.TotalBytesStorageUsedPerBackend[backend] = perBackendResult.TotalBytes
-		c.stats.Files.FileCountPerBackend[backend] = perBackendResult.Count
-		c.stats.Files.TotalBytesStorageUsed += perBackendResult.TotalBytes
+		bytesPerBackend[backend] = perBackendResult.TotalBytes
+		countPerBackend[backend] = perBackendResult.Count
+		totalBytes += perBackendResult.TotalBytes
+	}
+
+	if err := iter.Close(); err != nil {
+		return err
 	}
 
-	return iter.Close()
+	c.update(func(stats *elastic.Stats) {
+		stats.Files.TotalBytesStorageUsed = totalBytes
+		stats.Files.TotalBytesStorageUsedPerBackend = bytesPerBackend
+		stats.Files.FileCountPerBackend = countPerBackend
+	})
+	return nil
 }
 
 func (c *collector) filesCountStatsPerStatus() error {
@@ -89,14 +142,20 @@ func (c *collector) filesCountStatsPerStatus() error {
 	}))
 	iter := pipe.Iter()
 
-	c.stats.Files.FileCountPerStatus = map[string]int{}
+	countPerStatus := map[string]int{}
 
 	for iter.Next(&perStatusResult) {
 		status := perStatusResult.Status
 		if status == "" {
 			status = noValueString
 		}
-		c.stats.Files.FileCountPerStatus[status] = perStatusResult.Count
+		countPerStatus[status] = perStatusResult.Count
 	}
-	return iter.Close()
+
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	c.update(func(stats *elastic.Stats) { stats.Files.FileCountPerStatus = countPerStatus })
+	return nil
 }
@@ -0,0 +1,217 @@
+package pillar
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// LogBuckets returns count upper bounds of histogram buckets, starting at base bytes and each
+// factor times larger than the previous. Fewer bounds are returned when the next one would not
+// fit in an int64.
+func LogBuckets(base int64, factor, count int) []int64 {
+	bounds := make([]int64, 0, count)
+	bound := base
+	for len(bounds) < count {
+		bounds = append(bounds, bound)
+		// The histogram aggregation uses bound+1 as the boundary, so that must fit as well.
+		if factor > 1 && bound > (math.MaxInt64-1)/int64(factor) {
+			break
+		}
+		bound *= int64(factor)
+	}
+	return bounds
+}
+
+// sizeLabel returns a short label for a number of bytes, like "16KiB".
+func sizeLabel(bytes int64) string {
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"TiB", 1 << 40},
+		{"GiB", 1 << 30},
+		{"MiB", 1 << 20},
+		{"KiB", 1 << 10},
+	}
+	for _, unit := range units {
+		if bytes >= unit.size && bytes%unit.size == 0 {
+			return fmt.Sprintf("%d%s", bytes/unit.size, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", bytes)
+}
+
+// contentTypeFamilies maps content types that don't follow the "family/subtype" pattern to their
+// family.
+var contentTypeFamilies = map[string]string{
+	"application/x-blender":        "blend",
+	"application/x-blend":          "blend",
+	"application/zip":              "archive",
+	"application/x-zip-compressed": "archive",
+	"application/x-tar":            "archive",
+	"application/gzip":             "archive",
+	"application/x-gzip":           "archive",
+	"application/x-bzip2":          "archive",
+	"application/x-xz":             "archive",
+	"application/x-7z-compressed":  "archive",
+	"application/x-rar-compressed": "archive",
+	"application/vnd.rar":          "archive",
+}
+
+// contentTypeFamily returns "image", "video", "blend", "archive" or "other" for the content type.
+func contentTypeFamily(contentType string) string {
+	contentType = strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	if family, found := contentTypeFamilies[contentType]; found {
+		return family
+	}
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		return "image"
+	case strings.HasPrefix(contentType, "video/"):
+		return "video"
+	}
+	return "other"
+}
+
+func (c *collector) filesSizeHistogram() error {
+	log.Info("Aggregating file size histogram")
+
+	bounds := c.target.options.FileSizeBuckets
+	if len(bounds) == 0 {
+		return nil
+	}
+
+	var perBucketResult struct {
+		// LowerBound is the lower bound of the bucket, or "more" for files above the last bucket.
+		LowerBound interface{} `bson:"_id"`
+		Count      int         `bson:"count"`
+		TotalBytes int64       `bson:"total_bytes"`
+	}
+
+	// $bucket boundaries are inclusive lower bounds, while our bounds are inclusive upper bounds.
+	boundaries := []int64{0}
+	labels := map[int64]string{}
+	for _, bound := range bounds {
+		labels[boundaries[len(boundaries)-1]] = sizeLabel(bound)
+		boundaries = append(boundaries, bound+1)
+	}
+
+	pipe := c.filesColl.Pipe(c.aggrPipe([]m{
+		m{"$bucket": m{
+			"groupBy":    m{"$ifNull": []interface{}{"$length_aggregate_in_bytes", 0}},
+			"boundaries": boundaries,
+			"default":    "more",
+			"output": m{
+				"count":       m{"$sum": 1},
+				"total_bytes": m{"$sum": "$length_aggregate_in_bytes"},
+			},
+		}},
+	}))
+	iter := pipe.Iter()
+
+	countPerSize := map[string]int{}
+	bytesPerSize := map[string]int64{}
+	for iter.Next(&perBucketResult) {
+		label := "more"
+		switch lowerBound := perBucketResult.LowerBound.(type) {
+		case int:
+			label = labels[int64(lowerBound)]
+		case int64:
+			label = labels[lowerBound]
+		}
+		countPerSize[label] += perBucketResult.Count
+		bytesPerSize[label] += perBucketResult.TotalBytes
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	c.update(func(stats *elastic.Stats) {
+		stats.Files.FileCountPerSize = countPerSize
+		stats.Files.TotalBytesPerSize = bytesPerSize
+	})
+	return nil
+}
+
+func (c *collector) filesCountStatsPerContentType() error {
+	log.Info("Aggregating file statistics per content type")
+
+	var perContentTypeResult struct {
+		ContentType string `bson:"_id"`
+		Count       int    `bson:"count"`
+		TotalBytes  int64  `bson:"total_bytes"`
+	}
+
+	pipe := c.filesColl.Pipe(c.aggrPipe([]m{
+		m{"$group": m{
+			"_id":         "$content_type",
+			"count":       m{"$sum": 1},
+			"total_bytes": m{"$sum": "$length_aggregate_in_bytes"},
+		}},
+	}))
+	iter := pipe.Iter()
+
+	countPerFamily := map[string]int{}
+	bytesPerFamily := map[string]int64{}
+	for iter.Next(&perContentTypeResult) {
+		family := contentTypeFamily(perContentTypeResult.ContentType)
+		countPerFamily[family] += perContentTypeResult.Count
+		bytesPerFamily[family] += perContentTypeResult.TotalBytes
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	c.update(func(stats *elastic.Stats) {
+		stats.Files.FileCountPerContentType = countPerFamily
+		stats.Files.TotalBytesPerContentType = bytesPerFamily
+	})
+	return nil
+}
+
+func (c *collector) filesLargest() error {
+	if c.target.options.LargestFiles <= 0 {
+		return nil
+	}
+	log.Info("Finding the largest files")
+
+	var files []struct {
+		ID          bson.ObjectId `bson:"_id"`
+		Project     bson.ObjectId `bson:"project"`
+		Filename    string        `bson:"filename"`
+		ContentType string        `bson:"content_type"`
+		Backend     string        `bson:"backend"`
+		Size        int64         `bson:"length_aggregate_in_bytes"`
+	}
+	err := c.filesColl.Find(c.emptyQuery()).
+		Select(m{"project": 1, "filename": 1, "content_type": 1, "backend": 1, "length_aggregate_in_bytes": 1}).
+		Sort("-length_aggregate_in_bytes").
+		Limit(c.target.options.LargestFiles).
+		All(&files)
+	if err != nil {
+		return err
+	}
+
+	largest := make([]elastic.LargestFile, len(files))
+	for idx, file := range files {
+		largest[idx] = elastic.LargestFile{
+			ID:          file.ID.Hex(),
+			Filename:    file.Filename,
+			ContentType: file.ContentType,
+			Family:      contentTypeFamily(file.ContentType),
+			Backend:     file.Backend,
+			Size:        file.Size,
+		}
+		if file.Project != "" {
+			largest[idx].Project = file.Project.Hex()
+		}
+	}
+
+	c.update(func(stats *elastic.Stats) { stats.Files.LargestFiles = largest })
+	return nil
+}
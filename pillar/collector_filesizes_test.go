@@ -0,0 +1,99 @@
+package pillar
+
+import (
+	"github.com/armadillica/pillar-statscollector/elastic"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type FileSizesTestSuite struct{}
+
+var _ = check.Suite(&FileSizesTestSuite{})
+
+func (s *FileSizesTestSuite) TestLogBuckets(t *check.C) {
+	assert.Equal(t, []int64{1024, 16384, 262144}, LogBuckets(1024, 16, 3))
+	assert.Equal(t, []int64{}, LogBuckets(1024, 16, 0))
+
+	// The bounds stop before overflowing.
+	bounds := LogBuckets(1024, 16, 100)
+	assert.Len(t, bounds, 14)
+	assert.Equal(t, int64(1<<62), bounds[13])
+}
+
+func (s *FileSizesTestSuite) TestSizeLabel(t *check.C) {
+	assert.Equal(t, "1KiB", sizeLabel(1024))
+	assert.Equal(t, "16KiB", sizeLabel(16<<10))
+	assert.Equal(t, "4MiB", sizeLabel(4<<20))
+	assert.Equal(t, "16GiB", sizeLabel(16<<30))
+	assert.Equal(t, "1000B", sizeLabel(1000))
+	assert.Equal(t, "1025B", sizeLabel(1025))
+}
+
+func (s *FileSizesTestSuite) TestContentTypeFamily(t *check.C) {
+	assert.Equal(t, "image", contentTypeFamily("image/png"))
+	assert.Equal(t, "video", contentTypeFamily("Video/MP4"))
+	assert.Equal(t, "blend", contentTypeFamily("application/x-blender"))
+	assert.Equal(t, "archive", contentTypeFamily("application/zip; charset=binary"))
+	assert.Equal(t, "other", contentTypeFamily("application/octet-stream"))
+	assert.Equal(t, "other", contentTypeFamily(""))
+}
+
+type CollectorFileSizesTestSuite struct {
+	session *mgo.Session
+}
+
+var _ = check.Suite(&CollectorFileSizesTestSuite{})
+
+func (s *CollectorFileSizesTestSuite) SetUpTest(c *check.C) {
+	session, err := mgo.Dial("mongodb://localhost/unittests")
+	if err != nil {
+		log.Panic(err)
+	}
+	s.session = session
+}
+
+func (s *CollectorFileSizesTestSuite) TearDownTest(c *check.C) {
+	s.session.DB("").DropDatabase()
+	s.session.Close()
+}
+
+func (s *CollectorFileSizesTestSuite) TestFileSizes(t *check.C) {
+	project := bson.NewObjectId()
+	video := bson.NewObjectId()
+	assert.Nil(t, s.session.DB("").C("files").Insert(
+		bson.M{"content_type": "image/png", "length_aggregate_in_bytes": 1000},
+		bson.M{"content_type": "image/jpeg", "length_aggregate_in_bytes": 1024},
+		bson.M{"content_type": "application/x-blender", "length_aggregate_in_bytes": 2000},
+		bson.M{"_id": video, "project": project, "filename": "film.mkv", "backend": "gcs",
+			"content_type": "video/x-matroska", "length_aggregate_in_bytes": 1 << 20},
+		bson.M{"content_type": "text/plain"},
+	))
+
+	options := DefaultOptions()
+	options.Only = []string{"files"}
+	options.FileSizeBuckets = LogBuckets(1024, 16, 2)
+	options.LargestFiles = 1
+	stats, err := CollectStatsWithOptions(s.session, options)
+	assert.Nil(t, err)
+
+	assert.Equal(t, map[string]int{"1KiB": 3, "16KiB": 1, "more": 1}, stats.Files.FileCountPerSize)
+	assert.Equal(t, map[string]int64{"1KiB": 2024, "16KiB": 2000, "more": 1 << 20}, stats.Files.TotalBytesPerSize)
+	assert.Equal(t,
+		map[string]int{"image": 2, "blend": 1, "video": 1, "other": 1},
+		stats.Files.FileCountPerContentType)
+	assert.Equal(t,
+		map[string]int64{"image": 2024, "blend": 2000, "video": 1 << 20, "other": 0},
+		stats.Files.TotalBytesPerContentType)
+	assert.Equal(t, []elastic.LargestFile{{
+		ID:          video.Hex(),
+		Project:     project.Hex(),
+		Filename:    "film.mkv",
+		ContentType: "video/x-matroska",
+		Family:      "video",
+		Backend:     "gcs",
+		Size:        1 << 20,
+	}}, stats.Files.LargestFiles)
+}
@@ -0,0 +1,161 @@
+package pillar
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	log "github.com/sirupsen/logrus"
+)
+
+// windowLabel returns a short label for a link expiry window, like "1h" or "7d".
+func windowLabel(window time.Duration) string {
+	day := 24 * time.Hour
+	switch {
+	case window%day == 0:
+		return fmt.Sprintf("%dd", window/day)
+	case window%time.Hour == 0:
+		return fmt.Sprintf("%dh", window/time.Hour)
+	case window%time.Minute == 0:
+		return fmt.Sprintf("%dm", window/time.Minute)
+	}
+	return window.String()
+}
+
+// sortedWindows returns the link expiry windows from the options, shortest first and without
+// duplicates, as $bucket needs strictly ascending boundaries.
+func (c *collector) sortedWindows() []time.Duration {
+	windows := append([]time.Duration{}, c.target.options.LinkExpiryWindows...)
+	sort.Slice(windows, func(i, j int) bool { return windows[i] < windows[j] })
+	unique := windows[:0]
+	for idx, window := range windows {
+		if idx == 0 || window != windows[idx-1] {
+			unique = append(unique, window)
+		}
+	}
+	return unique
+}
+
+// milliseconds returns the timestamp in milliseconds since the epoch, which is the precision of
+// MongoDB dates.
+func milliseconds(timestamp time.Time) int64 {
+	return timestamp.UnixNano() / int64(time.Millisecond)
+}
+
+func (c *collector) filesLinkExpiry() error {
+	if err := c.filesExpiringLinks(); err != nil {
+		return err
+	}
+	if err := c.filesExpiredLinksPerBackend(); err != nil {
+		return err
+	}
+	return c.filesExpiredLinksPerAge()
+}
+
+// filesExpiringLinks counts the links that expire within each window.
+func (c *collector) filesExpiringLinks() error {
+	log.Info("Counting files with links that expire soon")
+
+	countPerWindow := map[string]int{}
+	for _, window := range c.sortedWindows() {
+		count, err := c.filesColl.Find(c.query(
+			m{"link_expires": m{"$gte": c.now, "$lt": c.now.Add(window)}},
+		)).Count()
+		if err != nil {
+			return err
+		}
+		countPerWindow[windowLabel(window)] = count
+	}
+
+	c.update(func(stats *elastic.Stats) { stats.Files.ExpiringLinkCount = countPerWindow })
+	return nil
+}
+
+func (c *collector) filesExpiredLinksPerBackend() error {
+	log.Info("Aggregating expired links per storage backend")
+
+	var perBackendResult struct {
+		Backend string `bson:"_id"`
+		Count   int    `bson:"count"`
+	}
+
+	pipe := c.filesColl.Pipe(c.aggrPipe([]m{
+		m{"$match": m{"link_expires": m{"$lt": c.now}}},
+		m{"$group": m{
+			"_id":   "$backend",
+			"count": m{"$sum": 1},
+		}},
+	}))
+	iter := pipe.Iter()
+
+	countPerBackend := map[string]int{}
+	for iter.Next(&perBackendResult) {
+		backend := perBackendResult.Backend
+		if backend == "" {
+			backend = noValueString
+		}
+		countPerBackend[backend] = perBackendResult.Count
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	c.update(func(stats *elastic.Stats) { stats.Files.ExpiredLinkCountPerBackend = countPerBackend })
+	return nil
+}
+
+// filesExpiredLinksPerAge counts the expired links by how long ago they expired, using the link
+// expiry windows as buckets. Links that expired longer ago than the largest window are counted
+// as "more".
+func (c *collector) filesExpiredLinksPerAge() error {
+	log.Info("Aggregating expired links per age")
+
+	windows := c.sortedWindows()
+	if len(windows) == 0 {
+		return nil
+	}
+
+	var perAgeResult struct {
+		// LowerBound is the lower bound of the bucket, or "more" for links older than all windows.
+		LowerBound interface{} `bson:"_id"`
+		Count      int         `bson:"count"`
+	}
+
+	// $bucket boundaries are ascending, so the largest window comes first. Each bucket is labelled
+	// with the largest age of its links.
+	boundaries := []time.Time{}
+	labels := map[int64]string{}
+	for idx := len(windows) - 1; idx >= 0; idx-- {
+		boundary := c.now.Add(-windows[idx])
+		boundaries = append(boundaries, boundary)
+		labels[milliseconds(boundary)] = windowLabel(windows[idx])
+	}
+	boundaries = append(boundaries, c.now)
+
+	pipe := c.filesColl.Pipe(c.aggrPipe([]m{
+		m{"$match": m{"link_expires": m{"$lt": c.now}}},
+		m{"$bucket": m{
+			"groupBy":    "$link_expires",
+			"boundaries": boundaries,
+			"default":    "more",
+			"output":     m{"count": m{"$sum": 1}},
+		}},
+	}))
+	iter := pipe.Iter()
+
+	countPerAge := map[string]int{}
+	for iter.Next(&perAgeResult) {
+		label := "more"
+		if lowerBound, isTime := perAgeResult.LowerBound.(time.Time); isTime {
+			label = labels[milliseconds(lowerBound)]
+		}
+		countPerAge[label] += perAgeResult.Count
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	c.update(func(stats *elastic.Stats) { stats.Files.ExpiredLinkCountPerAge = countPerAge })
+	return nil
+}
@@ -0,0 +1,77 @@
+package pillar
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type LinkExpiryTestSuite struct{}
+
+var _ = check.Suite(&LinkExpiryTestSuite{})
+
+func (s *LinkExpiryTestSuite) TestWindowLabel(t *check.C) {
+	assert.Equal(t, "1h", windowLabel(time.Hour))
+	assert.Equal(t, "1d", windowLabel(24*time.Hour))
+	assert.Equal(t, "7d", windowLabel(7*24*time.Hour))
+	assert.Equal(t, "36h", windowLabel(36*time.Hour))
+	assert.Equal(t, "30m", windowLabel(30*time.Minute))
+	assert.Equal(t, "1m30s", windowLabel(90*time.Second))
+}
+
+func (s *LinkExpiryTestSuite) TestSortedWindows(t *check.C) {
+	options := DefaultOptions()
+	options.LinkExpiryWindows = []time.Duration{24 * time.Hour, time.Hour, 24 * time.Hour}
+	c := &collector{target: &Target{options: &options}}
+	assert.Equal(t, []time.Duration{time.Hour, 24 * time.Hour}, c.sortedWindows())
+	assert.Equal(t, []time.Duration{24 * time.Hour, time.Hour, 24 * time.Hour}, options.LinkExpiryWindows)
+}
+
+type CollectorLinkExpiryTestSuite struct {
+	session *mgo.Session
+}
+
+var _ = check.Suite(&CollectorLinkExpiryTestSuite{})
+
+func (s *CollectorLinkExpiryTestSuite) SetUpTest(c *check.C) {
+	session, err := mgo.Dial("mongodb://localhost/unittests")
+	if err != nil {
+		log.Panic(err)
+	}
+	s.session = session
+}
+
+func (s *CollectorLinkExpiryTestSuite) TearDownTest(c *check.C) {
+	s.session.DB("").DropDatabase()
+	s.session.Close()
+}
+
+func (s *CollectorLinkExpiryTestSuite) TestLinkExpiry(t *check.C) {
+	now := time.Now().UTC()
+	assert.Nil(t, s.session.DB("").C("files").Insert(
+		// Expiring links.
+		bson.M{"backend": "gcs", "link_expires": now.Add(30 * time.Minute)},
+		bson.M{"backend": "gcs", "link_expires": now.Add(12 * time.Hour)},
+		bson.M{"backend": "gcs", "link_expires": now.Add(30 * 24 * time.Hour)},
+		// Expired links.
+		bson.M{"backend": "gcs", "link_expires": now.Add(-30 * time.Minute)},
+		bson.M{"backend": "pillar", "link_expires": now.Add(-12 * time.Hour)},
+		bson.M{"link_expires": now.Add(-30 * 24 * time.Hour)},
+		// No link at all.
+		bson.M{"backend": "local"},
+	))
+
+	options := DefaultOptions()
+	options.Only = []string{"files"}
+	options.LinkExpiryWindows = []time.Duration{24 * time.Hour, time.Hour}
+	stats, err := CollectStatsWithOptions(s.session, options)
+	assert.Nil(t, err)
+
+	assert.Equal(t, map[string]int{"1h": 1, "1d": 2}, stats.Files.ExpiringLinkCount)
+	assert.Equal(t, map[string]int{"gcs": 1, "pillar": 1, "-none-": 1}, stats.Files.ExpiredLinkCountPerBackend)
+	assert.Equal(t, map[string]int{"1h": 1, "1d": 1, "more": 1}, stats.Files.ExpiredLinkCountPerAge)
+}
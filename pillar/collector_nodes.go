@@ -1,6 +1,13 @@
 package pillar
 
-import log "github.com/sirupsen/logrus"
+import (
+	"github.com/armadillica/pillar-statscollector/elastic"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	Register(&builtinCollector{name: "nodes", collect: (*collector).nodesCount})
+}
 
 func (c *collector) nodesCount() error {
 	log.Info("Aggregating nodes stats")
@@ -29,17 +36,25 @@ func (c *collector) nodesCount() error {
 	})
 	iter := c.projColl.Pipe(query).Iter()
 
-	c.stats.Nodes.PublicCountPerNodeType = map[string]int{}
-	c.stats.Nodes.TotalPublicNodeCount = 0
+	countPerNodeType := map[string]int{}
+	totalCount := 0
 
 	for iter.Next(&result) {
 		nodeType := result.NodeType
 		if nodeType == "" {
 			nodeType = noValueString
 		}
-		c.stats.Nodes.PublicCountPerNodeType[nodeType] = result.Count
-		c.stats.Nodes.TotalPublicNodeCount += result.Count
+		countPerNodeType[nodeType] = result.Count
+		totalCount += result.Count
 	}
 
-	return iter.Close()
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	c.update(func(stats *elastic.Stats) {
+		stats.Nodes.PublicCountPerNodeType = countPerNodeType
+		stats.Nodes.TotalPublicNodeCount = totalCount
+	})
+	return nil
 }
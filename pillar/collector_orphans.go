@@ -0,0 +1,156 @@
+package pillar
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func init() {
+	// Finding orphans reads all nodes, projects, users and files, so it only runs when enabled.
+	Register(&builtinCollector{name: "orphans", optional: true, collect: (*collector).countOrphanFiles})
+}
+
+// OrphanFile is a file document that is not referenced by any node, project, user or other file.
+type OrphanFile struct {
+	ID      bson.ObjectId `json:"id" bson:"_id"`
+	Project bson.ObjectId `json:"project,omitempty" bson:"project,omitempty"`
+	Backend string        `json:"backend" bson:"backend"`
+	Size    int64         `json:"size" bson:"length_aggregate_in_bytes"`
+}
+
+// referenceSources lists the documents that can refer to files, and the fields that contain
+// those references. Fields are searched recursively, as node properties differ per node type.
+var referenceSources = []struct {
+	collection string
+	fields     []string
+}{
+	{"nodes", []string{"picture", "properties"}},
+	{"projects", []string{"picture_square", "picture_header", "picture_16_9"}},
+	{"users", []string{"avatar"}},
+}
+
+func (c *collector) countOrphanFiles() error {
+	log.Info("Finding orphan files")
+
+	var count int
+	var totalBytes int64
+	countPerBackend := map[string]int{}
+	bytesPerBackend := map[string]int64{}
+
+	err := findOrphans(c.ctx, c.target.Session, c.emptyQuery(), func(orphan OrphanFile) error {
+		backend := orphan.Backend
+		if backend == "" {
+			backend = noValueString
+		}
+		count++
+		totalBytes += orphan.Size
+		countPerBackend[backend]++
+		bytesPerBackend[backend] += orphan.Size
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.update(func(stats *elastic.Stats) {
+		stats.Files.OrphanFileCount = count
+		stats.Files.TotalOrphanFileSizeInBytes = totalBytes
+		stats.Files.OrphanFileCountPerBackend = countPerBackend
+		stats.Files.TotalOrphanBytesPerBackend = bytesPerBackend
+	})
+	return nil
+}
+
+// FindOrphans calls found for every orphan file, limited to files created before the given
+// timestamp when it is not nil. References are always taken from the current documents, including
+// deleted ones, as those can still be restored.
+func FindOrphans(ctx context.Context, session *mgo.Session, before *time.Time, found func(OrphanFile) error) error {
+	query := m{}
+	if before != nil {
+		query["_created"] = m{"$lt": before}
+	}
+	return findOrphans(ctx, session, query, found)
+}
+
+func findOrphans(ctx context.Context, session *mgo.Session, fileQuery m, found func(OrphanFile) error) error {
+	db := session.DB("")
+	referenced := map[bson.ObjectId]bool{}
+
+	for _, source := range referenceSources {
+		selection := m{}
+		for _, field := range source.fields {
+			selection[field] = 1
+		}
+		var doc bson.M
+		iter := db.C(source.collection).Find(nil).Select(selection).Iter()
+		for iter.Next(&doc) {
+			if ctx.Err() != nil {
+				iter.Close()
+				return ctx.Err()
+			}
+			for _, field := range source.fields {
+				addObjectIDs(doc[field], referenced)
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return fmt.Errorf("unable to find file references in %s: %s", source.collection, err)
+		}
+	}
+	log.WithField("referenced_ids", len(referenced)).Debug("found file references")
+
+	var file struct {
+		OrphanFile `bson:",inline"`
+		// Parent refers to the original file, for files that are a variation of it.
+		Parent bson.ObjectId `bson:"parent,omitempty"`
+	}
+	iter := db.C("files").Find(fileQuery).Select(m{
+		"project":                   1,
+		"backend":                   1,
+		"length_aggregate_in_bytes": 1,
+		"parent":                    1,
+	}).Iter()
+	for iter.Next(&file) {
+		if ctx.Err() != nil {
+			iter.Close()
+			return ctx.Err()
+		}
+		orphan := !referenced[file.ID] && (file.Parent == "" || !referenced[file.Parent])
+		if orphan {
+			if err := found(file.OrphanFile); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+	}
+	return iter.Close()
+}
+
+// addObjectIDs adds every ObjectID in value to ids, searching through subdocuments and arrays.
+func addObjectIDs(value interface{}, ids map[bson.ObjectId]bool) {
+	switch v := value.(type) {
+	case bson.ObjectId:
+		ids[v] = true
+	case bson.M:
+		for _, item := range v {
+			addObjectIDs(item, ids)
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			addObjectIDs(item, ids)
+		}
+	case bson.D:
+		for _, elem := range v {
+			addObjectIDs(elem.Value, ids)
+		}
+	case []interface{}:
+		for _, item := range v {
+			addObjectIDs(item, ids)
+		}
+	}
+}
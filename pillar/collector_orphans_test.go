@@ -0,0 +1,134 @@
+package pillar
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type ObjectIDsTestSuite struct{}
+
+var _ = check.Suite(&ObjectIDsTestSuite{})
+
+func (s *ObjectIDsTestSuite) TestAddObjectIDs(t *check.C) {
+	picture := bson.NewObjectId()
+	file := bson.NewObjectId()
+	attachment := bson.NewObjectId()
+
+	ids := map[bson.ObjectId]bool{}
+	addObjectIDs(picture, ids)
+	addObjectIDs(bson.M{
+		"files": []interface{}{
+			bson.M{"file": file, "slug": "hd"},
+		},
+		"attachments": bson.M{"diagram": bson.M{"oid": attachment}},
+		"status":      "published",
+	}, ids)
+	addObjectIDs(nil, ids)
+
+	assert.Equal(t, map[bson.ObjectId]bool{picture: true, file: true, attachment: true}, ids)
+}
+
+type CollectorOrphansTestSuite struct {
+	session *mgo.Session
+}
+
+var _ = check.Suite(&CollectorOrphansTestSuite{})
+
+func (s *CollectorOrphansTestSuite) SetUpTest(c *check.C) {
+	session, err := mgo.Dial("mongodb://localhost/unittests")
+	if err != nil {
+		log.Panic(err)
+	}
+	s.session = session
+}
+
+func (s *CollectorOrphansTestSuite) TearDownTest(c *check.C) {
+	s.session.DB("").DropDatabase()
+	s.session.Close()
+}
+
+func (s *CollectorOrphansTestSuite) insert(t *check.C, collection string, docs ...interface{}) {
+	err := s.session.DB("").C(collection).Insert(docs...)
+	assert.Nil(t, err)
+}
+
+func (s *CollectorOrphansTestSuite) TestOrphans(t *check.C) {
+	project := bson.NewObjectId()
+	created := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	file := func(backend string, size int64) bson.M {
+		return bson.M{
+			"_id":                       bson.NewObjectId(),
+			"_created":                  created,
+			"project":                   project,
+			"backend":                   backend,
+			"length_aggregate_in_bytes": size,
+		}
+	}
+	asset, thumbnail, header, avatar := file("gcs", 1), file("gcs", 2), file("gcs", 4), file("local", 8)
+	variation := file("gcs", 16)
+	variation["parent"] = asset["_id"]
+	orphanGCS, orphanLocal := file("gcs", 32), file("local", 64)
+	s.insert(t, "files", asset, thumbnail, header, avatar, variation, orphanGCS, orphanLocal)
+
+	s.insert(t, "nodes", bson.M{
+		"picture":    thumbnail["_id"],
+		"properties": bson.M{"file": asset["_id"]},
+	})
+	s.insert(t, "projects", bson.M{"_id": project, "picture_header": header["_id"]})
+	s.insert(t, "users", bson.M{"avatar": bson.M{"file": avatar["_id"]}})
+
+	orphans := []OrphanFile{}
+	err := FindOrphans(context.Background(), s.session, nil, func(orphan OrphanFile) error {
+		orphans = append(orphans, orphan)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []OrphanFile{
+		{ID: orphanGCS["_id"].(bson.ObjectId), Project: project, Backend: "gcs", Size: 32},
+		{ID: orphanLocal["_id"].(bson.ObjectId), Project: project, Backend: "local", Size: 64},
+	}, orphans)
+
+	// The collector is optional, so it doesn't run by default.
+	options := DefaultOptions()
+	options.Skip = []string{"store", "blenderid"}
+	stats, err := CollectStatsWithOptions(s.session, options)
+	assert.Nil(t, err)
+	assert.NotContains(t, stats.Sections, "orphans")
+	assert.Zero(t, stats.Files.OrphanFileCount)
+	// Without the collector the document should not claim there are no orphans.
+	asJSON, err := json.Marshal(stats)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(asJSON), "orphan")
+	asBSON, err := bson.Marshal(stats)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(asBSON), "orphan")
+
+	options.Enable = []string{"orphans"}
+	stats, err = CollectStatsWithOptions(s.session, options)
+	assert.Nil(t, err)
+	assert.Contains(t, stats.Sections, "orphans")
+	assert.Equal(t, 2, stats.Files.OrphanFileCount)
+
+	options = DefaultOptions()
+	options.Only = []string{"orphans"}
+	stats, err = CollectStatsWithOptions(s.session, options)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, stats.Files.OrphanFileCount)
+	assert.Equal(t, int64(96), stats.Files.TotalOrphanFileSizeInBytes)
+	assert.Equal(t, map[string]int{"gcs": 1, "local": 1}, stats.Files.OrphanFileCountPerBackend)
+	assert.Equal(t, map[string]int64{"gcs": 32, "local": 64}, stats.Files.TotalOrphanBytesPerBackend)
+
+	// References are taken from the current documents, so historical statistics don't have orphans.
+	before := created.Add(time.Hour)
+	options.Before = &before
+	stats, err = CollectStatsWithOptions(s.session, options)
+	assert.Nil(t, err)
+	assert.NotContains(t, stats.Sections, "orphans")
+}
@@ -1,10 +1,15 @@
 package pillar
 
 import (
+	"github.com/armadillica/pillar-statscollector/elastic"
 	log "github.com/sirupsen/logrus"
 	mgo "gopkg.in/mgo.v2"
 )
 
+func init() {
+	Register(&builtinCollector{name: "projects", collect: (*collector).projectsCount})
+}
+
 func (c *collector) projectsCount() error {
 	log.Info("Aggregating project stats")
 
@@ -41,21 +46,25 @@ func (c *collector) projectsCount() error {
 		return err
 	}
 	if err == nil {
-		c.stats.Projects.PublicCount = result.Public
-		c.stats.Projects.PrivateCount = result.Private
-		c.stats.Projects.HomeProjectCount = result.Home
+		c.update(func(stats *elastic.Stats) {
+			stats.Projects.PublicCount = result.Public
+			stats.Projects.PrivateCount = result.Private
+			stats.Projects.HomeProjectCount = result.Home
+		})
 	}
 
 	// Do a separate count to ensure we get a correct total, even in the face of small mistakes in
 	// the aggregation query.
-	c.stats.Projects.TotalCount, err = c.projColl.Find(c.notDeletedQuery()).Count()
+	totalCount, err := c.projColl.Find(c.notDeletedQuery()).Count()
 	if err != nil && err != mgo.ErrNotFound {
 		return err
 	}
+	c.update(func(stats *elastic.Stats) { stats.Projects.TotalCount = totalCount })
 
-	c.stats.Projects.TotalDeletedCount, err = c.projColl.Find(c.query(m{"_deleted": true})).Count()
-	if err == mgo.ErrNotFound {
-		return nil
+	totalDeletedCount, err := c.projColl.Find(c.query(m{"_deleted": true})).Count()
+	if err != nil && err != mgo.ErrNotFound {
+		return err
 	}
-	return err
+	c.update(func(stats *elastic.Stats) { stats.Projects.TotalDeletedCount = totalDeletedCount })
+	return nil
 }
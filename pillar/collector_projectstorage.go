@@ -0,0 +1,170 @@
+package pillar
+
+import (
+	"sort"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func init() {
+	Register(&builtinCollector{name: "projectstorage", collect: (*collector).projectStorage})
+}
+
+// Project categories used for storage accounting.
+const (
+	categoryPublic  = "public"
+	categoryPrivate = "private"
+	categoryHome    = "home"
+	categoryDeleted = "deleted"
+)
+
+func (c *collector) projectStorage() error {
+	log.Info("Aggregating storage per project")
+
+	var perProjectResult struct {
+		ID struct {
+			Project bson.ObjectId `bson:"project"`
+			Backend string        `bson:"backend"`
+		} `bson:"_id"`
+		Count      int   `bson:"count"`
+		TotalBytes int64 `bson:"total_bytes"`
+	}
+
+	pipe := c.filesColl.Pipe(c.aggrPipe([]m{
+		m{"$group": m{
+			"_id":         m{"project": "$project", "backend": "$backend"},
+			"count":       m{"$sum": 1},
+			"total_bytes": m{"$sum": "$length_aggregate_in_bytes"},
+		}},
+	}))
+	iter := pipe.Iter()
+
+	perProject := map[bson.ObjectId]*elastic.ProjectStorage{}
+	for iter.Next(&perProjectResult) {
+		projectID := perProjectResult.ID.Project
+		backend := perProjectResult.ID.Backend
+		if backend == "" {
+			backend = noValueString
+		}
+
+		storage, found := perProject[projectID]
+		if !found {
+			storage = &elastic.ProjectStorage{
+				Timestamp:           c.now,
+				FileCountPerBackend: map[string]int{},
+				BytesPerBackend:     map[string]int64{},
+			}
+			if projectID != "" {
+				storage.Project = projectID.Hex()
+				storage.ID = elastic.DocumentID(storage.Project, c.now)
+			}
+			perProject[projectID] = storage
+		}
+		storage.FileCount += perProjectResult.Count
+		storage.TotalBytes += perProjectResult.TotalBytes
+		storage.FileCountPerBackend[backend] += perProjectResult.Count
+		storage.BytesPerBackend[backend] += perProjectResult.TotalBytes
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	if err := c.describeProjects(perProject); err != nil {
+		return err
+	}
+
+	countPerCategory := map[string]int{}
+	bytesPerCategory := map[string]int64{}
+	projects := []elastic.ProjectStorage{}
+	for projectID, storage := range perProject {
+		countPerCategory[storage.Category] += storage.FileCount
+		bytesPerCategory[storage.Category] += storage.TotalBytes
+		// Files without project are only counted per category.
+		if projectID != "" {
+			projects = append(projects, *storage)
+		}
+	}
+	sortProjectStorage(projects)
+
+	top := projects
+	if limit := c.target.options.TopProjects; len(top) > limit {
+		if limit < 0 {
+			limit = 0
+		}
+		top = top[:limit]
+	}
+
+	c.update(func(stats *elastic.Stats) {
+		stats.Projects.FileCountPerCategory = countPerCategory
+		stats.Projects.BytesPerCategory = bytesPerCategory
+		stats.Projects.TopStorage = top
+		if c.target.options.ProjectBreakdown {
+			stats.ProjectStorage = projects
+		}
+	})
+	return nil
+}
+
+// describeProjects sets the name and category of the projects. Files of projects that don't exist
+// are counted in the -none- category.
+func (c *collector) describeProjects(perProject map[bson.ObjectId]*elastic.ProjectStorage) error {
+	var project struct {
+		ID        bson.ObjectId `bson:"_id"`
+		Name      string        `bson:"name"`
+		Category  string        `bson:"category"`
+		IsPrivate bool          `bson:"is_private"`
+		Deleted   bool          `bson:"_deleted"`
+	}
+
+	// All projects are read, as the list of IDs can be too large for a query.
+	iter := c.projColl.Find(nil).Select(m{
+		"name":       1,
+		"category":   1,
+		"is_private": 1,
+		"_deleted":   1,
+	}).Iter()
+	for iter.Next(&project) {
+		storage, found := perProject[project.ID]
+		if !found {
+			continue
+		}
+		storage.Name = project.Name
+		storage.Category = projectCategory(project.Category, project.IsPrivate, project.Deleted)
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	for _, storage := range perProject {
+		if storage.Category == "" {
+			storage.Category = noValueString
+		}
+	}
+	return nil
+}
+
+// projectCategory returns the category of the project for storage accounting, which is the
+// same as used for counting projects, except that deleted projects get their own category.
+func projectCategory(category string, isPrivate, deleted bool) string {
+	switch {
+	case deleted:
+		return categoryDeleted
+	case category == "home":
+		return categoryHome
+	case isPrivate:
+		return categoryPrivate
+	}
+	return categoryPublic
+}
+
+// sortProjectStorage sorts the projects by the storage they use, largest first.
+func sortProjectStorage(projects []elastic.ProjectStorage) {
+	sort.Slice(projects, func(i, j int) bool {
+		if projects[i].TotalBytes != projects[j].TotalBytes {
+			return projects[i].TotalBytes > projects[j].TotalBytes
+		}
+		return projects[i].Project < projects[j].Project
+	})
+}
@@ -0,0 +1,94 @@
+package pillar
+
+import (
+	"github.com/armadillica/pillar-statscollector/elastic"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type ProjectCategoryTestSuite struct{}
+
+var _ = check.Suite(&ProjectCategoryTestSuite{})
+
+func (s *ProjectCategoryTestSuite) TestProjectCategory(t *check.C) {
+	assert.Equal(t, "public", projectCategory("film", false, false))
+	assert.Equal(t, "private", projectCategory("assets", true, false))
+	assert.Equal(t, "home", projectCategory("home", true, false))
+	assert.Equal(t, "deleted", projectCategory("home", true, true))
+}
+
+func (s *ProjectCategoryTestSuite) TestSort(t *check.C) {
+	projects := []elastic.ProjectStorage{
+		{Project: "b", TotalBytes: 10},
+		{Project: "c", TotalBytes: 30},
+		{Project: "a", TotalBytes: 10},
+	}
+	sortProjectStorage(projects)
+	assert.Equal(t, []elastic.ProjectStorage{
+		{Project: "c", TotalBytes: 30},
+		{Project: "a", TotalBytes: 10},
+		{Project: "b", TotalBytes: 10},
+	}, projects)
+}
+
+type CollectorProjectStorageTestSuite struct {
+	session *mgo.Session
+}
+
+var _ = check.Suite(&CollectorProjectStorageTestSuite{})
+
+func (s *CollectorProjectStorageTestSuite) SetUpTest(c *check.C) {
+	session, err := mgo.Dial("mongodb://localhost/unittests")
+	if err != nil {
+		log.Panic(err)
+	}
+	s.session = session
+}
+
+func (s *CollectorProjectStorageTestSuite) TearDownTest(c *check.C) {
+	s.session.DB("").DropDatabase()
+	s.session.Close()
+}
+
+func (s *CollectorProjectStorageTestSuite) TestProjectStorage(t *check.C) {
+	film, home := bson.NewObjectId(), bson.NewObjectId()
+	db := s.session.DB("")
+	assert.Nil(t, db.C("projects").Insert(
+		bson.M{"_id": film, "name": "Film", "category": "film", "is_private": false},
+		bson.M{"_id": home, "name": "Home", "category": "home", "is_private": true},
+	))
+	assert.Nil(t, db.C("files").Insert(
+		bson.M{"project": film, "backend": "gcs", "length_aggregate_in_bytes": 100},
+		bson.M{"project": film, "backend": "local", "length_aggregate_in_bytes": 10},
+		bson.M{"project": home, "backend": "gcs", "length_aggregate_in_bytes": 50},
+		bson.M{"backend": "gcs", "length_aggregate_in_bytes": 1},
+	))
+
+	options := DefaultOptions()
+	options.Only = []string{"projectstorage"}
+	options.TopProjects = 1
+	options.ProjectBreakdown = true
+	stats, err := CollectStatsWithOptions(s.session, options)
+	assert.Nil(t, err)
+
+	assert.Equal(t, map[string]int{"public": 2, "home": 1, "-none-": 1}, stats.Projects.FileCountPerCategory)
+	assert.Equal(t, map[string]int64{"public": 110, "home": 50, "-none-": 1}, stats.Projects.BytesPerCategory)
+
+	if assert.Len(t, stats.Projects.TopStorage, 1) {
+		top := stats.Projects.TopStorage[0]
+		assert.Equal(t, film.Hex(), top.Project)
+		assert.Equal(t, "Film", top.Name)
+		assert.Equal(t, "public", top.Category)
+		assert.Equal(t, 2, top.FileCount)
+		assert.Equal(t, int64(110), top.TotalBytes)
+		assert.Equal(t, map[string]int64{"gcs": 100, "local": 10}, top.BytesPerBackend)
+		assert.Equal(t, elastic.DocumentID(film.Hex(), stats.Timestamp), top.ID)
+	}
+	if assert.Len(t, stats.ProjectStorage, 2) {
+		assert.Equal(t, home.Hex(), stats.ProjectStorage[1].Project)
+		assert.Equal(t, "home", stats.ProjectStorage[1].Category)
+	}
+}
@@ -1,14 +1,33 @@
 package pillar
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 
+	"github.com/armadillica/pillar-statscollector/elastic"
 	log "github.com/sirupsen/logrus"
 	mgo "gopkg.in/mgo.v2"
 )
 
+func init() {
+	Register(&builtinCollector{name: "users", collect: (*collector).usersCount})
+	Register(&builtinCollector{name: "blendersync", collect: func(c *collector) error {
+		if err := c.countBlenderSyncUsers(); err != nil {
+			return err
+		}
+		return c.blenderSyncUsage()
+	}})
+	Register(&builtinCollector{name: "store", collect: func(c *collector) error {
+		// The store can be unreachable at times; in that case we just omit the subscriber count.
+		if err := c.countSubscriptions(); err != nil {
+			return Ignore(err)
+		}
+		return nil
+	}})
+}
+
 func (c *collector) usersCount() error {
 	log.Info("Aggregating users stats")
 
@@ -46,17 +65,23 @@ func (c *collector) usersCount() error {
 	}))
 	iter := pipe.Iter()
 
-	c.stats.Users.CountPerType = map[string]int{}
+	countPerType := map[string]int{}
 
 	for iter.Next(&perTypeResult) {
-		c.stats.Users.CountPerType[perTypeResult.Type] = perTypeResult.Count
+		countPerType[perTypeResult.Type] = perTypeResult.Count
 	}
 
-	serviceUsercount := c.stats.Users.CountPerType["service"]
-	c.stats.Users.TotalRealUserCount = totalUserCount - serviceUsercount
-	c.stats.Users.TotalCount = totalUserCount
+	if err := iter.Close(); err != nil {
+		return err
+	}
 
-	return iter.Close()
+	serviceUsercount := countPerType["service"]
+	c.update(func(stats *elastic.Stats) {
+		stats.Users.CountPerType = countPerType
+		stats.Users.TotalRealUserCount = totalUserCount - serviceUsercount
+		stats.Users.TotalCount = totalUserCount
+	})
+	return nil
 }
 
 func (c *collector) countBlenderSyncUsers() error {
@@ -94,28 +119,38 @@ func (c *collector) countBlenderSyncUsers() error {
 		return err
 	}
 
-	c.stats.Users.BlenderSyncCount = result.Total
+	c.update(func(stats *elastic.Stats) { stats.Users.BlenderSyncCount = result.Total })
 	return nil
 }
 
 // Connects to Blender Store to fetch the current number of subscriptions.
-func (c *collector) countSubscriptions(storeURL string) error {
-	log.Infof("Connecting to %s", storeURL)
-
-	resp, err := http.Get(storeURL)
+func (c *collector) countSubscriptions() error {
+	subscriberCount, attempts, err := FetchSubscriberCount(c.ctx, *c.target.options)
 	if err != nil {
-		return fmt.Errorf("error getting Blender Store stats: %s", err)
+		return err
 	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("error %d getting Blender Store stats", resp.StatusCode)
+	c.update(func(stats *elastic.Stats) { stats.Users.SubscriberCount = subscriberCount })
+	c.recordAttempts("store", attempts)
+	return nil
+}
+
+// FetchSubscriberCount gets the current number of subscriptions from the Blender Store, as
+// configured in the options. Failed requests are retried; the number of attempts is returned as
+// well.
+func FetchSubscriberCount(ctx context.Context, options Options) (int, int, error) {
+	log.Infof("Connecting to %s", options.StoreURL)
+
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", options.StoreURL, nil)
+	}
+	body, attempts, err := getWithRetry(ctx, httpClient, options.retryPolicy(), newRequest)
+	if err != nil {
+		return 0, attempts, fmt.Errorf("error getting Blender Store stats after %d attempts: %s", attempts, err)
 	}
 
 	var storeData storeResponse
-	decoder := json.NewDecoder(resp.Body)
-	if err := decoder.Decode(&storeData); err != nil {
-		return fmt.Errorf("error decoding response from store: %s", err)
+	if err := json.Unmarshal(body, &storeData); err != nil {
+		return 0, attempts, fmt.Errorf("error decoding response from store: %s", err)
 	}
-
-	c.stats.Users.SubscriberCount = storeData.Total
-	return nil
+	return storeData.Total, attempts, nil
 }
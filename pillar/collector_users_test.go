@@ -3,7 +3,9 @@ package pillar
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 
+	"github.com/armadillica/pillar-statscollector/elastic"
 	"github.com/stretchr/testify/assert"
 
 	log "github.com/sirupsen/logrus"
@@ -35,30 +37,39 @@ func (s *CollectorsUsersTestSuite) TearDownTest(c *check.C) {
 	httpmock.DeactivateAndReset()
 }
 
+const testStoreURL = "http://store.test/product-counter/?prod=cloud"
+
+func (s *CollectorsUsersTestSuite) collect(t *check.C) elastic.Stats {
+	options := DefaultOptions()
+	options.StoreURL = testStoreURL
+	options.BlenderIDURL = ""
+	options.RetryDelay = time.Millisecond
+
+	stats, err := CollectStatsWithOptions(s.session, options)
+	assert.Nil(t, err)
+	return stats
+}
+
 func (s *CollectorsUsersTestSuite) TestStoreRequestHappy(t *check.C) {
 	responder, err := httpmock.NewJsonResponder(200, storeResponse{456})
 	assert.Nil(t, err)
-	httpmock.RegisterResponder(
-		"GET", "https://store.blender.org/product-counter/?prod=cloud",
-		responder,
-	)
-
-	stats, err := CollectStats(s.session, nil)
+	httpmock.RegisterResponder("GET", testStoreURL, responder)
 
-	assert.Nil(t, err)
+	stats := s.collect(t)
 	assert.Equal(t, 456, stats.Users.SubscriberCount)
+	assert.Contains(t, stats.Sections, "store")
 }
 
 func (s *CollectorsUsersTestSuite) TestStoreRequestUnhappy(t *check.C) {
 	httpmock.RegisterResponder(
 		"GET",
-		"https://store.blender.org/product-counter/?prod=cloud",
+		testStoreURL,
 		httpmock.NewErrorResponder(http.ErrHandlerTimeout),
 	)
 
-	stats, err := CollectStats(s.session, nil)
-	assert.Nil(t, err)
+	stats := s.collect(t)
 	assert.Zero(t, stats.Users.SubscriberCount)
+	assert.NotContains(t, stats.Sections, "store")
 
 	// Marshalling to JSON should exclude the susbcriber count.
 	jsonBytes, err := json.Marshal(stats)
@@ -73,3 +84,33 @@ func (s *CollectorsUsersTestSuite) TestStoreRequestUnhappy(t *check.C) {
 	_, ok = usersKnownType["subscriber_count"]
 	assert.False(t, ok)
 }
+
+func (s *CollectorsUsersTestSuite) TestStoreDisabled(t *check.C) {
+	options := DefaultOptions()
+	options.StoreURL = ""
+	options.BlenderIDURL = ""
+
+	// httpmock refuses any request, as there are no responders registered.
+	stats, err := CollectStatsWithOptions(s.session, options)
+	assert.Nil(t, err)
+	assert.Zero(t, stats.Users.SubscriberCount)
+	assert.NotContains(t, stats.Sections, "store")
+	assert.Contains(t, stats.Sections, "users")
+	assert.False(t, stats.Partial)
+}
+
+func (s *CollectorsUsersTestSuite) TestSkipIsNotPartial(t *check.C) {
+	options := DefaultOptions()
+	options.Skip = []string{"store", "blenderid"}
+
+	stats, err := CollectStatsWithOptions(s.session, options)
+	assert.Nil(t, err)
+	assert.NotContains(t, stats.Sections, "store")
+	assert.False(t, stats.Partial)
+
+	options.Skip = nil
+	options.Only = []string{"users"}
+	stats, err = CollectStatsWithOptions(s.session, options)
+	assert.Nil(t, err)
+	assert.True(t, stats.Partial)
+}
@@ -1,7 +1,10 @@
 package pillar
 
 import (
-	"fmt"
+	"context"
+	"net/http"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/armadillica/pillar-statscollector/elastic"
@@ -13,8 +16,9 @@ import (
 type m bson.M
 
 type collector struct {
+	ctx        context.Context
 	now        time.Time
-	stats      *elastic.Stats
+	target     *Target
 	extraQuery *m
 	filesColl  *mgo.Collection
 	projColl   *mgo.Collection
@@ -22,90 +26,211 @@ type collector struct {
 	usersColl  *mgo.Collection
 }
 
+// Options configures the collection of statistics.
+type Options struct {
+	// Before limits the statistics to objects created before this timestamp.
+	// When nil, the current statistics are collected.
+	Before *time.Time
+	// Concurrency is the maximum number of collectors that run at the same time.
+	Concurrency int
+	// Only lists the names of the collectors to run. When empty, all collectors run.
+	Only []string
+	// Skip lists the names of the collectors not to run.
+	Skip []string
+	// Enable lists the names of optional collectors to run next to the default ones, like
+	// "orphans"; see OptionalCollector.
+	Enable []string
+	// TopProjects is the number of projects that use the most storage to include in the document.
+	TopProjects int
+	// ProjectBreakdown enables the storage statistics of all projects in Stats.ProjectStorage.
+	ProjectBreakdown bool
+	// FileSizeBuckets are the upper bounds in bytes of the file size histogram, in ascending order;
+	// see LogBuckets. No histogram is made when empty.
+	FileSizeBuckets []int64
+	// LargestFiles is the number of largest files to include in the document.
+	LargestFiles int
+	// LinkExpiryWindows are the periods for which links that expire within them are counted. They
+	// are also the buckets of the age distribution of expired links.
+	LinkExpiryWindows []time.Duration
+	// BlenderSyncQuota is the storage in bytes that a user's home project can use; users above it
+	// are counted. Zero disables counting.
+	BlenderSyncQuota int64
+	// CollectorTimeout is the maximum duration of each collector; zero means no limit. The overall
+	// deadline is taken from the context passed to CollectStatsContext.
+	CollectorTimeout time.Duration
+
+	// StoreURL is the Blender Store URL to get the subscriber count from.
+	// When empty, the store is not queried.
+	StoreURL string
+	// BlenderIDURL is the Blender ID URL to get the user statistics from.
+	// When empty, Blender ID is not queried.
+	BlenderIDURL string
+	// BlenderIDToken is sent to Blender ID as bearer token, when not empty.
+	BlenderIDToken string
+	// BlenderIDHeaders are sent to Blender ID as additional HTTP headers.
+	BlenderIDHeaders http.Header
+
+	// RetryAttempts is the maximum number of attempts to query the Blender Store and Blender ID.
+	RetryAttempts int
+	// RetryDelay is the delay before the first retry, which doubles for every next retry up to
+	// MaxRetryDelay. A Retry-After response header is respected, up to MaxRetryDelay.
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+}
+
+func (o *Options) retryPolicy() retryPolicy {
+	return retryPolicy{
+		Attempts: o.RetryAttempts,
+		Delay:    o.RetryDelay,
+		MaxDelay: o.MaxRetryDelay,
+	}
+}
+
+// Default values for the options.
+const (
+	DefaultConcurrency  = 4
+	DefaultTopProjects  = 10
+	DefaultLargestFiles = 10
+	// The default file size histogram has buckets up to 1KiB, 16KiB, 256KiB, ..., 16GiB.
+	DefaultFileSizeBucketBase   = 1 << 10
+	DefaultFileSizeBucketFactor = 16
+	DefaultFileSizeBucketCount  = 7
+	// DefaultBlenderSyncQuota is in bytes.
+	DefaultBlenderSyncQuota = 1 << 30
+	DefaultStoreURL         = "https://store.blender.org/product-counter/?prod=cloud"
+	DefaultBlenderIDURL     = "https://www.blender.org/id/api/stats"
+	DefaultHTTPTimeout      = 1 * time.Minute
+
+	DefaultRetryAttempts = 3
+	DefaultRetryDelay    = 1 * time.Second
+	DefaultMaxRetryDelay = 30 * time.Second
+)
+
+// DefaultLinkExpiryWindows returns the default link expiry windows: 1 hour, 1 day and 1 week.
+func DefaultLinkExpiryWindows() []time.Duration {
+	return []time.Duration{time.Hour, 24 * time.Hour, 7 * 24 * time.Hour}
+}
+
+// DefaultOptions returns the options used by CollectStats.
+func DefaultOptions() Options {
+	return Options{
+		Concurrency: DefaultConcurrency,
+		TopProjects: DefaultTopProjects,
+
+		FileSizeBuckets:   LogBuckets(DefaultFileSizeBucketBase, DefaultFileSizeBucketFactor, DefaultFileSizeBucketCount),
+		LargestFiles:      DefaultLargestFiles,
+		LinkExpiryWindows: DefaultLinkExpiryWindows(),
+		BlenderSyncQuota:  DefaultBlenderSyncQuota,
+
+		StoreURL:     DefaultStoreURL,
+		BlenderIDURL: DefaultBlenderIDURL,
+
+		RetryAttempts: DefaultRetryAttempts,
+		RetryDelay:    DefaultRetryDelay,
+		MaxRetryDelay: DefaultMaxRetryDelay,
+	}
+}
+
+// httpClient is used to query the Blender Store and Blender ID. The timeout prevents a hanging
+// endpoint from blocking the collector when no deadline is given.
+var httpClient = &http.Client{Timeout: DefaultHTTPTimeout}
+
 var notDeletedQuery = m{"_deleted": m{"$ne": true}}
 
 const noValueString = "-none-" // Used to prevent empty keys in maps.
 
 // collector methods are defined in the collector_xxx.go files.
 
+// newCollector returns a collector that stores its results in the target.
+func newCollector(ctx context.Context, target *Target) *collector {
+	var extraQuery *m
+	if target.Before != nil {
+		extraQuery = &m{"_created": m{"$lt": target.Before}}
+	}
+
+	db := target.Session.DB("")
+	return &collector{
+		ctx,
+		target.Now,
+		target,
+		extraQuery,
+		db.C("files"),
+		db.C("projects"),
+		db.C("nodes"),
+		db.C("users"),
+	}
+}
+
 // CollectStats collects all the statistics and returns it as elastic.Stats object.
 func CollectStats(session *mgo.Session, before *time.Time) (elastic.Stats, error) {
-	var extraQuery *m
+	options := DefaultOptions()
+	options.Before = before
+	return CollectStatsWithOptions(session, options)
+}
+
+// CollectStatsWithOptions runs all registered collectors and returns the result as elastic.Stats
+// object. When one or more collectors fail, the returned error is a CollectErrors.
+func CollectStatsWithOptions(session *mgo.Session, options Options) (elastic.Stats, error) {
+	return CollectStatsContext(context.Background(), session, options)
+}
+
+// CollectStatsContext is like CollectStatsWithOptions, but stops starting collectors when the
+// context is cancelled, and fails the collectors that were running at that moment. MongoDB queries
+// cannot be interrupted, but are limited to the deadline of the context by the socket timeout.
+func CollectStatsContext(ctx context.Context, session *mgo.Session, options Options) (elastic.Stats, error) {
 	var now time.Time
 
-	if before == nil {
+	if options.Before == nil {
 		now = time.Now().UTC()
 		log.Info("Collecting current statistics")
 	} else {
-		now = *before
-		extraQuery = &m{"_created": m{"$lt": before}}
+		now = *options.Before
 		log.Infof("Collecting statistics before %s", now)
 	}
 
 	stats := elastic.Stats{
 		SchemaVersion: 1,
 		Timestamp:     now,
+		// Skipped collectors leave their sections out, like disabled sources; only an explicit
+		// selection results in a document that is to be merged with an existing one.
+		Partial: len(options.Only) > 0,
 	}
 
-	c := collector{
-		now,
-		&stats,
-		extraQuery,
-		session.DB("").C("files"),
-		session.DB("").C("projects"),
-		session.DB("").C("nodes"),
-		session.DB("").C("users"),
-	}
-
-	// Collect subscribers/Blender ID in another goroutine, because they need to do an HTTP call.
-	storeDone := make(chan error)
-	bidDone := make(chan error)
-	go func() {
-		subsErr := c.countSubscriptions("https://store.blender.org/product-counter/?prod=cloud")
-		storeDone <- subsErr
-	}()
-	go func() {
-		bidErr := c.countBlenderID("https://www.blender.org/id/api/stats")
-		bidDone <- bidErr
-	}()
-
-	if err := c.filesTotalCount(); err != nil {
-		return stats, fmt.Errorf("filesTotalCount: %s", err)
-	}
-	if err := c.filesExpiredLinks(); err != nil {
-		return stats, fmt.Errorf("filesExpiredLinks: %s", err)
+	// Sources without URL are disabled. This doesn't make the document partial, as it's the
+	// same as when the source is unreachable.
+	skip := append([]string{}, options.Skip...)
+	if options.StoreURL == "" {
+		log.Info("Blender Store URL not configured, not querying the store")
+		skip = append(skip, "store")
 	}
-	if err := c.filesEmptyLinks(); err != nil {
-		return stats, fmt.Errorf("filesEmptyLinks: %s", err)
+	if options.BlenderIDURL == "" {
+		log.Info("Blender ID URL not configured, not querying Blender ID")
+		skip = append(skip, "blenderid")
 	}
-	if err := c.filesCountStatsPerStorageBackend(); err != nil {
-		return stats, fmt.Errorf("filesCountStatsPerStorageBackend: %s", err)
-	}
-	if err := c.filesCountStatsPerStatus(); err != nil {
-		return stats, fmt.Errorf("filesCountStatsPerStatus: %s", err)
+	// References to files are always taken from the current documents, so orphans can only be
+	// determined for the current statistics.
+	if options.Before != nil {
+		log.Debug("Not looking for orphan files in historical statistics")
+		skip = append(skip, "orphans")
 	}
 
-	if err := c.projectsCount(); err != nil {
-		return stats, fmt.Errorf("projectsCount: %s", err)
+	collectors, err := selectCollectors(options.Only, skip, options.Enable)
+	if err != nil {
+		return stats, err
 	}
 
-	if err := c.nodesCount(); err != nil {
-		return stats, fmt.Errorf("nodesCount: %s", err)
+	target := Target{
+		Now:     now,
+		Before:  options.Before,
+		Session: session,
+		stats:   &stats,
+		mutex:   new(sync.Mutex),
+		options: &options,
 	}
-
-	if err := c.usersCount(); err != nil {
-		return stats, fmt.Errorf("usersCount: %s", err)
-	}
-	if err := c.countBlenderSyncUsers(); err != nil {
-		return stats, fmt.Errorf("countBlenderSyncUsers: %s", err)
-	}
-
-	// Wait for the remote calls to be done.
-	if err := <-storeDone; err != nil {
-		log.Warningf("Ignoring error from store: %s", err)
-	}
-	if err := <-bidDone; err != nil {
-		log.Warningf("Ignoring error from Blender ID: %s", err)
+	errs := runCollectors(ctx, collectors, target, options.Concurrency, options.CollectorTimeout)
+	sort.Strings(stats.Sections)
+	if len(errs) > 0 {
+		return stats, errs
 	}
 
 	// Done!
@@ -113,6 +238,21 @@ func CollectStats(session *mgo.Session, before *time.Time) (elastic.Stats, error
 	return stats, nil
 }
 
+// update calls fn with the statistics document; see Target.Update.
+func (c *collector) update(fn func(stats *elastic.Stats)) {
+	c.target.Update(fn)
+}
+
+// recordAttempts stores the number of attempts that were needed to query an external source.
+func (c *collector) recordAttempts(source string, attempts int) {
+	c.update(func(stats *elastic.Stats) {
+		if stats.FetchAttempts == nil {
+			stats.FetchAttempts = map[string]int{}
+		}
+		stats.FetchAttempts[source] = attempts
+	})
+}
+
 // aggrPipe(p) returns the given pipeline, possibly prepended with a $match: c.extraQuery.
 func (c *collector) aggrPipe(pipeline []m) []m {
 	if c.extraQuery == nil {
@@ -152,6 +292,22 @@ func (c *collector) query(q m) m {
 	return query
 }
 
+// joinedQuery returns the given query, possibly combined with c.extraQuery applied to the
+// documents joined into the given field by a $lookup.
+// The returned value is a copy, so can be modified without side-effects.
+func (c *collector) joinedQuery(field string, q m) m {
+	query := m{}
+	if c.extraQuery != nil {
+		for k, v := range *c.extraQuery {
+			query[field+"."+k] = v
+		}
+	}
+	for k, v := range q {
+		query[k] = v
+	}
+	return query
+}
+
 // notDeletedQuery returns a "not deleted" query, possibly combined with c.extraQuery.
 // The returned value is a copy, so can be modified without side-effects.
 func (c *collector) notDeletedQuery() m {
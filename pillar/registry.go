@@ -0,0 +1,230 @@
+package pillar
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Collector collects a part of the statistics. The built-in collectors are defined in the
+// collector_xxx.go files, and other packages can add their own with Register().
+type Collector interface {
+	// Name returns the unique name of this collector, for example "files".
+	Name() string
+	// Dependencies returns the names of the collectors that should run before this one.
+	Dependencies() []string
+	// Collect collects the statistics and stores them in the target. It should return when the
+	// context is done.
+	Collect(ctx context.Context, target *Target) error
+}
+
+// OptionalCollector is a Collector that does not run by default, for example because it is
+// expensive. It runs when it is named in Options.Only or Options.Enable.
+type OptionalCollector interface {
+	Collector
+	// Optional returns true when the collector should not run by default.
+	Optional() bool
+}
+
+// isOptional returns true when the collector only runs when selected explicitly.
+func isOptional(coll Collector) bool {
+	optional, ok := coll.(OptionalCollector)
+	return ok && optional.Optional()
+}
+
+// Target gives collectors access to the Pillar database and the statistics document.
+type Target struct {
+	// Now is the timestamp of the statistics; either the current time or the "before" timestamp.
+	Now time.Time
+	// Before is the "before" timestamp, or nil when collecting the current statistics.
+	Before *time.Time
+	// Session is connected to the Pillar database.
+	Session *mgo.Session
+
+	stats   *elastic.Stats
+	mutex   *sync.Mutex
+	options *Options
+}
+
+// Update calls fn with the statistics document, so that the collector can store its results.
+// Collectors run concurrently, so they should only access the document from within fn.
+func (t *Target) Update(fn func(stats *elastic.Stats)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	fn(t.stats)
+}
+
+// Query returns the given query, limited to documents created before t.Before if it is set.
+// The returned value is a copy, so can be modified without side-effects.
+func (t *Target) Query(q bson.M) bson.M {
+	query := bson.M{}
+	if t.Before != nil {
+		query["_created"] = bson.M{"$lt": *t.Before}
+	}
+	for k, v := range q {
+		query[k] = v
+	}
+	return query
+}
+
+var (
+	registry      = map[string]Collector{}
+	registryMutex sync.Mutex
+)
+
+// Register makes a collector available to CollectStats.
+// It panics when the collector is nil or its name was already registered.
+func Register(collector Collector) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if collector == nil {
+		panic("pillar: Register collector is nil")
+	}
+	name := collector.Name()
+	if _, exists := registry[name]; exists {
+		panic("pillar: Register called twice for collector " + name)
+	}
+	registry[name] = collector
+}
+
+// Collectors returns all registered collectors, sorted such that each collector comes after its
+// dependencies. Independent collectors are sorted by name.
+func Collectors() ([]Collector, error) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	sorted := make([]Collector, 0, len(names))
+
+	var visit func(name, dependent string) error
+	visit = func(name, dependent string) error {
+		collector, found := registry[name]
+		if !found {
+			return fmt.Errorf("collector %q depends on unknown collector %q", dependent, name)
+		}
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("circular dependency between collectors %q and %q", dependent, name)
+		}
+
+		state[name] = visiting
+		dependencies := append([]string{}, collector.Dependencies()...)
+		sort.Strings(dependencies)
+		for _, dependency := range dependencies {
+			if err := visit(dependency, name); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		sorted = append(sorted, collector)
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name, ""); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+// selectCollectors returns the registered collectors (see Collectors()), limited to the names in
+// `only` when it is not empty, and without the names in `skip`. Optional collectors are only
+// selected when they are named in `only` or `enable`.
+func selectCollectors(only, skip, enable []string) ([]Collector, error) {
+	collectors, err := Collectors()
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[string]bool{}
+	for _, coll := range collectors {
+		known[coll.Name()] = true
+	}
+	toSet := func(names []string) (map[string]bool, error) {
+		set := map[string]bool{}
+		for _, name := range names {
+			if !known[name] {
+				return nil, fmt.Errorf("unknown collector %q", name)
+			}
+			set[name] = true
+		}
+		return set, nil
+	}
+	onlySet, err := toSet(only)
+	if err != nil {
+		return nil, err
+	}
+	skipSet, err := toSet(skip)
+	if err != nil {
+		return nil, err
+	}
+	enableSet, err := toSet(enable)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := map[string]bool{}
+	result := []Collector{}
+	for _, coll := range collectors {
+		name := coll.Name()
+		if len(onlySet) > 0 && !onlySet[name] || skipSet[name] {
+			continue
+		}
+		if isOptional(coll) && !onlySet[name] && !enableSet[name] {
+			continue
+		}
+		for _, dependency := range coll.Dependencies() {
+			if !selected[dependency] {
+				return nil, fmt.Errorf("collector %q depends on collector %q, which is not selected", name, dependency)
+			}
+		}
+		selected[name] = true
+		result = append(result, coll)
+	}
+	return result, nil
+}
+
+// builtinCollector adapts the collector methods from the collector_xxx.go files to the
+// Collector interface.
+type builtinCollector struct {
+	name         string
+	dependencies []string
+	optional     bool
+	collect      func(c *collector) error
+}
+
+func (b *builtinCollector) Name() string {
+	return b.name
+}
+
+func (b *builtinCollector) Optional() bool {
+	return b.optional
+}
+
+func (b *builtinCollector) Dependencies() []string {
+	return b.dependencies
+}
+
+func (b *builtinCollector) Collect(ctx context.Context, target *Target) error {
+	return b.collect(newCollector(ctx, target))
+}
@@ -0,0 +1,129 @@
+package pillar
+
+import (
+	"context"
+
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+)
+
+type RegistryTestSuite struct {
+	originalRegistry map[string]Collector
+}
+
+var _ = check.Suite(&RegistryTestSuite{})
+
+type dummyCollector struct {
+	name         string
+	dependencies []string
+}
+
+func (d *dummyCollector) Name() string                                      { return d.name }
+func (d *dummyCollector) Dependencies() []string                            { return d.dependencies }
+func (d *dummyCollector) Collect(ctx context.Context, target *Target) error { return nil }
+
+func (s *RegistryTestSuite) SetUpTest(c *check.C) {
+	s.originalRegistry = registry
+	registry = map[string]Collector{}
+}
+
+func (s *RegistryTestSuite) TearDownTest(c *check.C) {
+	registry = s.originalRegistry
+}
+
+func names(collectors []Collector) []string {
+	result := []string{}
+	for _, coll := range collectors {
+		result = append(result, coll.Name())
+	}
+	return result
+}
+
+func (s *RegistryTestSuite) TestBuiltinCollectors(t *check.C) {
+	registry = s.originalRegistry
+
+	collectors, err := Collectors()
+	assert.Nil(t, err)
+	assert.Equal(t,
+		[]string{"blenderid", "blendersync", "files", "nodes", "orphans", "projects", "projectstorage", "store", "users"},
+		names(collectors))
+}
+
+func (s *RegistryTestSuite) TestDependencyOrder(t *check.C) {
+	Register(&dummyCollector{"alpha", []string{"charlie"}})
+	Register(&dummyCollector{"bravo", nil})
+	Register(&dummyCollector{"charlie", []string{"delta", "bravo"}})
+	Register(&dummyCollector{"delta", nil})
+
+	collectors, err := Collectors()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"bravo", "delta", "charlie", "alpha"}, names(collectors))
+}
+
+func (s *RegistryTestSuite) TestUnknownDependency(t *check.C) {
+	Register(&dummyCollector{"alpha", []string{"nonexistant"}})
+
+	_, err := Collectors()
+	assert.NotNil(t, err)
+}
+
+func (s *RegistryTestSuite) TestCircularDependency(t *check.C) {
+	Register(&dummyCollector{"alpha", []string{"bravo"}})
+	Register(&dummyCollector{"bravo", []string{"alpha"}})
+
+	_, err := Collectors()
+	assert.NotNil(t, err)
+}
+
+func (s *RegistryTestSuite) TestDoubleRegistration(t *check.C) {
+	Register(&dummyCollector{"alpha", nil})
+	assert.Panics(t, func() { Register(&dummyCollector{"alpha", nil}) })
+}
+
+func (s *RegistryTestSuite) TestSelectCollectors(t *check.C) {
+	Register(&dummyCollector{"alpha", nil})
+	Register(&dummyCollector{"bravo", []string{"alpha"}})
+	Register(&dummyCollector{"charlie", nil})
+
+	selected, err := selectCollectors(nil, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"alpha", "bravo", "charlie"}, names(selected))
+
+	selected, err = selectCollectors([]string{"charlie", "alpha"}, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"alpha", "charlie"}, names(selected))
+
+	selected, err = selectCollectors(nil, []string{"charlie"}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"alpha", "bravo"}, names(selected))
+
+	// Unknown names and missing dependencies should be refused.
+	_, err = selectCollectors([]string{"delta"}, nil, nil)
+	assert.NotNil(t, err)
+	_, err = selectCollectors(nil, []string{"delta"}, nil)
+	assert.NotNil(t, err)
+	_, err = selectCollectors([]string{"bravo"}, nil, nil)
+	assert.NotNil(t, err)
+	_, err = selectCollectors(nil, []string{"alpha"}, nil)
+	assert.NotNil(t, err)
+}
+
+func (s *RegistryTestSuite) TestSelectOptionalCollectors(t *check.C) {
+	Register(&dummyCollector{"alpha", nil})
+	Register(&builtinCollector{name: "bravo", optional: true})
+
+	selected, err := selectCollectors(nil, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"alpha"}, names(selected))
+
+	selected, err = selectCollectors(nil, nil, []string{"bravo"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"alpha", "bravo"}, names(selected))
+
+	selected, err = selectCollectors([]string{"bravo"}, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"bravo"}, names(selected))
+
+	_, err = selectCollectors(nil, nil, []string{"delta"})
+	assert.NotNil(t, err)
+}
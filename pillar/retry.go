@@ -0,0 +1,109 @@
+package pillar
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// retryPolicy configures how often and how long to wait before retrying an HTTP request.
+type retryPolicy struct {
+	// Attempts is the maximum number of attempts, including the first one.
+	Attempts int
+	// Delay is the delay before the first retry; it doubles with every subsequent retry, up to
+	// MaxDelay. A random jitter of up to half the delay is subtracted, so that clients that failed
+	// at the same time don't retry at the same time.
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// backoff returns the delay before the given retry (1 for the first retry).
+func (p retryPolicy) backoff(retry int) time.Duration {
+	delay := p.Delay
+	for idx := 1; idx < retry && delay < p.MaxDelay; idx++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+// retryAfter returns the delay requested by the Retry-After header, which is either a number of
+// seconds or a HTTP date. Returns 0 when the header is absent or invalid.
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// getWithRetry performs GET requests created by newRequest until one succeeds with status 200,
+// and returns its body and the number of attempts. Network errors, 429 and 5xx responses are
+// retried; a Retry-After header takes precedence over the backoff, limited to MaxDelay.
+func getWithRetry(ctx context.Context, client *http.Client, policy retryPolicy,
+	newRequest func(ctx context.Context) (*http.Request, error)) ([]byte, int, error) {
+
+	for attempts := 1; ; attempts++ {
+		req, err := newRequest(ctx)
+		if err != nil {
+			return nil, attempts, err
+		}
+		logger := log.WithFields(log.Fields{"url": req.URL, "attempt": attempts})
+
+		var wait time.Duration
+		resp, err := client.Do(req)
+		if err == nil {
+			var body []byte
+			body, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			switch {
+			case err != nil:
+				err = fmt.Errorf("error reading response: %s", err)
+			case resp.StatusCode == http.StatusOK:
+				return body, attempts, nil
+			case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+				err = fmt.Errorf("error %d", resp.StatusCode)
+				wait = retryAfter(resp, time.Now())
+			default:
+				// Other errors won't be fixed by retrying.
+				return nil, attempts, fmt.Errorf("error %d", resp.StatusCode)
+			}
+		}
+
+		if attempts >= policy.Attempts || ctx.Err() != nil {
+			return nil, attempts, err
+		}
+		if wait == 0 {
+			wait = policy.backoff(attempts)
+		}
+		if policy.MaxDelay > 0 && wait > policy.MaxDelay {
+			wait = policy.MaxDelay
+		}
+		logger.WithError(err).WithField("retry_in", wait).Warning("request failed, retrying")
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, attempts, fmt.Errorf("%s, not retrying: %s", err, ctx.Err())
+		}
+	}
+}
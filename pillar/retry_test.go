@@ -0,0 +1,119 @@
+package pillar
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+	"gopkg.in/jarcoal/httpmock.v1"
+)
+
+type RetryTestSuite struct{}
+
+var _ = check.Suite(&RetryTestSuite{})
+
+func (s *RetryTestSuite) SetUpTest(c *check.C) {
+	httpmock.Activate()
+}
+
+func (s *RetryTestSuite) TearDownTest(c *check.C) {
+	httpmock.DeactivateAndReset()
+}
+
+const testRetryURL = "http://source.test/stats"
+
+var testRetryPolicy = retryPolicy{Attempts: 3, Delay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+func (s *RetryTestSuite) get(policy retryPolicy) ([]byte, int, error) {
+	newRequest := func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", testRetryURL, nil)
+	}
+	return getWithRetry(context.Background(), httpClient, policy, newRequest)
+}
+
+// respondInSequence returns a responder that returns the responses in order, repeating the last one.
+func respondInSequence(responders ...httpmock.Responder) httpmock.Responder {
+	count := 0
+	return func(req *http.Request) (*http.Response, error) {
+		responder := responders[len(responders)-1]
+		if count < len(responders) {
+			responder = responders[count]
+		}
+		count++
+		return responder(req)
+	}
+}
+
+func (s *RetryTestSuite) TestTransientFailure(t *check.C) {
+	httpmock.RegisterResponder("GET", testRetryURL, respondInSequence(
+		httpmock.NewErrorResponder(http.ErrHandlerTimeout),
+		httpmock.NewStringResponder(503, "down for maintenance"),
+		httpmock.NewStringResponder(200, `{"total": 47}`),
+	))
+
+	body, attempts, err := s.get(testRetryPolicy)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, `{"total": 47}`, string(body))
+}
+
+func (s *RetryTestSuite) TestGiveUp(t *check.C) {
+	httpmock.RegisterResponder("GET", testRetryURL, httpmock.NewStringResponder(500, "oops"))
+
+	_, attempts, err := s.get(testRetryPolicy)
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func (s *RetryTestSuite) TestNotRetryable(t *check.C) {
+	httpmock.RegisterResponder("GET", testRetryURL, httpmock.NewStringResponder(403, "go away"))
+
+	_, attempts, err := s.get(testRetryPolicy)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func (s *RetryTestSuite) TestRetryAfter(t *check.C) {
+	tooMany := httpmock.NewStringResponse(429, "slow down")
+	tooMany.Header.Set("Retry-After", "1")
+	httpmock.RegisterResponder("GET", testRetryURL, respondInSequence(
+		httpmock.ResponderFromResponse(tooMany),
+		httpmock.NewStringResponder(200, `{}`),
+	))
+
+	// The Retry-After delay is limited to the maximum delay.
+	policy := testRetryPolicy
+	policy.MaxDelay = 50 * time.Millisecond
+	start := time.Now()
+	_, attempts, err := s.get(policy)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func (s *RetryTestSuite) TestRetryAfterHeader(t *check.C) {
+	now := time.Date(2018, 3, 14, 12, 0, 0, 0, time.UTC)
+	resp := &http.Response{Header: http.Header{}}
+	assert.Equal(t, time.Duration(0), retryAfter(resp, now))
+
+	resp.Header.Set("Retry-After", "120")
+	assert.Equal(t, 2*time.Minute, retryAfter(resp, now))
+
+	resp.Header.Set("Retry-After", now.Add(30*time.Second).Format(http.TimeFormat))
+	assert.Equal(t, 30*time.Second, retryAfter(resp, now))
+
+	resp.Header.Set("Retry-After", "soon")
+	assert.Equal(t, time.Duration(0), retryAfter(resp, now))
+}
+
+func (s *RetryTestSuite) TestBackoff(t *check.C) {
+	policy := retryPolicy{Attempts: 10, Delay: time.Second, MaxDelay: 5 * time.Second}
+	for retry, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		delay := policy.backoff(retry + 1)
+		assert.True(t, delay > expected/2, "retry %d: %s", retry+1, delay)
+		assert.True(t, delay <= expected, "retry %d: %s", retry+1, delay)
+	}
+}
@@ -0,0 +1,162 @@
+package pillar
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	log "github.com/sirupsen/logrus"
+)
+
+// CollectErrors maps collector names to the error they returned.
+type CollectErrors map[string]error
+
+func (errs CollectErrors) Error() string {
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	messages := make([]string, len(names))
+	for idx, name := range names {
+		messages[idx] = fmt.Sprintf("%s: %s", name, errs[name])
+	}
+	return strings.Join(messages, "; ")
+}
+
+type ignoredError struct {
+	error
+}
+
+// Ignore wraps an error returned by a collector, so that it is logged but doesn't fail the
+// collection of statistics. Use this for sources that can be unreachable at times; the collector
+// is then omitted from the collected sections of the statistics document.
+func Ignore(err error) error {
+	return ignoredError{err}
+}
+
+// runCollectors runs the collectors concurrently, with at most `concurrency` collectors running at
+// the same time. A collector only starts after its dependencies have finished, and is skipped when
+// one of them failed or was ignored. The names of the successful collectors are stored in the
+// collected sections of the statistics document. Each collector gets its own copy of the MongoDB session, so that their
+// queries don't have to wait for each other. A timeout > 0 limits the duration of each collector.
+// Collectors that haven't started when the context is done fail with the context's error.
+func runCollectors(ctx context.Context, collectors []Collector, target Target, concurrency int, timeout time.Duration) CollectErrors {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	done := map[string]chan struct{}{}
+	for _, coll := range collectors {
+		done[coll.Name()] = make(chan struct{})
+	}
+
+	errs := CollectErrors{}
+	errsMutex := sync.Mutex{}
+	setError := func(name string, err error) {
+		errsMutex.Lock()
+		defer errsMutex.Unlock()
+		errs[name] = err
+	}
+	hasFailed := func(name string) bool {
+		errsMutex.Lock()
+		defer errsMutex.Unlock()
+		_, failed := errs[name]
+		return failed
+	}
+	wasCollected := func(name string) (collected bool) {
+		target.Update(func(stats *elastic.Stats) {
+			for _, section := range stats.Sections {
+				if section == name {
+					collected = true
+				}
+			}
+		})
+		return
+	}
+
+	semaphore := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+
+	for _, coll := range collectors {
+		wg.Add(1)
+		go func(coll Collector) {
+			defer wg.Done()
+			name := coll.Name()
+			defer close(done[name])
+			logger := log.WithField("collector", name)
+
+			for _, dependency := range coll.Dependencies() {
+				<-done[dependency]
+				if hasFailed(dependency) {
+					logger.WithField("dependency", dependency).Warning("skipping collector, dependency failed")
+					setError(name, fmt.Errorf("dependency %q failed", dependency))
+					return
+				}
+				if !wasCollected(dependency) {
+					logger.WithField("dependency", dependency).Warning("skipping collector, dependency was ignored")
+					return
+				}
+			}
+
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-ctx.Done():
+				logger.WithError(ctx.Err()).Warning("not running collector")
+				setError(name, ctx.Err())
+				return
+			}
+
+			collCtx := ctx
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				collCtx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+
+			collTarget := target
+			collTarget.Session = target.Session.Copy()
+			defer collTarget.Session.Close()
+			if deadline, hasDeadline := collCtx.Deadline(); hasDeadline {
+				collTarget.Session.SetSocketTimeout(time.Until(deadline))
+			}
+
+			logger.Debug("running collector")
+			err := coll.Collect(collCtx, &collTarget)
+			switch ignored, isIgnored := err.(ignoredError); {
+			case err == nil:
+			case ctx.Err() != nil:
+				// Cancellation of the entire run is never ignored.
+				err = fmt.Errorf("%s: %s", ctx.Err(), err)
+			case collCtx.Err() != nil && isIgnored:
+				err = Ignore(fmt.Errorf("timeout after %s: %s", timeout, ignored.error))
+			case collCtx.Err() != nil:
+				err = fmt.Errorf("timeout after %s: %s", timeout, err)
+			}
+			switch err.(type) {
+			case nil:
+			case ignoredError:
+				logger.WithError(err).Warning("ignoring error from collector")
+				return
+			default:
+				logger.WithError(err).Error("collector failed")
+				setError(name, err)
+				return
+			}
+
+			target.Update(func(stats *elastic.Stats) {
+				stats.Sections = append(stats.Sections, name)
+			})
+			logger.Debug("collector done")
+		}(coll)
+	}
+
+	wg.Wait()
+	return errs
+}
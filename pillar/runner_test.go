@@ -0,0 +1,198 @@
+package pillar
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	"github.com/stretchr/testify/assert"
+
+	log "github.com/sirupsen/logrus"
+	check "gopkg.in/check.v1"
+	mgo "gopkg.in/mgo.v2"
+)
+
+type RunnerTestSuite struct {
+	session *mgo.Session
+}
+
+var _ = check.Suite(&RunnerTestSuite{})
+
+func (s *RunnerTestSuite) SetUpTest(c *check.C) {
+	session, err := mgo.Dial("mongodb://localhost/unittests")
+	if err != nil {
+		log.Panic(err)
+	}
+
+	s.session = session
+}
+
+func (s *RunnerTestSuite) TearDownTest(c *check.C) {
+	s.session.DB("").DropDatabase()
+	s.session.Close()
+}
+
+// funcCollector calls a function to collect statistics.
+type funcCollector struct {
+	name         string
+	dependencies []string
+	collect      func(target *Target) error
+}
+
+func (f *funcCollector) Name() string           { return f.name }
+func (f *funcCollector) Dependencies() []string { return f.dependencies }
+func (f *funcCollector) Collect(ctx context.Context, target *Target) error {
+	return f.collect(target)
+}
+
+func (s *RunnerTestSuite) target(stats *elastic.Stats) Target {
+	return Target{
+		Now:     time.Now().UTC(),
+		Session: s.session,
+		stats:   stats,
+		mutex:   new(sync.Mutex),
+	}
+}
+
+func (s *RunnerTestSuite) TestConcurrencyLimit(t *check.C) {
+	mutex := sync.Mutex{}
+	running := 0
+	maxRunning := 0
+
+	collect := func(target *Target) error {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+		target.Update(func(stats *elastic.Stats) { stats.Projects.TotalCount++ })
+
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		return nil
+	}
+
+	collectors := []Collector{}
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		collectors = append(collectors, &funcCollector{name, nil, collect})
+	}
+
+	stats := elastic.Stats{}
+	errs := runCollectors(context.Background(), collectors, s.target(&stats), 2, 0)
+	assert.Empty(t, errs)
+	assert.Equal(t, 2, maxRunning)
+	assert.Equal(t, 6, stats.Projects.TotalCount)
+}
+
+func (s *RunnerTestSuite) TestDependencies(t *check.C) {
+	collectors := []Collector{
+		&funcCollector{"first", nil, func(target *Target) error {
+			time.Sleep(20 * time.Millisecond)
+			target.Update(func(stats *elastic.Stats) { stats.Users.TotalCount = 47 })
+			return nil
+		}},
+		&funcCollector{"second", []string{"first"}, func(target *Target) error {
+			target.Update(func(stats *elastic.Stats) {
+				stats.Users.TotalRealUserCount = stats.Users.TotalCount - 1
+			})
+			return nil
+		}},
+	}
+
+	stats := elastic.Stats{}
+	errs := runCollectors(context.Background(), collectors, s.target(&stats), 4, 0)
+	assert.Empty(t, errs)
+	assert.Equal(t, 46, stats.Users.TotalRealUserCount)
+}
+
+func (s *RunnerTestSuite) TestErrorsPerCollector(t *check.C) {
+	collectors := []Collector{
+		&funcCollector{"failing", nil, func(target *Target) error {
+			return errors.New("oh no")
+		}},
+		&funcCollector{"dependent", []string{"failing"}, func(target *Target) error {
+			assert.Fail(t, "dependent collector should not run")
+			return nil
+		}},
+		&funcCollector{"independent", nil, func(target *Target) error {
+			target.Update(func(stats *elastic.Stats) { stats.Nodes.TotalPublicNodeCount = 5 })
+			return nil
+		}},
+	}
+
+	stats := elastic.Stats{}
+	errs := runCollectors(context.Background(), collectors, s.target(&stats), 4, 0)
+	assert.Len(t, errs, 2)
+	assert.EqualError(t, errs["failing"], "oh no")
+	assert.NotNil(t, errs["dependent"])
+	assert.Equal(t, 5, stats.Nodes.TotalPublicNodeCount)
+	assert.Equal(t, `dependent: dependency "failing" failed; failing: oh no`, errs.Error())
+}
+
+func (s *RunnerTestSuite) TestIgnoredErrors(t *check.C) {
+	collectors := []Collector{
+		&funcCollector{"flaky", nil, func(target *Target) error {
+			return Ignore(errors.New("unreachable"))
+		}},
+		&funcCollector{"dependent", []string{"flaky"}, func(target *Target) error {
+			assert.Fail(t, "dependent collector should not run")
+			return nil
+		}},
+		&funcCollector{"solid", nil, func(target *Target) error {
+			return nil
+		}},
+	}
+
+	stats := elastic.Stats{}
+	errs := runCollectors(context.Background(), collectors, s.target(&stats), 4, 0)
+	assert.Empty(t, errs)
+	assert.Equal(t, []string{"solid"}, stats.Sections)
+}
+
+// waitCollector waits until its context is done.
+type waitCollector struct {
+	name string
+}
+
+func (w *waitCollector) Name() string           { return w.name }
+func (w *waitCollector) Dependencies() []string { return nil }
+func (w *waitCollector) Collect(ctx context.Context, target *Target) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (s *RunnerTestSuite) TestCollectorTimeout(t *check.C) {
+	collectors := []Collector{
+		&waitCollector{"hanging"},
+		&funcCollector{"quick", nil, func(target *Target) error {
+			return nil
+		}},
+	}
+
+	stats := elastic.Stats{}
+	errs := runCollectors(context.Background(), collectors, s.target(&stats), 4, 10*time.Millisecond)
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs["hanging"].Error(), "timeout after 10ms")
+	assert.Equal(t, []string{"quick"}, stats.Sections)
+}
+
+func (s *RunnerTestSuite) TestCancelled(t *check.C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	// With a concurrency of 1, one collector runs and the other waits for it.
+	collectors := []Collector{&waitCollector{"running"}, &waitCollector{"queued"}}
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	stats := elastic.Stats{}
+	errs := runCollectors(ctx, collectors, s.target(&stats), 1, 0)
+	assert.Len(t, errs, 2)
+	for _, err := range errs {
+		assert.Contains(t, err.Error(), context.Canceled.Error())
+	}
+	assert.Empty(t, stats.Sections)
+}
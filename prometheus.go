@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	"github.com/armadillica/pillar-statscollector/metrics"
+	"github.com/armadillica/pillar-statscollector/pillar"
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// metricsShutdownTimeout is how long running scrapes get to finish when the server stops.
+const metricsShutdownTimeout = 10 * time.Second
+
+// serveMetrics serves the current statistics as Prometheus metrics on /metrics, until the context
+// is cancelled. Statistics are either refreshed periodically, or when scraped and older than the
+// cache TTL. In both cases they are collected in the background, and scrapes get the cached
+// statistics.
+func serveMetrics(ctx context.Context, mgoCloud *mgo.Session) error {
+	collect := func() (elastic.Stats, error) {
+		// Re-establish the session's connection if it was broken since the last refresh.
+		mgoCloud.Refresh()
+		ctx, cancel := runContext(ctx)
+		defer cancel()
+		return pillar.CollectStatsContext(ctx, mgoCloud, collectOptions(nil))
+	}
+
+	var exporter *metrics.Exporter
+	if config.Metrics.RefreshInterval <= 0 && config.Metrics.CacheTTL <= 0 {
+		return errors.New("configure either the metrics refresh interval or the cache TTL")
+	}
+	if config.Metrics.RefreshInterval > 0 {
+		exporter = metrics.NewExporter(collect, 0)
+		go exporter.RefreshEvery(config.Metrics.RefreshInterval, ctx.Done())
+	} else {
+		exporter = metrics.NewExporter(collect, config.Metrics.CacheTTL)
+		go exporter.Refresh()
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", exporter)
+
+	log.WithFields(log.Fields{
+		"listen":           config.Metrics.Listen,
+		"refresh_interval": config.Metrics.RefreshInterval,
+		"cache_ttl":        config.Metrics.CacheTTL,
+	}).Warning("serving Prometheus metrics on /metrics")
+
+	server := &http.Server{Addr: config.Metrics.Listen, Handler: mux}
+	shutdownDone := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		log.Warning("shutting down the Prometheus metrics server")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+		shutdownDone <- server.Shutdown(shutdownCtx)
+	}()
+
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return <-shutdownDone
+}
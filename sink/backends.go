@@ -0,0 +1,181 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	"github.com/armadillica/pillar-statscollector/influx"
+	"github.com/armadillica/pillar-statscollector/mongo"
+	log "github.com/sirupsen/logrus"
+	mgo "gopkg.in/mgo.v2"
+)
+
+type mongoSink struct {
+	session *mgo.Session
+}
+
+// NewMongo returns a sink that stores documents in the stats collection, using a copy of the
+// session. Partial documents are merged into existing documents.
+func NewMongo(session *mgo.Session) Sink {
+	return &mongoSink{session.Copy()}
+}
+
+func (m *mongoSink) Push(ctx context.Context, stats *elastic.Stats) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := mongo.PushContext(ctx, m.session, stats); err != nil {
+		return err
+	}
+	if len(stats.ProjectStorage) == 0 {
+		return nil
+	}
+	return mongo.PushProjects(m.session, stats.ProjectStorage)
+}
+
+func (m *mongoSink) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (m *mongoSink) Close() error {
+	m.session.Close()
+	return nil
+}
+
+type elasticSink struct {
+	url string
+}
+
+// NewElastic returns a sink that pushes documents to ElasticSearch.
+func NewElastic(elasticURL string) Sink {
+	return &elasticSink{elasticURL}
+}
+
+func (e *elasticSink) Push(ctx context.Context, stats *elastic.Stats) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := elastic.PushContext(ctx, e.url, *stats); err != nil {
+		return err
+	}
+	if len(stats.ProjectStorage) == 0 {
+		return nil
+	}
+	return elastic.PushProjects(ctx, e.url, stats.ProjectStorage)
+}
+
+func (e *elasticSink) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (e *elasticSink) Close() error {
+	return nil
+}
+
+type elasticBulkSink struct {
+	url    string
+	pusher *elastic.BulkPusher
+}
+
+// NewElasticBulk returns a sink that pushes documents to ElasticSearch in batches, using the bulk
+// API. Close() logs the number of indexed and failed documents.
+func NewElasticBulk(elasticURL string, options elastic.BulkOptions) (Sink, error) {
+	pusher, err := elastic.NewBulkPusher(elasticURL, options)
+	if err != nil {
+		return nil, err
+	}
+	return &elasticBulkSink{elasticURL, pusher}, nil
+}
+
+func (e *elasticBulkSink) Push(ctx context.Context, stats *elastic.Stats) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := e.pusher.Add(ctx, *stats); err != nil {
+		return err
+	}
+	// The project documents of one statistics document are already pushed in batches by
+	// PushProjects, so they are not queued together with the statistics documents.
+	if len(stats.ProjectStorage) == 0 {
+		return nil
+	}
+	return elastic.PushProjects(ctx, e.url, stats.ProjectStorage)
+}
+
+func (e *elasticBulkSink) Flush(ctx context.Context) error {
+	return e.pusher.Flush(ctx)
+}
+
+func (e *elasticBulkSink) Close() error {
+	err := e.pusher.Flush(context.Background())
+	summary := e.pusher.Summary()
+	log.WithFields(log.Fields{
+		"indexed": summary.Indexed,
+		"failed":  summary.Failed,
+		"retried": summary.Retried,
+	}).Info("done bulk-pushing to ElasticSearch")
+	return err
+}
+
+type influxSink struct {
+	url       string
+	batchSize int
+	batch     []elastic.Stats
+}
+
+// NewInflux returns a sink that writes documents to InfluxDB. Documents are buffered until
+// batchSize documents are pushed or the sink is flushed.
+func NewInflux(writeURL string, batchSize int) Sink {
+	return &influxSink{url: writeURL, batchSize: batchSize}
+}
+
+func (i *influxSink) Push(ctx context.Context, stats *elastic.Stats) error {
+	i.batch = append(i.batch, *stats)
+	if len(i.batch) < i.batchSize {
+		return nil
+	}
+	return i.Flush(ctx)
+}
+
+func (i *influxSink) Flush(ctx context.Context) error {
+	if len(i.batch) == 0 {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := influx.PushContext(ctx, i.url, i.batch...)
+	// Drop the batch even when it failed, so that a broken InfluxDB doesn't make it grow forever.
+	i.batch = i.batch[:0]
+	return err
+}
+
+func (i *influxSink) Close() error {
+	return i.Flush(context.Background())
+}
+
+type logSink struct{}
+
+// NewLog returns a sink that only logs the documents as JSON.
+func NewLog() Sink {
+	return logSink{}
+}
+
+func (logSink) Push(ctx context.Context, stats *elastic.Stats) error {
+	asJSON, err := json.MarshalIndent(stats, "", "    ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal to JSON: %s", err)
+	}
+	log.Infof("Statistics:\n%s\n", string(asJSON))
+	return nil
+}
+
+func (logSink) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (logSink) Close() error {
+	return nil
+}
@@ -0,0 +1,127 @@
+// Package sink contains the destinations that statistics documents are pushed to.
+package sink
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	log "github.com/sirupsen/logrus"
+)
+
+// Sink is a destination for statistics documents.
+type Sink interface {
+	// Push stores the statistics document. Sinks may update the document, for example when
+	// MongoDB merges a partial document into an existing one; later sinks see those changes.
+	Push(ctx context.Context, stats *elastic.Stats) error
+	// Flush sends any documents that were buffered by Push.
+	Flush(ctx context.Context) error
+	// Close flushes the sink and releases its resources.
+	Close() error
+}
+
+// Policy determines what happens when a sink fails.
+type Policy int
+
+const (
+	// Required sinks make the push fail when they fail.
+	Required Policy = iota
+	// BestEffort sinks only log a warning when they fail.
+	BestEffort
+)
+
+func (p Policy) String() string {
+	if p == Required {
+		return "required"
+	}
+	return "best-effort"
+}
+
+// Errors maps sink names to the error they returned.
+type Errors map[string]error
+
+func (errs Errors) Error() string {
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	messages := make([]string, len(names))
+	for idx, name := range names {
+		messages[idx] = fmt.Sprintf("%s: %s", name, errs[name])
+	}
+	return strings.Join(messages, "; ")
+}
+
+type output struct {
+	name   string
+	sink   Sink
+	policy Policy
+}
+
+// Fanout is a Sink that pushes to multiple sinks, in the order in which they were added.
+// All sinks are used even when one of them fails. Only failures of required sinks are returned,
+// as Errors; failures of best-effort sinks are logged.
+type Fanout struct {
+	outputs []output
+}
+
+// NewFanout returns a Fanout without sinks.
+func NewFanout() *Fanout {
+	return &Fanout{}
+}
+
+// Add adds a sink with the given name, which is used in logging and errors.
+func (f *Fanout) Add(name string, sink Sink, policy Policy) {
+	f.outputs = append(f.outputs, output{name, sink, policy})
+}
+
+// Len returns the number of sinks.
+func (f *Fanout) Len() int {
+	return len(f.outputs)
+}
+
+// Push pushes the statistics document to all sinks.
+func (f *Fanout) Push(ctx context.Context, stats *elastic.Stats) error {
+	return f.each("push", func(sink Sink) error { return sink.Push(ctx, stats) })
+}
+
+// Flush flushes all sinks.
+func (f *Fanout) Flush(ctx context.Context) error {
+	return f.each("flush", func(sink Sink) error { return sink.Flush(ctx) })
+}
+
+// Close closes all sinks.
+func (f *Fanout) Close() error {
+	return f.each("close", func(sink Sink) error { return sink.Close() })
+}
+
+func (f *Fanout) each(action string, fn func(sink Sink) error) error {
+	errs := Errors{}
+	for _, out := range f.outputs {
+		err := fn(out.sink)
+		if err == nil {
+			continue
+		}
+
+		logger := log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"sink":       out.name,
+			"policy":     out.policy,
+		})
+		if out.policy == BestEffort {
+			logger.Warningf("unable to %s to sink, continuing", action)
+			continue
+		}
+		logger.Errorf("unable to %s to sink", action)
+		errs[out.name] = err
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
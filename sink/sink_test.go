@@ -0,0 +1,86 @@
+package sink
+
+import (
+	"context"
+	"errors"
+
+	"github.com/armadillica/pillar-statscollector/elastic"
+	"github.com/stretchr/testify/assert"
+	check "gopkg.in/check.v1"
+)
+
+type FanoutTestSuite struct{}
+
+var _ = check.Suite(&FanoutTestSuite{})
+
+// recordingSink records the pushed documents, and fails when err is set.
+type recordingSink struct {
+	pushed  []elastic.Stats
+	flushed int
+	closed  bool
+	err     error
+}
+
+func (r *recordingSink) Push(ctx context.Context, stats *elastic.Stats) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.pushed = append(r.pushed, *stats)
+	stats.ID = "pushed"
+	return nil
+}
+
+func (r *recordingSink) Flush(ctx context.Context) error {
+	r.flushed++
+	return r.err
+}
+
+func (r *recordingSink) Close() error {
+	r.closed = true
+	return nil
+}
+
+func (s *FanoutTestSuite) TestPushAll(t *check.C) {
+	first := &recordingSink{}
+	second := &recordingSink{}
+	fanout := NewFanout()
+	fanout.Add("first", first, Required)
+	fanout.Add("second", second, BestEffort)
+
+	stats := elastic.Stats{SchemaVersion: 1}
+	assert.Nil(t, fanout.Push(context.Background(), &stats))
+	assert.Nil(t, fanout.Flush(context.Background()))
+	assert.Nil(t, fanout.Close())
+
+	assert.Len(t, first.pushed, 1)
+	// Changes made by a sink should be visible to the next sink.
+	assert.Equal(t, "pushed", second.pushed[0].ID)
+	assert.Equal(t, 1, first.flushed)
+	assert.Equal(t, 1, second.flushed)
+	assert.True(t, first.closed)
+	assert.True(t, second.closed)
+}
+
+func (s *FanoutTestSuite) TestBestEffortFailure(t *check.C) {
+	failing := &recordingSink{err: errors.New("connection refused")}
+	working := &recordingSink{}
+	fanout := NewFanout()
+	fanout.Add("mongo", working, Required)
+	fanout.Add("elastic", failing, BestEffort)
+
+	assert.Nil(t, fanout.Push(context.Background(), &elastic.Stats{}))
+	assert.Len(t, working.pushed, 1)
+}
+
+func (s *FanoutTestSuite) TestRequiredFailure(t *check.C) {
+	failing := &recordingSink{err: errors.New("connection refused")}
+	working := &recordingSink{}
+	fanout := NewFanout()
+	fanout.Add("mongo", failing, Required)
+	fanout.Add("elastic", working, BestEffort)
+
+	err := fanout.Push(context.Background(), &elastic.Stats{})
+	assert.Equal(t, "mongo: connection refused", err.Error())
+	// The other sinks should still be used.
+	assert.Len(t, working.pushed, 1)
+}